@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// Файлы альбома приходят отдельными апдейтами почти одновременно; после
+// такой паузы без новых файлов альбом считается полученным целиком
+const albumQuietPeriod = 2 * time.Second
+
+type albumItem struct {
+	msgID int
+	doc   *tg.Document
+}
+
+type album struct {
+	peer  tg.InputPeerClass
+	items []albumItem
+	timer *time.Timer
+	// seq растёт с каждым файлом, чтобы сработавший ранее таймер не отдал альбом раньше времени
+	seq int
+}
+
+// albumBuffer собирает аудио одного альбома по GroupedID и отдаёт их
+// в flush все сразу, чтобы обработать по порядку одной задачей.
+type albumBuffer struct {
+	mu     sync.Mutex
+	quiet  time.Duration
+	albums map[int64]*album
+	flush  func(peer tg.InputPeerClass, items []albumItem)
+	// afterFunc подменяется в тестах
+	afterFunc func(d time.Duration, f func()) *time.Timer
+}
+
+func newAlbumBuffer(quiet time.Duration, flush func(peer tg.InputPeerClass, items []albumItem)) *albumBuffer {
+	return &albumBuffer{
+		quiet:     quiet,
+		albums:    make(map[int64]*album),
+		flush:     flush,
+		afterFunc: time.AfterFunc,
+	}
+}
+
+// Add добавляет файл в альбом groupID и откладывает его обработку.
+func (b *albumBuffer) Add(groupID int64, peer tg.InputPeerClass, msgID int, doc *tg.Document) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	a, ok := b.albums[groupID]
+	if !ok {
+		a = &album{peer: peer}
+		b.albums[groupID] = a
+	} else {
+		a.timer.Stop()
+	}
+	a.items = append(a.items, albumItem{msgID: msgID, doc: doc})
+	a.seq++
+	seq := a.seq
+	a.timer = b.afterFunc(b.quiet, func() { b.release(groupID, a, seq) })
+}
+
+func (b *albumBuffer) release(groupID int64, a *album, seq int) {
+	b.mu.Lock()
+	if b.albums[groupID] != a || a.seq != seq {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.albums, groupID)
+	b.mu.Unlock()
+
+	// Апдейты могут прийти не по порядку, а в альбоме важен порядок сообщений
+	slices.SortFunc(a.items, func(x, y albumItem) int { return x.msgID - y.msgID })
+	b.flush(a.peer, a.items)
+}
+
+// Flush сразу отдаёт все альбомы, которые ещё ждут паузы, и возвращает их
+// число. Вызывается при остановке, чтобы файлы успели попасть в очередь.
+func (b *albumBuffer) Flush() int {
+	b.mu.Lock()
+	pending := b.albums
+	b.albums = make(map[int64]*album)
+	b.mu.Unlock()
+
+	for _, a := range pending {
+		a.timer.Stop()
+		slices.SortFunc(a.items, func(x, y albumItem) int { return x.msgID - y.msgID })
+		b.flush(a.peer, a.items)
+	}
+	return len(pending)
+}
+
+// enqueueAlbum ставит альбом в очередь одной задачей: файлы обрабатываются
+// по порядку, после чего в чат отправляется одна сводка.
+func (h *messageHandler) enqueueAlbum(peer tg.InputPeerClass, items []albumItem) {
+	name := fmt.Sprintf("album of %d files", len(items))
+	if err := h.queue.Enqueue(name, func(ctx context.Context) error {
+		var (
+			converted int
+			failed    []string
+		)
+		for _, it := range items {
+			if err := convertMessage(ctx, h.lg, h.api, peer, it.msgID, it.doc, time.Time{}, h.files, h.processed); err != nil {
+				h.lg.Error("Convert album file", zap.Int("msg_id", it.msgID), zap.Error(err))
+				failed = append(failed, fmt.Sprintf("%s: %s", getFileName(it.doc), err))
+				continue
+			}
+			converted++
+		}
+		if len(items) < 2 || dryRun {
+			return nil
+		}
+		return errors.Wrap(sendMessage(ctx, h.api, peer, summaryText(converted, failed), 0), "send album summary")
+	}); err != nil {
+		h.lg.Error("Enqueue album", zap.Error(err))
+	}
+}
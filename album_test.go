@@ -0,0 +1,155 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestAlbumBuffer(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	type member struct {
+		group int64
+		msgID int
+	}
+
+	tests := []struct {
+		name    string
+		members []member
+		want    [][]int // ID сообщений каждого отданного альбома
+	}{
+		{name: "single file", members: []member{{group: 1, msgID: 10}}, want: [][]int{{10}}},
+		{name: "members are sorted", members: []member{{group: 1, msgID: 12}, {group: 1, msgID: 10}, {group: 1, msgID: 11}}, want: [][]int{{10, 11, 12}}},
+		{name: "groups are separate", members: []member{{group: 1, msgID: 10}, {group: 2, msgID: 20}, {group: 1, msgID: 11}}, want: [][]int{{10, 11}, {20}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			var got [][]int
+			b := newAlbumBuffer(albumQuietPeriod, func(_ tg.InputPeerClass, items []albumItem) {
+				var ids []int
+				for _, it := range items {
+					ids = append(ids, it.msgID)
+				}
+				got = append(got, ids)
+			})
+			b.afterFunc = clock.afterFunc
+
+			for _, m := range tt.members {
+				b.Add(m.group, peer, m.msgID, &tg.Document{ID: int64(m.msgID)})
+			}
+			// Таймеры ранних файлов тоже срабатывают, но альбом отдаётся один раз
+			clock.fire()
+
+			slices.SortFunc(got, func(x, y []int) int { return x[0] - y[0] })
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("flushed %v, want %v", got, tt.want)
+			}
+			if len(b.albums) != 0 {
+				t.Errorf("%d albums left in buffer", len(b.albums))
+			}
+		})
+	}
+}
+
+func TestAlbumBufferWaitsForQuietPeriod(t *testing.T) {
+	clock := &fakeClock{}
+	var flushed int
+	b := newAlbumBuffer(albumQuietPeriod, func(tg.InputPeerClass, []albumItem) { flushed++ })
+	b.afterFunc = clock.afterFunc
+	peer := &tg.InputPeerChannel{ChannelID: 1}
+
+	b.Add(1, peer, 10, &tg.Document{ID: 10})
+	stale := clock.pending
+	clock.pending = nil
+	b.Add(1, peer, 11, &tg.Document{ID: 11})
+
+	// Таймер первого файла устарел и не отдаёт альбом
+	for _, f := range stale {
+		f()
+	}
+	if flushed != 0 {
+		t.Fatalf("album flushed by a stale timer")
+	}
+	clock.fire()
+	if flushed != 1 {
+		t.Errorf("album flushed %d times, want 1", flushed)
+	}
+}
+
+func TestAlbumBufferFlush(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1}
+
+	tests := []struct {
+		name    string
+		members map[int64][]int // ID сообщений по GroupedID
+		want    [][]int
+	}{
+		{name: "nothing pending"},
+		{name: "pending albums are flushed", members: map[int64][]int{1: {11, 10}, 2: {20}}, want: [][]int{{10, 11}, {20}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			var got [][]int
+			b := newAlbumBuffer(albumQuietPeriod, func(_ tg.InputPeerClass, items []albumItem) {
+				var ids []int
+				for _, it := range items {
+					ids = append(ids, it.msgID)
+				}
+				got = append(got, ids)
+			})
+			b.afterFunc = clock.afterFunc
+			for group, ids := range tt.members {
+				for _, id := range ids {
+					b.Add(group, peer, id, &tg.Document{ID: int64(id)})
+				}
+			}
+
+			if n := b.Flush(); n != len(tt.want) {
+				t.Errorf("Flush() = %d, want %d", n, len(tt.want))
+			}
+			// Таймеры, сработавшие после Flush, не отдают альбомы второй раз
+			clock.fire()
+
+			slices.SortFunc(got, func(x, y []int) int { return x[0] - y[0] })
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("flushed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerAlbum(t *testing.T) {
+	setFakeConverter(t)
+	api := &stubAPI{}
+	hh := newHandlerHarness(t, api)
+	clock := &fakeClock{}
+	hh.h.albums = newAlbumBuffer(albumQuietPeriod, hh.h.enqueueAlbum)
+	hh.h.albums.afterFunc = clock.afterFunc
+
+	// Второй файл альбома пришёл раньше первого
+	for _, msg := range []*tg.Message{hh.audioMessage(11, "audio/mpeg", "two.mp3"), hh.audioMessage(10, "audio/mpeg", "one.mp3")} {
+		msg.SetGroupedID(77)
+		hh.deliver(t, &tg.UpdateNewChannelMessage{Message: msg}, msg)
+	}
+	if len(clock.pending) == 0 {
+		t.Fatal("album files are not buffered")
+	}
+	clock.fire()
+	hh.drain(t)
+
+	var replies []int
+	for _, req := range api.sentMedia {
+		if reply, ok := req.ReplyTo.(*tg.InputReplyToMessage); ok {
+			replies = append(replies, reply.ReplyToMsgID)
+		}
+	}
+	if !slices.Equal(replies, []int{10, 11}) {
+		t.Errorf("voices sent in reply to %v, want [10 11]", replies)
+	}
+	if len(api.sentMessages) != 1 || api.sentMessages[0].Message != summaryText(2, nil) {
+		t.Errorf("summaries = %v, want one %q", api.sentMessages, summaryText(2, nil))
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+func TestSendVoiceRequest(t *testing.T) {
+	setFakeConverter(t)
+	peer := &tg.InputPeerUser{UserID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name string
+		opts voiceOptions
+	}{
+		{name: "plain voice"},
+		{name: "reply with caption", opts: voiceOptions{ReplyTo: 10, Caption: "Artist — Song", RandomID: 42}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := []byte("OggS converted voice")
+			path := filepath.Join(t.TempDir(), "voice.ogg")
+			if err := os.WriteFile(path, content, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			api := &stubAPI{}
+
+			if err := sendVoice(context.Background(), api, peer, path, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(api.sentMedia) != 1 {
+				t.Fatalf("sent %d media, want 1", len(api.sentMedia))
+			}
+			req := api.sentMedia[0]
+			if req.Peer != peer || req.Message != tt.opts.Caption {
+				t.Errorf("peer %v, caption %q", req.Peer, req.Message)
+			}
+			if tt.opts.RandomID != 0 && req.RandomID != tt.opts.RandomID {
+				t.Errorf("RandomID = %d, want %d", req.RandomID, tt.opts.RandomID)
+			}
+			if (req.ReplyTo != nil) != (tt.opts.ReplyTo != 0) {
+				t.Errorf("ReplyTo = %v, want message %d", req.ReplyTo, tt.opts.ReplyTo)
+			}
+
+			media, ok := req.Media.(*tg.InputMediaUploadedDocument)
+			if !ok {
+				t.Fatalf("media is %T", req.Media)
+			}
+			if media.MimeType != "audio/ogg" {
+				t.Errorf("MimeType = %q", media.MimeType)
+			}
+			var audio *tg.DocumentAttributeAudio
+			var fileName string
+			for _, attr := range media.Attributes {
+				switch a := attr.(type) {
+				case *tg.DocumentAttributeAudio:
+					audio = a
+				case *tg.DocumentAttributeFilename:
+					fileName = a.FileName
+				}
+			}
+			// Длительность и waveform берутся из поддельного ffprobe и ffmpeg
+			if audio == nil || !audio.Voice || audio.Duration != 3 || len(audio.Waveform) == 0 {
+				t.Errorf("audio attribute = %+v", audio)
+			}
+			if fileName != voiceFileName {
+				t.Errorf("file name = %q, want %q", fileName, voiceFileName)
+			}
+
+			file, ok := media.File.(*tg.InputFile)
+			if !ok {
+				t.Fatalf("file is %T", media.File)
+			}
+			if !bytes.Equal(api.uploaded[file.ID], content) {
+				t.Errorf("uploaded %q, want %q", api.uploaded[file.ID], content)
+			}
+		})
+	}
+}
+
+func TestGetMessageRequest(t *testing.T) {
+	msg := &tg.Message{ID: 5, Message: "hello"}
+
+	tests := []struct {
+		name       string
+		peer       tg.InputPeerClass
+		wantMethod string
+	}{
+		{name: "channel", peer: &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}, wantMethod: "ChannelsGetMessages"},
+		{name: "private chat", peer: &tg.InputPeerUser{UserID: 3, AccessHash: 4}, wantMethod: "MessagesGetMessages"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{messages: map[int]*tg.Message{5: msg}}
+			got, err := getMessage(context.Background(), api, tt.peer, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != msg {
+				t.Errorf("getMessage() = %v, want %v", got, msg)
+			}
+			if len(api.calls) != 1 || api.calls[0] != tt.wantMethod {
+				t.Errorf("calls = %v, want %s", api.calls, tt.wantMethod)
+			}
+			if tt.wantMethod != "ChannelsGetMessages" {
+				return
+			}
+			channel, ok := api.channelGets[0].Channel.(*tg.InputChannel)
+			if !ok || channel.ChannelID != 1 || channel.AccessHash != 2 {
+				t.Errorf("channel = %v", api.channelGets[0].Channel)
+			}
+		})
+	}
+}
+
+func TestGetMessageRetry(t *testing.T) {
+	setVar(t, &getMessageAttempts, 3)
+	setVar(t, &getMessageDelay, time.Millisecond)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	msg := &tg.Message{ID: 5, Message: "hello"}
+
+	tests := []struct {
+		name      string
+		messages  map[int]*tg.Message
+		hidden    int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "found at once", messages: map[int]*tg.Message{5: msg}, wantCalls: 1},
+		{name: "first fetch is empty", messages: map[int]*tg.Message{5: msg}, hidden: 1, wantCalls: 2},
+		{name: "found on last attempt", messages: map[int]*tg.Message{5: msg}, hidden: 2, wantCalls: 3},
+		{name: "not found", wantCalls: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{messages: tt.messages, hidden: tt.hidden}
+
+			got, err := getMessage(context.Background(), api, peer, 5)
+			if n := api.count("ChannelsGetMessages"); n != tt.wantCalls {
+				t.Errorf("fetched %d times, want %d", n, tt.wantCalls)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errMessageNotFound) {
+					t.Fatalf("getMessage() error = %v, want %v", err, errMessageNotFound)
+				}
+				// Ошибка называет сообщение и число попыток
+				if !strings.Contains(err.Error(), "message 5") || !strings.Contains(err.Error(), "after 3 attempts") {
+					t.Errorf("getMessage() error = %q", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != msg {
+				t.Errorf("getMessage() = %v, want %v", got, msg)
+			}
+		})
+	}
+}
+
+func TestSendVoiceByReferenceRequest(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	doc := &tg.Document{ID: 7, AccessHash: 8, FileReference: []byte("ref")}
+
+	tests := []struct {
+		name string
+		opts voiceOptions
+	}{
+		{name: "without caption"},
+		{name: "with caption", opts: voiceOptions{Caption: "Note", Entities: []tg.MessageEntityClass{&tg.MessageEntityItalic{Length: 4}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{}
+			if err := sendVoiceByReference(context.Background(), api, peer, doc, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			req := api.sentMedia[0]
+			media, ok := req.Media.(*tg.InputMediaDocument)
+			if !ok {
+				t.Fatalf("media is %T", req.Media)
+			}
+			id, ok := media.ID.(*tg.InputDocument)
+			if !ok || id.ID != doc.ID || id.AccessHash != doc.AccessHash || !bytes.Equal(id.FileReference, doc.FileReference) {
+				t.Errorf("document = %v", media.ID)
+			}
+			if req.Message != tt.opts.Caption || len(req.Entities) != len(tt.opts.Entities) {
+				t.Errorf("caption %q with %d entities", req.Message, len(req.Entities))
+			}
+		})
+	}
+}
+
+func TestUploadMimeType(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "voice.ogg", want: "audio/ogg"},
+		{path: "voice.OPUS", want: "audio/ogg"},
+		{path: "song.m4a", want: "audio/mp4"},
+		{path: "song.mp3", want: "audio/mpeg"},
+		{path: "voice", want: "audio/ogg"},
+	}
+	for _, tt := range tests {
+		if got := uploadMimeType(tt.path); got != tt.want {
+			t.Errorf("uploadMimeType(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSendAudioRequest(t *testing.T) {
+	setFakeConverter(t)
+	peer := &tg.InputPeerUser{UserID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name         string
+		source       *tg.Document
+		output       string
+		wantFileName string
+		wantMimeType string
+	}{
+		{
+			name:         "opus keeps source name",
+			source:       testDocument("audio/mpeg", "Artist - Song.mp3", &tg.DocumentAttributeAudio{Performer: "Artist", Title: "Song"}),
+			output:       "hash.ogg",
+			wantFileName: "Artist - Song.ogg",
+			wantMimeType: "audio/ogg",
+		},
+		{
+			name:         "aac",
+			source:       testDocument("audio/flac", "track.flac"),
+			output:       "hash.m4a",
+			wantFileName: "track.m4a",
+			wantMimeType: "audio/mp4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.output)
+			if err := os.WriteFile(path, []byte("converted"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			api := &stubAPI{}
+
+			if err := sendAudio(context.Background(), api, peer, path, tt.source, voiceOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(api.sentMedia) != 1 {
+				t.Fatalf("sent %d media, want 1", len(api.sentMedia))
+			}
+			media, ok := api.sentMedia[0].Media.(*tg.InputMediaUploadedDocument)
+			if !ok {
+				t.Fatalf("media is %T", api.sentMedia[0].Media)
+			}
+			if media.MimeType != tt.wantMimeType {
+				t.Errorf("MimeType = %q, want %q", media.MimeType, tt.wantMimeType)
+			}
+			for _, attr := range media.Attributes {
+				switch a := attr.(type) {
+				case *tg.DocumentAttributeAudio:
+					if a.Voice {
+						t.Error("audio is sent as voice")
+					}
+				case *tg.DocumentAttributeFilename:
+					if a.FileName != tt.wantFileName {
+						t.Errorf("file name = %q, want %q", a.FileName, tt.wantFileName)
+					}
+				}
+			}
+		})
+	}
+}
+
+// flakyUploadAPI отвечает временной ошибкой на первые попытки загрузить
+// части из failures и запоминает попытки и содержимое каждой части.
+type flakyUploadAPI struct {
+	*stubAPI
+	failures map[int]int // номер части → сколько раз ответить ошибкой
+	attempts map[int]int
+	parts    map[int][]byte
+}
+
+func (f *flakyUploadAPI) UploadSaveFilePart(_ context.Context, req *tg.UploadSaveFilePartRequest) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts[req.FilePart]++
+	if f.attempts[req.FilePart] <= f.failures[req.FilePart] {
+		return false, tgerr.New(500, "INTERNAL")
+	}
+	f.parts[req.FilePart] = req.Bytes
+	return true, nil
+}
+
+func TestUploadFileRetriesParts(t *testing.T) {
+	setRetryDelay(t, time.Millisecond)
+	// Файл больше нескольких частей загрузчика
+	content := bytes.Repeat([]byte("OggS voice data "), 512*1024/16)
+	path := filepath.Join(t.TempDir(), "voice.ogg")
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		failures map[int]int
+		wantErr  bool
+	}{
+		{name: "no failures", failures: map[int]int{}},
+		{name: "transient failures", failures: map[int]int{1: 1, 2: 2}},
+		{name: "attempts exhausted", failures: map[int]int{1: retryAttempts}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &flakyUploadAPI{stubAPI: &stubAPI{}, failures: tt.failures, attempts: map[int]int{}, parts: map[int][]byte{}}
+
+			_, err := uploadFile(context.Background(), api, path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("uploadFile() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Каждая часть повторяется только после своих ошибок, загрузка
+			// не начинается заново
+			if len(api.attempts) < 2 {
+				t.Fatalf("file uploaded in %d parts, want several", len(api.attempts))
+			}
+			for part, n := range api.attempts {
+				if want := tt.failures[part] + 1; n != want {
+					t.Errorf("part %d uploaded %d times, want %d", part, n, want)
+				}
+			}
+			var got []byte
+			for part := range len(api.parts) {
+				got = append(got, api.parts[part]...)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("uploaded %d bytes, want %d", len(got), len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	waveformSamples    = 100
+	waveformSampleRate = 8000
+)
+
+// computeWaveform декодирует аудио в PCM и строит waveform в формате Telegram:
+// waveformSamples значений по 5 бит, упакованных подряд.
+func computeWaveform(ctx context.Context, path string) ([]byte, error) {
+	cmd := ffmpegCommand(ctx, "-i", path,
+		"-f", "s16le", "-ac", "1", "-ar", fmt.Sprint(waveformSampleRate), "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode audio for waveform: %w", execError(ffmpegBin, err, stderr.Bytes()))
+	}
+
+	pcm := make([]int16, len(out)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(out[i*2:]))
+	}
+	return packWaveform(waveformPeaks(pcm, waveformSamples)), nil
+}
+
+// waveformPeaks разбивает PCM на n отрезков и возвращает пиковую амплитуду
+// каждого из них, отмасштабированную к диапазону 0..31.
+func waveformPeaks(pcm []int16, n int) []byte {
+	peaks := make([]int, n)
+	var maxPeak int
+	if len(pcm) > 0 {
+		for i := range peaks {
+			from := i * len(pcm) / n
+			to := (i + 1) * len(pcm) / n
+			for _, s := range pcm[from:to] {
+				v := int(s)
+				if v < 0 {
+					v = -v
+				}
+				peaks[i] = max(peaks[i], v)
+			}
+			maxPeak = max(maxPeak, peaks[i])
+		}
+	}
+
+	samples := make([]byte, n)
+	if maxPeak == 0 {
+		return samples
+	}
+	for i, p := range peaks {
+		samples[i] = byte(p * 31 / maxPeak)
+	}
+	return samples
+}
+
+func packWaveform(samples []byte) []byte {
+	out := make([]byte, (len(samples)*5+7)/8)
+	for i, s := range samples {
+		bit := i * 5
+		v := uint16(s&0x1f) << (bit % 8)
+		out[bit/8] |= byte(v)
+		if bit/8+1 < len(out) {
+			out[bit/8+1] |= byte(v >> 8)
+		}
+	}
+	return out
+}
+
+// audioDuration возвращает длительность аудио в секундах, округлённую
+// до ближайшего целого: 3.4s → 3, 3.5s → 4.
+func audioDuration(ctx context.Context, path string) (int, error) {
+	cmd := exec.CommandContext(ctx, ffprobeBin, "-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe audio duration: %w", execError(ffprobeBin, err, stderr.Bytes()))
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse audio duration: %w", err)
+	}
+	return int(math.Round(seconds)), nil
+}
+
+// errUnreadableAudio означает, что ffprobe не нашёл в файле аудио, которое
+// можно декодировать: файл повреждён или это не аудио.
+var errUnreadableAudio = errors.New("unreadable audio")
+
+// audioInfo описывает первую аудиодорожку файла.
+type audioInfo struct {
+	Codec      string // например "mp3", "opus" или "vorbis"
+	Channels   int
+	SampleRate int
+}
+
+// probeAudio проверяет ffprobe, что файл содержит декодируемую аудиодорожку,
+// и возвращает её параметры. Для повреждённых файлов и файлов без звука
+// возвращает ошибку, оборачивающую errUnreadableAudio.
+func probeAudio(ctx context.Context, path string) (audioInfo, error) {
+	cmd := exec.CommandContext(ctx, ffprobeBin, "-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name,channels,sample_rate",
+		"-of", "json", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return audioInfo{}, fmt.Errorf("%w: %s", errUnreadableAudio, lastLines(stderr.String(), stderrTailLines))
+	}
+	if err != nil {
+		return audioInfo{}, fmt.Errorf("failed to probe audio: %w", execError(ffprobeBin, err, stderr.Bytes()))
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecName  string `json:"codec_name"`
+			Channels   int    `json:"channels"`
+			SampleRate string `json:"sample_rate"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return audioInfo{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return audioInfo{}, fmt.Errorf("%w: no audio stream", errUnreadableAudio)
+	}
+	s := probe.Streams[0]
+	sampleRate, _ := strconv.Atoi(s.SampleRate)
+	return audioInfo{Codec: s.CodecName, Channels: s.Channels, SampleRate: sampleRate}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-faster/errors"
+)
+
+func TestPackWaveform(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []byte
+		want    []byte
+	}{
+		{name: "empty", samples: nil, want: []byte{}},
+		{name: "first sample", samples: []byte{1}, want: []byte{0x01}},
+		{name: "second sample", samples: []byte{0, 1}, want: []byte{0x20, 0x00}},
+		{name: "sample across bytes", samples: []byte{0, 31}, want: []byte{0xe0, 0x03}},
+		{name: "only 5 bits are used", samples: []byte{0xff}, want: []byte{0x1f}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := packWaveform(tt.samples); !bytes.Equal(got, tt.want) {
+				t.Errorf("packWaveform(%v) = %#v, want %#v", tt.samples, got, tt.want)
+			}
+		})
+	}
+
+	// Telegram ожидает 100 значений по 5 бит
+	if got := len(packWaveform(make([]byte, waveformSamples))); got != 63 {
+		t.Errorf("packed waveform has %d bytes, want 63", got)
+	}
+}
+
+func TestWaveformPeaks(t *testing.T) {
+	tests := []struct {
+		name string
+		pcm  []int16
+		n    int
+		want []byte
+	}{
+		{name: "silence", pcm: []int16{0, 0, 0, 0}, n: 2, want: []byte{0, 0}},
+		{name: "empty", pcm: nil, n: 3, want: []byte{0, 0, 0}},
+		{name: "scaled to loudest", pcm: []int16{0, 100, -200, 50}, n: 2, want: []byte{15, 31}},
+		{name: "negative peak", pcm: []int16{-32768, 16384}, n: 2, want: []byte{31, 15}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := waveformPeaks(tt.pcm, tt.n); !bytes.Equal(got, tt.want) {
+				t.Errorf("waveformPeaks(%v, %d) = %v, want %v", tt.pcm, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudioDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    int
+		wantErr bool
+	}{
+		{name: "rounds down", output: "3.4", want: 3},
+		{name: "rounds up", output: "3.5", want: 4},
+		{name: "whole seconds", output: "120.000000", want: 120},
+		{name: "not a number", output: "N/A", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFprobe(t, "echo "+tt.output)
+			got, err := audioDuration(context.Background(), "voice.ogg")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("audioDuration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("audioDuration() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeAudio(t *testing.T) {
+	tests := []struct {
+		name           string
+		script         string
+		want           audioInfo
+		wantUnreadable bool
+		wantErr        bool
+	}{
+		{
+			name:   "audio stream",
+			script: `echo '{"streams":[{"codec_name":"mp3","channels":2,"sample_rate":"44100"}]}'`,
+			want:   audioInfo{Codec: "mp3", Channels: 2, SampleRate: 44100},
+		},
+		{name: "no audio stream", script: `echo '{"streams":[]}'`, wantUnreadable: true, wantErr: true},
+		{name: "corrupt file", script: `echo 'Invalid data found when processing input' >&2; exit 1`, wantUnreadable: true, wantErr: true},
+		{name: "malformed output", script: `echo 'not json'`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFprobe(t, tt.script)
+			got, err := probeAudio(context.Background(), "input.mp3")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probeAudio() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errUnreadableAudio) != tt.wantUnreadable {
+				t.Errorf("probeAudio() error = %v, want unreadable %t", err, tt.wantUnreadable)
+			}
+			if got != tt.want {
+				t.Errorf("probeAudio() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
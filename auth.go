@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/jedib0t/go-pretty/v6/text"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/term"
+)
+
+// passwordPrompt запрашивает облачный пароль; подменяется в тестах.
+var passwordPrompt = readCloudPassword
+
+func readCloudPassword(_ context.Context) (string, error) {
+	fmt.Print("Введите облачный пароль: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return string(password), nil
+}
+
+// printLoginToken выводит QR-код для входа и, если printURL, ссылку tg://login
+// строкой ниже. На терминале курсор возвращается наверх, чтобы следующий токен
+// перерисовал предыдущий; в файл и в пайп escape-последовательности не пишутся.
+func printLoginToken(w io.Writer, url string, printURL, tty bool) error {
+	qr, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+
+	code := qr.ToSmallString(false)
+	if printURL {
+		code += "Ссылка для входа: " + url + "\n"
+	}
+	fmt.Fprint(w, code)
+	if tty {
+		fmt.Fprint(w, strings.Repeat(text.CursorUp.Sprint(), strings.Count(code, "\n")))
+	}
+	return nil
+}
+
+// isTerminal сообщает, выводится ли stdout в терминал.
+func isTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// isPasswordNeeded сообщает, что для входа нужен облачный пароль (2FA).
+func isPasswordNeeded(err error) bool {
+	return errors.Is(err, auth.ErrPasswordAuthNeeded) || tgerr.Is(err, "SESSION_PASSWORD_NEEDED")
+}
+
+// promptAndSubmitPassword запрашивает облачный пароль и завершает им вход.
+func promptAndSubmitPassword(ctx context.Context, client *telegram.Client) error {
+	password, err := passwordPrompt(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Auth().Password(ctx, strings.TrimSpace(password)); err != nil {
+		return fmt.Errorf("password auth: %w", err)
+	}
+	return nil
+}
+
+// phoneAuth выполняет вход по номеру телефона и коду из SMS или приложения.
+func phoneAuth(ctx context.Context, client *telegram.Client, terminal Terminal) error {
+	phone, err := terminal.Phone(ctx)
+	if err != nil {
+		return errors.Wrap(err, "read phone")
+	}
+	sent, err := client.Auth().SendCode(ctx, phone, auth.SendCodeOptions{})
+	if err != nil {
+		return errors.Wrap(err, "send code")
+	}
+	sentCode, ok := sent.(*tg.AuthSentCode)
+	if !ok {
+		return errors.Errorf("unexpected sent code type %T", sent)
+	}
+	code, err := terminal.Code(ctx, sentCode)
+	if err != nil {
+		return errors.Wrap(err, "read code")
+	}
+
+	_, err = client.Auth().SignIn(ctx, phone, code, sentCode.PhoneCodeHash)
+	if isPasswordNeeded(err) {
+		return promptAndSubmitPassword(ctx, client)
+	}
+	if err != nil {
+		return errors.Wrap(err, "sign in")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/tgerr"
+)
+
+func TestIsPasswordNeeded(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "auth helper error", err: auth.ErrPasswordAuthNeeded, want: true},
+		{name: "wrapped auth helper error", err: errors.Wrap(auth.ErrPasswordAuthNeeded, "sign in"), want: true},
+		{name: "rpc error from sign in", err: tgerr.New(401, "SESSION_PASSWORD_NEEDED"), want: true},
+		{name: "invalid code", err: tgerr.New(400, "PHONE_CODE_INVALID")},
+		{name: "no error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPasswordNeeded(tt.err); got != tt.want {
+				t.Errorf("isPasswordNeeded(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptAndSubmitPasswordPromptError(t *testing.T) {
+	errNoTTY := errors.New("no terminal")
+	old := passwordPrompt
+	passwordPrompt = func(context.Context) (string, error) { return "", errNoTTY }
+	t.Cleanup(func() { passwordPrompt = old })
+
+	// До запроса к Telegram дело не доходит, поэтому клиент не нужен
+	if err := promptAndSubmitPassword(context.Background(), nil); !errors.Is(err, errNoTTY) {
+		t.Errorf("promptAndSubmitPassword() = %v, want %v", err, errNoTTY)
+	}
+}
+
+func TestPrintLoginToken(t *testing.T) {
+	const url = "tg://login?token=abc"
+	tests := []struct {
+		name       string
+		printURL   bool
+		tty        bool
+		wantURL    bool
+		wantEscape bool
+	}{
+		{name: "qr to pipe"},
+		{name: "qr and url", printURL: true, wantURL: true},
+		{name: "terminal", tty: true, wantEscape: true},
+		{name: "url on terminal", printURL: true, tty: true, wantURL: true, wantEscape: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := printLoginToken(&buf, url, tt.printURL, tt.tty); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if got := strings.Contains(out, "Ссылка для входа: "+url+"\n"); got != tt.wantURL {
+				t.Errorf("url printed = %t, want %t", got, tt.wantURL)
+			}
+			if got := strings.Contains(out, "\x1b["); got != tt.wantEscape {
+				t.Errorf("escape sequences = %t, want %t", got, tt.wantEscape)
+			}
+			// QR-код печатается всегда
+			if !strings.ContainsAny(out, "█▀▄") {
+				t.Errorf("no QR code in output %q", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// Пауза после последнего файла, после которой пачка считается завершённой
+const batchQuietPeriod = 15 * time.Second
+
+// batchSummary собирает результаты файлов, присланных подряд, и после паузы
+// отправляет в чат одну сводку. Включается через BATCH_SUMMARY.
+type batchSummary struct {
+	mu      sync.Mutex
+	quiet   time.Duration
+	batches map[int64]*batch
+	send    func(peer tg.InputPeerClass, text string) error
+	lg      *zap.Logger
+	// afterFunc подменяется в тестах
+	afterFunc func(d time.Duration, f func()) *time.Timer
+}
+
+type batch struct {
+	peer      tg.InputPeerClass
+	converted int
+	failed    []string
+	timer     *time.Timer
+	// seq растёт с каждым файлом, чтобы сработавший ранее таймер не отправил сводку
+	seq int
+}
+
+// batches равен nil, если сводки выключены
+var batches *batchSummary
+
+func newBatchSummary(quiet time.Duration, lg *zap.Logger, send func(peer tg.InputPeerClass, text string) error) *batchSummary {
+	return &batchSummary{
+		quiet:     quiet,
+		batches:   make(map[int64]*batch),
+		send:      send,
+		lg:        lg,
+		afterFunc: time.AfterFunc,
+	}
+}
+
+// Add учитывает результат обработки файла name и откладывает сводку по чату.
+func (s *batchSummary) Add(peer tg.InputPeerClass, name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := inputPeerID(peer)
+	b, ok := s.batches[id]
+	if !ok {
+		b = &batch{peer: peer}
+		s.batches[id] = b
+	} else {
+		b.timer.Stop()
+	}
+	if err != nil {
+		b.failed = append(b.failed, fmt.Sprintf("%s: %s", name, err))
+	} else {
+		b.converted++
+	}
+	b.seq++
+	seq := b.seq
+	b.timer = s.afterFunc(s.quiet, func() { s.flush(id, b, seq) })
+}
+
+// flush отправляет сводку, если за паузу в пачку не добавилось новых файлов.
+func (s *batchSummary) flush(id int64, b *batch, seq int) {
+	s.mu.Lock()
+	if s.batches[id] != b || b.seq != seq {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.batches, id)
+	s.mu.Unlock()
+
+	// Для одного файла сводка не нужна
+	if b.converted+len(b.failed) < 2 {
+		return
+	}
+	if err := s.send(b.peer, summaryText(b.converted, b.failed)); err != nil {
+		s.lg.Warn("Send batch summary", zap.Error(err))
+	}
+}
+
+func summaryText(converted int, failed []string) string {
+	text := fmt.Sprintf("Converted %d files", converted)
+	if len(failed) > 0 {
+		text += fmt.Sprintf("\nFailed %d:\n- %s", len(failed), strings.Join(failed, "\n- "))
+	}
+	return text
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// fakeClock запоминает отложенные вызовы afterFunc и выполняет их по команде.
+type fakeClock struct {
+	pending []func()
+}
+
+func (c *fakeClock) afterFunc(_ time.Duration, f func()) *time.Timer {
+	c.pending = append(c.pending, f)
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
+
+// fire выполняет все накопленные вызовы, включая те, чей таймер уже
+// остановлен: так проверяется, что устаревший таймер не отправит сводку.
+func (c *fakeClock) fire() {
+	pending := c.pending
+	c.pending = nil
+	for _, f := range pending {
+		f()
+	}
+}
+
+func TestBatchSummary(t *testing.T) {
+	alice := &tg.InputPeerUser{UserID: 1}
+	bob := &tg.InputPeerUser{UserID: 2}
+	type file struct {
+		peer tg.InputPeerClass
+		name string
+		err  error
+	}
+
+	tests := []struct {
+		name  string
+		files []file
+		want  []string
+	}{
+		{name: "single file has no summary", files: []file{{peer: alice, name: "a.mp3"}}},
+		{
+			name:  "files are aggregated",
+			files: []file{{peer: alice, name: "a.mp3"}, {peer: alice, name: "b.mp3"}, {peer: alice, name: "c.mp3"}},
+			want:  []string{"Converted 3 files"},
+		},
+		{
+			name:  "failures are listed",
+			files: []file{{peer: alice, name: "a.mp3"}, {peer: alice, name: "b.mp3", err: errors.New("boom")}},
+			want:  []string{"Converted 1 files\nFailed 1:\n- b.mp3: boom"},
+		},
+		{
+			name: "chats are separate",
+			files: []file{
+				{peer: alice, name: "a.mp3"}, {peer: bob, name: "b.mp3"},
+				{peer: alice, name: "c.mp3"}, {peer: bob, name: "d.mp3"},
+			},
+			want: []string{"Converted 2 files", "Converted 2 files"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			var sent []string
+			s := newBatchSummary(batchQuietPeriod, zap.NewNop(), func(_ tg.InputPeerClass, text string) error {
+				sent = append(sent, text)
+				return nil
+			})
+			s.afterFunc = clock.afterFunc
+
+			for _, f := range tt.files {
+				s.Add(f.peer, f.name, f.err)
+			}
+			if len(sent) != 0 {
+				t.Fatalf("summary sent before the quiet period: %q", sent)
+			}
+			clock.fire()
+			if !slices.Equal(sent, tt.want) {
+				t.Errorf("sent %q, want %q", sent, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchSummaryDebounce(t *testing.T) {
+	clock := &fakeClock{}
+	var sent []string
+	s := newBatchSummary(batchQuietPeriod, zap.NewNop(), func(_ tg.InputPeerClass, text string) error {
+		sent = append(sent, text)
+		return nil
+	})
+	s.afterFunc = clock.afterFunc
+	peer := &tg.InputPeerUser{UserID: 1}
+
+	s.Add(peer, "a.mp3", nil)
+	s.Add(peer, "b.mp3", nil)
+	clock.fire()
+	// Новая пачка начинается после сводки по предыдущей
+	s.Add(peer, "c.mp3", nil)
+	s.Add(peer, "d.mp3", nil)
+	s.Add(peer, "e.mp3", nil)
+	clock.fire()
+
+	want := []string{"Converted 2 files", "Converted 3 files"}
+	if !slices.Equal(sent, want) {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+}
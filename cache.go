@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pebbledb "github.com/cockroachdb/pebble"
+	"github.com/go-faster/errors"
+)
+
+// Ключи кеша лежат в той же базе pebble, что и пиры, но под своим префиксом,
+// поэтому не попадают в обход хранилища пиров
+var contentHashPrefix = []byte("content-hash:")
+
+// contentCache запоминает хеш содержимого каждого документа, чтобы находить
+// готовый OGG без скачивания и не конвертировать повторно один и тот же звук,
+// загруженный другим документом.
+type contentCache struct {
+	db *pebbledb.DB
+}
+
+var oggCache *contentCache
+
+// opusCacheKey отличает OGG, сконвертированные с разными параметрами: в ключ
+// входят все действующие параметры кодирования и выбранный кодировщик, поэтому
+// после /reload, смены настроек чата или перезапуска с другим окружением
+// старый OGG из кеша не отправляется вместо нового.
+func opusCacheKey(opts OpusOptions) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%+v %s", opts, audioCodecs[formatOpus]))
+	return hex.EncodeToString(sum[:6])
+}
+
+// contentLocks не даёт параллельно конвертировать одинаковое содержимое
+var contentLocks = &keyedMutex{locks: map[int64]*keyedLock{}}
+
+func contentHashKey(docID int64) []byte {
+	return strconv.AppendInt(append([]byte(nil), contentHashPrefix...), docID, 10)
+}
+
+// Hash возвращает сохранённый хеш документа или пустую строку.
+func (c *contentCache) Hash(docID int64) (string, error) {
+	value, closer, err := c.db.Get(contentHashKey(docID))
+	if errors.Is(err, pebbledb.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "get content hash")
+	}
+	defer func() { _ = closer.Close() }()
+	return string(value), nil
+}
+
+func (c *contentCache) SetHash(docID int64, hash string) error {
+	return c.db.Set(contentHashKey(docID), []byte(hash), pebbledb.Sync)
+}
+
+// fileHash возвращает SHA-256 содержимого файла в hex.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashLockKey превращает хеш в ключ для contentLocks.
+func hashLockKey(hash string) int64 {
+	b, _ := hex.DecodeString(hash)
+	if len(b) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+const defaultOggCacheBytes = 512 << 20
+
+// oggCacheBytes ограничивает общий размер готовых OGG, которые остаются после
+// отправки, задаётся через OGG_CACHE_BYTES. 0 — удалять OGG после отправки,
+// как и скачанные файлы. С KEEP_FILES файлы не удаляются совсем
+var oggCacheBytes int64 = defaultOggCacheBytes
+
+// touchFile отмечает использование файла из кеша, чтобы он вытеснялся последним.
+func touchFile(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// evictOggCache удаляет из dir и его подкаталогов давно не использованные
+// OGG, пока их общий размер больше limit. Файлы, которые сейчас
+// используются, и незаконченные конвертации не трогает.
+func evictOggCache(dir string, limit int64) error {
+	type cached struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var (
+		files []cached
+		total int64
+	)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".ogg" || strings.HasPrefix(d.Name(), ".partial-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Файл удалили, пока обходили каталог
+			return nil
+		}
+		files = append(files, cached{path: path, size: info.Size(), mtime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "list ogg cache")
+	}
+
+	slices.SortFunc(files, func(a, b cached) int { return a.mtime.Compare(b.mtime) })
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		removed, err := activeFiles.removeUnused(f.path)
+		if err != nil {
+			return errors.Wrap(err, "remove cached ogg")
+		}
+		if removed {
+			total -= f.size
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestPrepareOggSharesConversion(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	tests := []struct {
+		name      string
+		contents  map[int64]string // содержимое документов в порядке ID
+		want      int              // число запусков ffmpeg
+		wantPaths int              // число разных OGG
+	}{
+		{name: "identical content", contents: map[int64]string{1: "ID3 same", 2: "ID3 same"}, want: 1, wantPaths: 1},
+		{name: "different content", contents: map[int64]string{1: "ID3 first", 2: "ID3 second"}, want: 2, wantPaths: 2},
+		{name: "same document twice", contents: map[int64]string{1: "ID3 same"}, want: 1, wantPaths: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOggCache(t)
+			runs := filepath.Join(t.TempDir(), "runs")
+			setFFmpeg(t, "echo run >> "+runs+"\n"+fakeFFmpegScript)
+			setFFprobe(t, fakeFFprobeScript)
+			api := &stubAPI{files: map[int64][]byte{}}
+			for id, content := range tt.contents {
+				api.files[id] = []byte(content)
+			}
+			dir := t.TempDir()
+			oggDir := filepath.Join(dir, "ogg")
+
+			ids := []int64{1, 2}
+			if len(tt.contents) == 1 {
+				ids = []int64{1, 1}
+			}
+			var paths []string
+			for _, id := range ids {
+				doc := testDocument("audio/mpeg", "song.mp3")
+				doc.ID = id
+				doc.Size = int64(len(tt.contents[id]))
+				downloadPath := filepath.Join(dir, "downloads", fmt.Sprintf("%d.mp3", id))
+				oggPath, err := prepareOgg(context.Background(), zap.NewNop(), api, peer, 10, doc, downloadPath, oggDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				activeFiles.release(false, oggPath)
+				if !slices.Contains(paths, oggPath) {
+					paths = append(paths, oggPath)
+				}
+			}
+
+			out, _ := os.ReadFile(runs)
+			if got := strings.Count(string(out), "run"); got != tt.want {
+				t.Errorf("ffmpeg ran %d times, want %d", got, tt.want)
+			}
+			if len(paths) != tt.wantPaths {
+				t.Errorf("got OGG files %q, want %d", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestOpusCacheKey(t *testing.T) {
+	setVar(t, &audioCodecs, maps.Clone(audioCodecs))
+	audioCodecs[formatOpus] = "libopus"
+	base := OpusOptions{Bitrate: "24k", Application: "voip"}
+
+	tests := []struct {
+		name    string
+		opts    OpusOptions
+		encoder string
+		same    bool // ключ совпадает с ключом base
+	}{
+		{name: "same options", opts: base, encoder: "libopus", same: true},
+		{name: "bitrate", opts: OpusOptions{Bitrate: "32k", Application: "voip"}, encoder: "libopus"},
+		{name: "normalize", opts: OpusOptions{Bitrate: "24k", Application: "voip", Normalize: true}, encoder: "libopus"},
+		{name: "loudnorm", opts: OpusOptions{Bitrate: "24k", Application: "voip", Loudnorm: LoudnormOptions{I: -20, TP: -1.5, LRA: 11}}, encoder: "libopus"},
+		{name: "speed", opts: OpusOptions{Bitrate: "24k", Application: "voip", Speed: 1.5}, encoder: "libopus"},
+		{name: "trim silence", opts: OpusOptions{Bitrate: "24k", Application: "voip", TrimSilence: true}, encoder: "libopus"},
+		{name: "application", opts: OpusOptions{Bitrate: "24k", Application: "audio"}, encoder: "libopus"},
+		{name: "sample format", opts: OpusOptions{Bitrate: "24k", Application: "voip", SampleFormat: "s16"}, encoder: "libopus"},
+		{name: "audio document", opts: OpusOptions{Bitrate: "24k", Application: "voip", AudioDocument: true}, encoder: "libopus"},
+		{name: "encoder", opts: base, encoder: "opus"},
+	}
+	want := opusCacheKey(base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audioCodecs[formatOpus] = tt.encoder
+			t.Cleanup(func() { audioCodecs[formatOpus] = "libopus" })
+			if got := opusCacheKey(tt.opts); (got == want) != tt.same {
+				t.Errorf("opusCacheKey(%+v) = %q, base %q, want same %t", tt.opts, got, want, tt.same)
+			}
+		})
+	}
+}
+
+// TestPrepareOggOptionsChange проверяет, что после смены параметров
+// кодирования OGG из кеша не отправляется, а конвертируется заново.
+func TestPrepareOggOptionsChange(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	tests := []struct {
+		name   string
+		change func()
+		want   int // число запусков ffmpeg
+	}{
+		{name: "same options", change: func() {}, want: 1},
+		{name: "reloaded bitrate", change: func() { setOpusOptions(OpusOptions{Bitrate: "64k"}) }, want: 2},
+		{name: "encoder", change: func() { audioCodecs[formatOpus] = "opus" }, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOggCache(t)
+			setVar(t, &audioCodecs, maps.Clone(audioCodecs))
+			resetOpusSettings(t, OpusOptions{Bitrate: "24k"})
+			runs := filepath.Join(t.TempDir(), "runs")
+			setFFmpeg(t, "echo run >> "+runs+"\n"+fakeFFmpegScript)
+			setFFprobe(t, fakeFFprobeScript)
+			doc, content := testAudio("audio/mpeg", "song.mp3")
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+
+			var paths []string
+			for i := range 2 {
+				if i == 1 {
+					tt.change()
+				}
+				downloadPath := filepath.Join(dir, "downloads", "1.mp3")
+				oggPath, err := prepareOgg(context.Background(), zap.NewNop(), api, peer, 10, doc, downloadPath, filepath.Join(dir, "ogg"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				activeFiles.release(false, oggPath)
+				paths = append(paths, oggPath)
+			}
+
+			out, _ := os.ReadFile(runs)
+			if got := strings.Count(string(out), "run"); got != tt.want {
+				t.Errorf("ffmpeg ran %d times, want %d", got, tt.want)
+			}
+			if (paths[0] == paths[1]) != (tt.want == 1) {
+				t.Errorf("OGG paths %q", paths)
+			}
+		})
+	}
+}
+
+func TestEvictOggCache(t *testing.T) {
+	type file struct {
+		name string
+		size int
+		age  time.Duration
+		busy bool
+	}
+	tests := []struct {
+		name  string
+		files []file
+		limit int64
+		want  []string // оставшиеся файлы
+	}{
+		{
+			name:  "under limit",
+			files: []file{{name: "a.ogg", size: 10}, {name: "b.ogg", size: 10}},
+			limit: 20,
+			want:  []string{"a.ogg", "b.ogg"},
+		},
+		{
+			name:  "oldest is evicted first",
+			files: []file{{name: "old.ogg", size: 10, age: 2 * time.Hour}, {name: "new.ogg", size: 10, age: time.Hour}},
+			limit: 15,
+			want:  []string{"new.ogg"},
+		},
+		{
+			name:  "busy file is kept",
+			files: []file{{name: "busy.ogg", size: 10, age: 2 * time.Hour, busy: true}, {name: "new.ogg", size: 10, age: time.Hour}},
+			limit: 15,
+			want:  []string{"busy.ogg"},
+		},
+		{
+			name:  "date partitions are walked",
+			files: []file{{name: "2024-06-01/old.ogg", size: 10, age: 2 * time.Hour}, {name: "2024-06-02/new.ogg", size: 10, age: time.Hour}},
+			limit: 15,
+			want:  []string{"2024-06-01", "2024-06-02", "2024-06-02/new.ogg"},
+		},
+		{
+			name: "partial and other files are ignored",
+			files: []file{
+				{name: ".partial-1.ogg", size: 100, age: 2 * time.Hour},
+				{name: "song.mp3", size: 100, age: 2 * time.Hour},
+				{name: "a.ogg", size: 10},
+			},
+			limit: 10,
+			want:  []string{".partial-1.ogg", "a.ogg", "song.mp3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tt.files {
+				path := filepath.Join(dir, f.name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, f.size), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				mtime := time.Now().Add(-f.age)
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				if f.busy {
+					activeFiles.acquire(path)
+					t.Cleanup(func() { activeFiles.release(false, path) })
+				}
+			}
+
+			if err := evictOggCache(dir, tt.limit); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+				if path != dir {
+					rel, _ := filepath.Rel(dir, path)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("left %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashLockKey(t *testing.T) {
+	tests := []struct {
+		hash string
+		want int64
+	}{
+		{hash: "0000000000000001ff", want: 1},
+		{hash: "short", want: 0},
+		{hash: "", want: 0},
+	}
+	for _, tt := range tests {
+		if got := hashLockKey(tt.hash); got != tt.want {
+			t.Errorf("hashLockKey(%q) = %d, want %d", tt.hash, got, tt.want)
+		}
+	}
+}
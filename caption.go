@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// captionTemplate задаётся через CAPTION_TEMPLATE, например
+// "{performer} - {title} ({duration})". Пустой шаблон означает подпись
+// по умолчанию из metadataCaption.
+var captionTemplate string
+
+var placeholderPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// renderCaption подставляет в шаблон поля документа. Неизвестные и
+// отсутствующие в документе поля заменяются пустой строкой.
+func renderCaption(template string, doc *tg.Document) string {
+	performer, title := audioMetadata(doc)
+	values := map[string]string{
+		"performer": performer,
+		"title":     title,
+		"filename":  getFileName(doc),
+	}
+	if seconds := int(sourceDuration(doc) / time.Second); seconds > 0 {
+		values["duration"] = fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+	}
+	caption := placeholderPattern.ReplaceAllStringFunc(template, func(m string) string {
+		return values[m[1:len(m)-1]]
+	})
+	return strings.TrimSpace(caption)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestRenderCaption(t *testing.T) {
+	full := testDocument("audio/mpeg", "track.mp3", &tg.DocumentAttributeAudio{Performer: "Artist", Title: "Song", Duration: 125})
+	bare := testDocument("audio/mpeg", "track.mp3", &tg.DocumentAttributeAudio{})
+
+	tests := []struct {
+		name     string
+		template string
+		doc      *tg.Document
+		want     string
+	}{
+		{name: "all fields", template: "{performer} - {title} ({duration})", doc: full, want: "Artist - Song (2:05)"},
+		{name: "file name", template: "{filename}", doc: full, want: "track.mp3"},
+		{name: "plain text", template: "Voice note", doc: full, want: "Voice note"},
+		{name: "unknown placeholder is empty", template: "{title}{album}", doc: full, want: "Song"},
+		{name: "missing fields are empty", template: "{performer} {title} {duration}", doc: bare, want: ""},
+		{name: "surrounding spaces are trimmed", template: "  {title}  ", doc: full, want: "Song"},
+		{name: "video duration", template: "{duration}", doc: testDocument("video/mp4", "clip.mp4", &tg.DocumentAttributeVideo{Duration: 61.5}), want: "1:01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderCaption(tt.template, tt.doc); got != tt.want {
+				t.Errorf("renderCaption(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataCaptionTemplate(t *testing.T) {
+	setVar(t, &captionTemplate, "{title} by {performer}")
+	doc := testDocument("audio/mpeg", "track.mp3", &tg.DocumentAttributeAudio{Performer: "Artist", Title: "Song"})
+	if got := metadataCaption(doc); got != "Song by Artist" {
+		t.Errorf("metadataCaption() = %q, want %q", got, "Song by Artist")
+	}
+}
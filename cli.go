@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-faster/errors"
+)
+
+// Форматы результата по расширению выходного файла для подкоманды convert
+var outputFormats = map[string]audioFormat{
+	".ogg":  formatOpus,
+	".opus": formatOpus,
+	".m4a":  formatAAC,
+	".mp3":  formatMP3,
+}
+
+// runConvert выполняет подкоманду "convert <input> <output>": конвертирует
+// локальный файл без подключения к Telegram.
+func runConvert(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: mp3_to_voice convert <input.mp3> <output.ogg>")
+	}
+	input, output := args[0], args[1]
+
+	format, ok := outputFormats[strings.ToLower(filepath.Ext(output))]
+	if !ok {
+		return errors.Errorf("unsupported output extension %q: use .ogg, .opus, .m4a or .mp3", filepath.Ext(output))
+	}
+	if _, err := os.Stat(input); err != nil {
+		return errors.Wrap(err, "input")
+	}
+	if _, err := os.Stat(output); err == nil {
+		return errors.Errorf("output %s already exists", output)
+	}
+	if err := checkFFmpeg(); err != nil {
+		return err
+	}
+	if format == formatOpus {
+		if _, err := selectOpusEncoder(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := convertAudio(ctx, input, output, format, OpusOptions{}); err != nil {
+		return err
+	}
+	fmt.Println("Converted", input, "to", output)
+	return nil
+}
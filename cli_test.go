@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunConvert(t *testing.T) {
+	setFFmpeg(t, `case "$*" in *-encoders*) echo ' A....D libopus              libopus Opus'; exit 0 ;; esac
+`+fakeFFmpegScript)
+	setFFprobe(t, fakeFFprobeScript)
+	// selectOpusEncoder запоминает найденный кодек в audioCodecs
+	setVar(t, &audioCodecs, maps.Clone(audioCodecs))
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "song.mp3")
+	if err := os.WriteFile(input, []byte("ID3 audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(dir, "existing.ogg")
+	if err := os.WriteFile(existing, []byte("OggS"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "ogg", args: []string{input, filepath.Join(dir, "voice.ogg")}},
+		{name: "opus in a subdirectory", args: []string{input, filepath.Join(dir, "out", "voice.opus")}},
+		{name: "missing arguments", args: []string{input}, wantErr: "usage: mp3_to_voice convert"},
+		{name: "unsupported extension", args: []string{input, filepath.Join(dir, "voice.wav")}, wantErr: `unsupported output extension ".wav"`},
+		{name: "missing input", args: []string{filepath.Join(dir, "missing.mp3"), filepath.Join(dir, "missing.ogg")}, wantErr: "input"},
+		{name: "output exists", args: []string{input, existing}, wantErr: "already exists"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runConvert(context.Background(), tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runConvert() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(tt.args[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), "OggS") {
+				t.Errorf("output is not OGG: %q", data)
+			}
+		})
+	}
+}
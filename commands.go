@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+)
+
+// processingStats хранит счётчики для команд /status и /stats
+type processingStats struct {
+	started         time.Time
+	processed       atomic.Int64
+	failed          atomic.Int64
+	skipped         atomic.Int64 // пропущенные по размеру, длительности, формату и в DRY_RUN
+	downloadedBytes atomic.Int64
+	conversionTime  atomic.Int64 // в наносекундах
+}
+
+var stats = &processingStats{started: time.Now()}
+
+// record учитывает результат обработки одного файла со статусом из вебхука.
+func (s *processingStats) record(status string, err error) {
+	switch {
+	case err != nil:
+		s.failed.Add(1)
+	case status == conversionSent:
+		s.processed.Add(1)
+	default:
+		s.skipped.Add(1)
+	}
+}
+
+// snapshot возвращает счётчики с момента запуска.
+func (s *processingStats) snapshot() statsCounters {
+	return statsCounters{
+		Processed:       s.processed.Load(),
+		Failed:          s.failed.Load(),
+		Skipped:         s.skipped.Load(),
+		DownloadedBytes: s.downloadedBytes.Load(),
+		ConversionTime:  time.Duration(s.conversionTime.Load()),
+	}
+}
+
+// parseCommand разбирает текст вида "/cmd@bot args" на имя команды без
+// упоминания бота и аргументы. ok равен false, если текст не является командой.
+func parseCommand(text string) (cmd, args string, ok bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+	cmd, args, _ = strings.Cut(text[1:], " ")
+	cmd, _, _ = strings.Cut(cmd, "@")
+	return strings.ToLower(cmd), strings.TrimSpace(args), cmd != ""
+}
+
+// commandReply возвращает ответ на команду. ok равен false, если команда неизвестна.
+func commandReply(cmd string, queue *jobQueue) (reply string, ok bool) {
+	switch cmd {
+	case "ping":
+		return "pong", true
+	case "status":
+		return fmt.Sprintf("Uptime: %s\nProcessed: %d\nFailed: %d\nSkipped: %d\nQueue: %d",
+			time.Since(stats.started).Truncate(time.Second),
+			stats.processed.Load(),
+			stats.failed.Load(),
+			stats.skipped.Load(),
+			queue.Len(),
+		), true
+	default:
+		return "", false
+	}
+}
+
+// handleCommand отвечает на известную команду. handled равен false, если
+// команда неизвестна и сообщение нужно обработать как обычное.
+func handleCommand(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, cmd string, queue *jobQueue) (handled bool, err error) {
+	reply, ok := commandReply(cmd, queue)
+	if !ok {
+		return false, nil
+	}
+	if err := sendMessage(ctx, api, peer, reply, msg.ID); err != nil {
+		return true, errors.Wrapf(err, "reply to /%s", cmd)
+	}
+	return true, nil
+}
+
+// queueReply перечисляет задачи очереди для команды /queue.
+func queueReply(jobs []jobInfo) string {
+	if len(jobs) == 0 {
+		return "Queue is empty"
+	}
+	var b strings.Builder
+	for i, j := range jobs {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "#%d %s: %s", j.ID, j.State, j.Name)
+	}
+	return b.String()
+}
+
+// handleQueue показывает ожидающие и выполняемые задачи.
+func handleQueue(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, queue *jobQueue) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	return sendMessage(ctx, api, peer, queueReply(queue.Jobs()), msg.ID)
+}
+
+// handleCancel убирает из очереди задачу с номером из /queue.
+func handleCancel(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, args string, queue *jobQueue) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(args, "#"), 10, 64)
+	if err != nil {
+		return sendMessage(ctx, api, peer, "Usage: /cancel <id>", msg.ID)
+	}
+	if !queue.Cancel(id) {
+		return sendMessage(ctx, api, peer, fmt.Sprintf("Job #%d is not queued", id), msg.ID)
+	}
+	return sendMessage(ctx, api, peer, fmt.Sprintf("Job #%d cancelled", id), msg.ID)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text     string
+		wantCmd  string
+		wantArgs string
+		wantOK   bool
+	}{
+		{text: "/ping", wantCmd: "ping", wantOK: true},
+		{text: "/Status@voice_bot", wantCmd: "status", wantOK: true},
+		{text: "/reprocess  5 ", wantCmd: "reprocess", wantArgs: "5", wantOK: true},
+		{text: "/cancel@voice_bot #3", wantCmd: "cancel", wantArgs: "#3", wantOK: true},
+		{text: "ping"},
+		{text: "/"},
+		{text: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			cmd, args, ok := parseCommand(tt.text)
+			if cmd != tt.wantCmd || args != tt.wantArgs || ok != tt.wantOK {
+				t.Errorf("parseCommand(%q) = %q, %q, %t, want %q, %q, %t",
+					tt.text, cmd, args, ok, tt.wantCmd, tt.wantArgs, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCommandReply(t *testing.T) {
+	queue := newJobQueue(1, zap.NewNop())
+	t.Cleanup(func() { _ = queue.Shutdown(time.Second) })
+
+	tests := []struct {
+		cmd    string
+		want   []string
+		wantOK bool
+	}{
+		{cmd: "ping", want: []string{"pong"}, wantOK: true},
+		{cmd: "status", want: []string{"Uptime:", "Processed:", "Failed:", "Queue: 0"}, wantOK: true},
+		{cmd: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			reply, ok := commandReply(tt.cmd, queue)
+			if ok != tt.wantOK {
+				t.Fatalf("commandReply(%q) ok = %t, want %t", tt.cmd, ok, tt.wantOK)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(reply, w) {
+					t.Errorf("commandReply(%q) = %q, want %q", tt.cmd, reply, w)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueReply(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []jobInfo
+		want string
+	}{
+		{name: "empty", want: "Queue is empty"},
+		{
+			name: "running and queued",
+			jobs: []jobInfo{{ID: 1, Name: "1 song.mp3", State: jobRunning}, {ID: 2, Name: "2 take.wav", State: jobQueued}},
+			want: "#1 running: 1 song.mp3\n#2 queued: 2 take.wav",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queueReply(tt.jobs); got != tt.want {
+				t.Errorf("queueReply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueAndCancelCommands(t *testing.T) {
+	const admin = 10
+	setVar(t, &allowedUsers, map[int64]struct{}{admin: {}})
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	q := newJobQueue(1, zap.NewNop())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var ran sync.Map
+	if err := q.Enqueue("first", func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"second", "third"} {
+		if err := q.Enqueue(name, func(context.Context) error {
+			ran.Store(name, true)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+
+	steps := []struct {
+		cmd       string
+		args      string
+		from      int64
+		wantReply string
+	}{
+		{cmd: "queue", from: admin, wantReply: "#1 running: first\n#2 queued: second\n#3 queued: third"},
+		{cmd: "queue", from: admin + 1},
+		{cmd: "cancel", args: "#2", from: admin + 1},
+		{cmd: "cancel", args: "#2", from: admin, wantReply: "Job #2 cancelled"},
+		{cmd: "cancel", args: "2", from: admin, wantReply: "Job #2 is not queued"},
+		{cmd: "cancel", args: "1", from: admin, wantReply: "Job #1 is not queued"},
+		{cmd: "cancel", args: "second", from: admin, wantReply: "Usage: /cancel <id>"},
+		{cmd: "queue", from: admin, wantReply: "#1 running: first\n#3 queued: third"},
+	}
+	for _, step := range steps {
+		api := &stubAPI{}
+		msg := &tg.Message{ID: 5, FromID: &tg.PeerUser{UserID: step.from}}
+		var err error
+		if step.cmd == "queue" {
+			err = handleQueue(context.Background(), api, peer, msg, q)
+		} else {
+			err = handleCancel(context.Background(), api, peer, msg, step.args, q)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if len(api.sentMessages) > 0 {
+			reply = api.sentMessages[0].Message
+		}
+		if reply != step.wantReply {
+			t.Errorf("/%s %s from %d: reply = %q, want %q", step.cmd, step.args, step.from, reply, step.wantReply)
+		}
+	}
+
+	close(release)
+	if err := q.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ran.Load("second"); ok {
+		t.Error("cancelled job ran")
+	}
+	if _, ok := ran.Load("third"); !ok {
+		t.Error("queued job did not run")
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/joho/godotenv"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+)
+
+// Способы входа в пользовательский аккаунт
+const (
+	authModeQR    = "qr"
+	authModePhone = "phone"
+)
+
+var silenceThresholdPattern = regexp.MustCompile(`^-?\d+(\.\d+)?(dB)?$`)
+
+// Способы отправки сконвертированного файла
+const (
+	sendAsVoice = "voice"
+	sendAsAudio = "audio"
+)
+
+// Config содержит все настройки, читаемые из переменных окружения.
+type Config struct {
+	AppID    int
+	AppHash  string
+	BotToken string // если задан, вход выполняется как бот
+	AuthMode string // authModeQR или authModePhone
+	Phone    string // номер для входа по коду, запрашивается, если пуст
+	WorkChat int64
+	DestChat int64 // канал для голосовых, 0 — отправлять в чат источника
+
+	AllowedUsers []int64 // пустой список разрешает всех
+	AllowDM      bool    // обрабатывать аудио из личных сообщений
+
+	SessionName  string
+	AuthPrintURL bool // печатать ссылку для входа вместе с QR-кодом
+	// SESSION_DATA задана: сессия хранится в памяти вместо каталога сессии
+	SessionFromEnv bool
+	SessionData    []byte
+
+	Opus  OpusOptions
+	Files fileOptions
+
+	ReplyToSource       bool
+	CaptionFromMetadata bool
+	CaptionTemplate     string // например "{performer} - {title} ({duration})"
+	DryRun              bool
+	Reprocess           bool   // обрабатывать уже обработанные сообщения повторно
+	BatchSummary        bool   // отправлять сводку после пачки файлов
+	DeleteSourceMessage bool   // удалять исходное сообщение после отправки
+	ReactToSource       bool   // отмечать ход обработки реакциями вместо сообщений
+	OnEdit              bool   // обрабатывать сообщения повторно после редактирования
+	ExtractVideoAudio   bool   // конвертировать звук из видео
+	SendAs              string // sendAsVoice или sendAsAudio
+	MaxWorkers          int
+	ShutdownTimeout     time.Duration
+	ProgressMinBytes    int64
+	MaxFileBytes        int64 // 0 — без ограничения
+	OggCacheBytes       int64 // размер кеша готовых OGG, 0 — удалять после отправки
+	MinDuration         time.Duration
+	MaxDuration         time.Duration // 0 — без ограничения
+	UserQuota           int           // конвертаций на пользователя в час, 0 — без ограничения
+
+	FFmpegPath    string
+	FFprobePath   string
+	FFmpegTimeout time.Duration
+	SelfTest      string // selfTestOff, selfTestWarn или selfTestFail
+	FFmpegThreads int    // 0 — на усмотрение ffmpeg
+	FFmpegNice    int    // понижение приоритета ffmpeg на Unix, 0 — без изменений
+
+	DirMode  os.FileMode // права создаваемых каталогов, до применения umask
+	FileMode os.FileMode // права создаваемых файлов, до применения umask
+
+	RateLimitInterval   time.Duration
+	RateLimitBurst      int
+	FloodWaitMaxRetries int
+	RetryJitter         float64 // доля случайного разброса пауз между повторами
+	GetMessageAttempts  int     // попытки найти сообщение, на которое ответили
+	GetMessageDelay     time.Duration
+
+	MetricsAddr string
+	HealthAddr  string
+
+	WebhookURL    string // адрес для POST-уведомлений об обработке файлов
+	WebhookSecret string // ключ HMAC-подписи уведомлений
+
+	ProxyURL string // socks5:// или http://, пустой — прямое подключение
+	TGTest   bool   // подключаться к тестовым серверам Telegram
+	DC       int    // номер DC, 0 — по умолчанию
+
+	Log LogOptions
+}
+
+// LoadConfig читает и проверяет настройки. Вместо остановки на первой ошибке
+// собирает все отсутствующие и некорректные значения в одну ошибку.
+func LoadConfig() (Config, error) {
+	var p envParser
+	cfg := Config{
+		AppID:    p.requiredInt("APP_ID"),
+		AppHash:  p.required("APP_HASH"),
+		BotToken: os.Getenv("BOT_TOKEN"),
+		AuthMode: p.oneOf("AUTH_MODE", authModeQR, authModePhone),
+		Phone:    os.Getenv("PHONE"),
+		WorkChat: p.requiredInt64("WORK_CHAT"),
+		DestChat: p.int64("DEST_CHAT", 0),
+
+		AllowedUsers: p.int64List("ALLOWED_USERS"),
+		AllowDM:      p.bool("ALLOW_DM"),
+
+		SessionName:  p.str("SESSION_NAME", "111"),
+		AuthPrintURL: p.bool("AUTH_PRINT_URL"),
+
+		Opus: OpusOptions{
+			Bitrate: os.Getenv("OPUS_BITRATE"),
+			VBR:     p.oneOf("OPUS_VBR", "", "on", "off", "constrained"),
+
+			Application: p.oneOf("OPUS_APPLICATION", defaultOpusApplication, "audio", "lowdelay"),
+
+			Normalize: p.bool("NORMALIZE_AUDIO"),
+			Loudnorm: LoudnormOptions{
+				I:   p.float64("LOUDNORM_I", defaultLoudnorm.I),
+				TP:  p.float64("LOUDNORM_TP", defaultLoudnorm.TP),
+				LRA: p.float64("LOUDNORM_LRA", defaultLoudnorm.LRA),
+			},
+
+			SampleFormat: p.oneOf("SAMPLE_FORMAT", "", "s16", "flt"),
+
+			TrimSilence:      p.bool("TRIM_SILENCE"),
+			SilenceThreshold: p.str("SILENCE_THRESHOLD", defaultSilenceThreshold),
+
+			Speed: p.float64("SPEED", 1),
+
+			AudioChannels:   p.int("AUDIO_CHANNELS", 0),
+			AudioSampleRate: p.int("AUDIO_SAMPLE_RATE", 0),
+
+			PreventClipping: p.bool("PREVENT_CLIPPING"),
+		},
+		Files: fileOptions{
+			DownloadDir: p.str("DOWNLOAD_DIR", "downloads"),
+			OggDir:      p.str("OGG_DIR", "ogg_files"),
+			KeepFiles:   p.bool("KEEP_FILES"),
+
+			DatePartition: p.bool("DATE_PARTITION"),
+		},
+
+		ReplyToSource:       p.bool("REPLY_TO_SOURCE"),
+		CaptionFromMetadata: p.bool("CAPTION_FROM_METADATA"),
+		CaptionTemplate:     os.Getenv("CAPTION_TEMPLATE"),
+		DryRun:              p.bool("DRY_RUN"),
+		Reprocess:           p.bool("REPROCESS"),
+		BatchSummary:        p.bool("BATCH_SUMMARY"),
+		DeleteSourceMessage: p.bool("DELETE_SOURCE_MESSAGE"),
+		ReactToSource:       p.bool("REACT_TO_SOURCE"),
+		OnEdit:              p.bool("ON_EDIT"),
+		ExtractVideoAudio:   p.bool("EXTRACT_VIDEO_AUDIO"),
+		SendAs:              p.oneOf("SEND_AS", sendAsVoice, sendAsAudio),
+		MaxWorkers:          p.int("MAX_WORKERS", defaultMaxWorkers),
+		ShutdownTimeout:     p.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		ProgressMinBytes:    p.int64("PROGRESS_MIN_BYTES", progressMinBytes),
+		MaxFileBytes:        p.int64("MAX_FILE_BYTES", 0),
+		OggCacheBytes:       p.int64("OGG_CACHE_BYTES", defaultOggCacheBytes),
+		MinDuration:         p.duration("MIN_DURATION", 0),
+		MaxDuration:         p.duration("MAX_DURATION", 0),
+		UserQuota:           p.int("USER_QUOTA", 0),
+
+		FFmpegPath:    p.str("FFMPEG_PATH", "ffmpeg"),
+		FFprobePath:   p.str("FFPROBE_PATH", "ffprobe"),
+		FFmpegTimeout: p.duration("FFMPEG_TIMEOUT", ffmpegTimeout),
+		SelfTest:      p.oneOf("SELF_TEST", selfTestOff, selfTestWarn, selfTestFail),
+		FFmpegThreads: p.int("FFMPEG_THREADS", 0),
+		FFmpegNice:    p.int("FFMPEG_NICE", 0),
+
+		DirMode:  p.fileMode("DIR_MODE", dirMode),
+		FileMode: p.fileMode("FILE_MODE", fileMode),
+
+		RateLimitInterval:   p.duration("RATE_LIMIT_INTERVAL", 100*time.Millisecond),
+		RateLimitBurst:      p.int("RATE_LIMIT_BURST", 5),
+		FloodWaitMaxRetries: p.int("FLOOD_WAIT_MAX_RETRIES", 5),
+		RetryJitter:         p.float64("RETRY_JITTER", retryJitter),
+		GetMessageAttempts:  p.int("GET_MESSAGE_ATTEMPTS", getMessageAttempts),
+		GetMessageDelay:     p.duration("GET_MESSAGE_DELAY", getMessageDelay),
+
+		MetricsAddr: os.Getenv("METRICS_ADDR"),
+		HealthAddr:  os.Getenv("HEALTH_ADDR"),
+
+		WebhookURL:    os.Getenv("WEBHOOK_URL"),
+		WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+
+		ProxyURL: os.Getenv("PROXY_URL"),
+		TGTest:   p.bool("TG_TEST"),
+		DC:       p.int("TG_DC", 0),
+
+		Log: LogOptions{
+			Level:    p.logLevel("LOG_LEVEL", zapcore.DebugLevel),
+			Format:   p.oneOf("LOG_FORMAT", logFormatJSON, logFormatConsole),
+			ToStderr: p.bool("LOG_TO_STDERR"),
+		},
+	}
+
+	if !silenceThresholdPattern.MatchString(cfg.Opus.SilenceThreshold) {
+		p.fail("SILENCE_THRESHOLD must look like -50dB or 0.001, got %q", cfg.Opus.SilenceThreshold)
+	}
+	if cfg.MaxWorkers < 1 {
+		p.fail("MAX_WORKERS must be positive, got %d", cfg.MaxWorkers)
+	}
+	if cfg.UserQuota < 0 {
+		p.fail("USER_QUOTA must not be negative, got %d", cfg.UserQuota)
+	}
+	if cfg.MinDuration < 0 || cfg.MaxDuration < 0 {
+		p.fail("MIN_DURATION and MAX_DURATION must not be negative")
+	}
+	if cfg.MaxDuration > 0 && cfg.MinDuration > cfg.MaxDuration {
+		p.fail("MIN_DURATION %s is greater than MAX_DURATION %s", cfg.MinDuration, cfg.MaxDuration)
+	}
+	if cfg.MaxFileBytes < 0 {
+		p.fail("MAX_FILE_BYTES must not be negative, got %d", cfg.MaxFileBytes)
+	}
+	if cfg.OggCacheBytes < 0 {
+		p.fail("OGG_CACHE_BYTES must not be negative, got %d", cfg.OggCacheBytes)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		p.fail("SHUTDOWN_TIMEOUT must be positive, got %s", cfg.ShutdownTimeout)
+	}
+	if cfg.FFmpegTimeout <= 0 {
+		p.fail("FFMPEG_TIMEOUT must be positive, got %s", cfg.FFmpegTimeout)
+	}
+	if cfg.RateLimitInterval <= 0 {
+		p.fail("RATE_LIMIT_INTERVAL must be positive, got %s", cfg.RateLimitInterval)
+	}
+	if cfg.RateLimitBurst < 1 {
+		p.fail("RATE_LIMIT_BURST must be positive, got %d", cfg.RateLimitBurst)
+	}
+	if cfg.FloodWaitMaxRetries < 0 {
+		p.fail("FLOOD_WAIT_MAX_RETRIES must not be negative, got %d", cfg.FloodWaitMaxRetries)
+	}
+	if cfg.DC < 0 || cfg.DC > 5 {
+		p.fail("TG_DC must be 0 (auto) or between 1 and 5, got %d", cfg.DC)
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := proxyDial(cfg.ProxyURL); err != nil {
+			p.fail("invalid PROXY_URL: %s", err)
+		}
+	}
+	if cfg.FFmpegThreads < 0 || cfg.FFmpegThreads > runtime.NumCPU()*4 {
+		p.fail("FFMPEG_THREADS must be between 0 and %d, got %d", runtime.NumCPU()*4, cfg.FFmpegThreads)
+	}
+	if cfg.FFmpegNice < 0 || cfg.FFmpegNice > 19 {
+		p.fail("FFMPEG_NICE must be between 0 and 19, got %d", cfg.FFmpegNice)
+	}
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			p.fail("WEBHOOK_URL must be an http or https URL, got %q", cfg.WebhookURL)
+		}
+	}
+	// Те же значения, что принимает команда /bitrate
+	if b := cfg.Opus.Bitrate; b != "" && !slices.Contains(allowedBitrates, b) {
+		p.fail("OPUS_BITRATE must be one of %v, got %q", allowedBitrates, b)
+	}
+	if cfg.Opus.AudioChannels < 0 || cfg.Opus.AudioChannels > 2 {
+		p.fail("AUDIO_CHANNELS must be 0, 1 or 2, got %d", cfg.Opus.AudioChannels)
+	}
+	// libopus принимает только эти частоты
+	if r := cfg.Opus.AudioSampleRate; r != 0 && !slices.Contains([]int{8000, 12000, 16000, 24000, 48000}, r) {
+		p.fail("AUDIO_SAMPLE_RATE must be one of 8000, 12000, 16000, 24000, 48000, got %d", r)
+	}
+	// Больше и меньше цепочка atempo заметно искажает речь
+	if cfg.Opus.Speed < 0.25 || cfg.Opus.Speed > 4 {
+		p.fail("SPEED must be between 0.25 and 4, got %g", cfg.Opus.Speed)
+	}
+	// Допустимые диапазоны фильтра loudnorm в ffmpeg
+	if l := cfg.Opus.Loudnorm; l.I < -70 || l.I > -5 {
+		p.fail("LOUDNORM_I must be between -70 and -5, got %g", l.I)
+	}
+	if l := cfg.Opus.Loudnorm; l.TP < -9 || l.TP > 0 {
+		p.fail("LOUDNORM_TP must be between -9 and 0, got %g", l.TP)
+	}
+	if l := cfg.Opus.Loudnorm; l.LRA < 1 || l.LRA > 50 {
+		p.fail("LOUDNORM_LRA must be between 1 and 50, got %g", l.LRA)
+	}
+	// Без этих прав бот не сможет работать с собственными файлами
+	if cfg.DirMode&0700 != 0700 {
+		p.fail("DIR_MODE must grant the owner rwx (0700), got %#o", cfg.DirMode)
+	}
+	if cfg.FileMode&0600 != 0600 {
+		p.fail("FILE_MODE must grant the owner rw (0600), got %#o", cfg.FileMode)
+	}
+	if cfg.RetryJitter < 0 || cfg.RetryJitter > 1 {
+		p.fail("RETRY_JITTER must be between 0 and 1, got %g", cfg.RetryJitter)
+	}
+	if cfg.GetMessageAttempts < 1 {
+		p.fail("GET_MESSAGE_ATTEMPTS must be positive, got %d", cfg.GetMessageAttempts)
+	}
+	if cfg.GetMessageDelay < 0 {
+		p.fail("GET_MESSAGE_DELAY must not be negative, got %s", cfg.GetMessageDelay)
+	}
+	if sessionFolder(cfg.SessionName) == sessionFolder("") {
+		p.fail("invalid SESSION_NAME %q", cfg.SessionName)
+	}
+	if v, ok := os.LookupEnv("SESSION_DATA"); ok {
+		cfg.SessionFromEnv = true
+		if strings.TrimSpace(v) != "" {
+			data, err := decodeSessionData(v)
+			if err != nil {
+				p.fail("invalid SESSION_DATA: %v", err)
+			}
+			cfg.SessionData = data
+		}
+	}
+
+	if err := p.err(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// configSource читает настройки при запуске и по команде /reload с одним и тем
+// же приоритетом: окружение процесса > .env > файл конфигурации.
+type configSource struct {
+	path string            // файл из флага -config, пустой — не задан
+	env  map[string]string // окружение процесса до чтения .env и файла
+}
+
+func newConfigSource(path string) *configSource {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			env[key] = value
+		}
+	}
+	return &configSource{path: path, env: env}
+}
+
+// Load возвращает окружение к состоянию при запуске, заново дополняет его
+// значениями из .env и файла конфигурации и читает настройки.
+func (s *configSource) Load() (Config, error) {
+	// Значения, выставленные прошлой загрузкой, не должны перекрыть новые
+	// из .env и файла
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := s.env[key]; !ok {
+			_ = os.Unsetenv(key)
+		}
+	}
+	for key, value := range s.env {
+		if err := os.Setenv(key, value); err != nil {
+			return Config{}, errors.Wrapf(err, "set %s", key)
+		}
+	}
+
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		return Config{}, errors.Wrap(err, "load env")
+	}
+	// Значения из файла конфигурации не перекрывают переменные окружения и .env
+	if s.path != "" {
+		if err := loadConfigFile(s.path); err != nil {
+			return Config{}, err
+		}
+	}
+	return LoadConfig()
+}
+
+// loadConfigFile читает файл конфигурации в формате JSON или YAML с теми же
+// ключами, что и переменные окружения, например {"APP_ID": 123}. Значения
+// выставляются в окружение, только если переменная ещё не задана, поэтому
+// приоритет такой: значения по умолчанию < файл < окружение.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "read config file")
+	}
+	// JSON является подмножеством YAML, поэтому один разбор подходит для обоих
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return errors.Wrapf(err, "parse config file %s", path)
+	}
+
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		v, err := configValue(value)
+		if err != nil {
+			return errors.Wrapf(err, "config file key %s", key)
+		}
+		if err := os.Setenv(key, v); err != nil {
+			return errors.Wrapf(err, "set %s", key)
+		}
+	}
+	return nil
+}
+
+// configValue приводит значение из файла конфигурации к строке переменной
+// окружения. Списки, например ALLOWED_USERS, склеиваются через запятую.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[any]any, map[string]any:
+		return "", errors.New("nested objects are not supported")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// envParser читает переменные окружения и накапливает ошибки разбора.
+type envParser struct {
+	errs []string
+}
+
+func (p *envParser) fail(format string, args ...any) {
+	p.errs = append(p.errs, fmt.Sprintf(format, args...))
+}
+
+func (p *envParser) err() error {
+	if len(p.errs) == 0 {
+		return nil
+	}
+	return errors.Errorf("invalid config:\n  - %s", strings.Join(p.errs, "\n  - "))
+}
+
+func (p *envParser) str(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func (p *envParser) required(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		p.fail("%s is required", key)
+	}
+	return v
+}
+
+// oneOf возвращает значение из allowed; если переменная не задана — первое из них.
+func (p *envParser) oneOf(key string, allowed ...string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return allowed[0]
+	}
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	p.fail("%s must be one of %q, got %q", key, allowed, v)
+	return ""
+}
+
+func (p *envParser) bool(key string) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		p.fail("%s must be a boolean, got %q", key, v)
+	}
+	return b
+}
+
+func (p *envParser) int64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		p.fail("%s must be an integer, got %q", key, v)
+	}
+	return n
+}
+
+// int64List разбирает список чисел, разделённых запятыми.
+func (p *envParser) int64List(key string) []int64 {
+	var list []int64
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			p.fail("%s must be a comma-separated list of integers, got %q", key, v)
+			continue
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+func (p *envParser) float64(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		p.fail("%s must be a number, got %q", key, v)
+	}
+	return f
+}
+
+// fileMode читает права в восьмеричной записи, например "0750".
+func (p *envParser) fileMode(key string, def os.FileMode) os.FileMode {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0777 {
+		p.fail("%s must be an octal mode between 0 and 0777, got %q", key, v)
+		return def
+	}
+	return os.FileMode(mode)
+}
+
+func (p *envParser) int(key string, def int) int {
+	return int(p.int64(key, int64(def)))
+}
+
+func (p *envParser) requiredInt64(key string) int64 {
+	if os.Getenv(key) == "" {
+		p.fail("%s is required", key)
+		return 0
+	}
+	return p.int64(key, 0)
+}
+
+func (p *envParser) requiredInt(key string) int {
+	return int(p.requiredInt64(key))
+}
+
+func (p *envParser) duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		p.fail("%s must be a duration like 90s or 2m, got %q", key, v)
+	}
+	return d
+}
+
+func (p *envParser) logLevel(key string, def zapcore.Level) zapcore.Level {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	level, err := zapcore.ParseLevel(v)
+	if err != nil {
+		p.fail("%s must be one of debug, info, warn, error, got %q", key, v)
+	}
+	return level
+}
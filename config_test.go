@@ -0,0 +1,507 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// setRequiredEnv задаёт обязательные переменные, чтобы LoadConfig проверял
+// только переменные конкретного случая.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("APP_ID", "123")
+	t.Setenv("APP_HASH", "hash")
+	t.Setenv("WORK_CHAT", "-1001")
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(t *testing.T, cfg Config)
+		wantErr []string // части сообщения об ошибке
+	}{
+		{
+			name: "QR login by default",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.BotToken != "" || cfg.AuthMode != authModeQR {
+					t.Errorf("BotToken = %q, AuthMode = %q", cfg.BotToken, cfg.AuthMode)
+				}
+			},
+		},
+		{
+			name: "bot token",
+			env:  map[string]string{"BOT_TOKEN": "123:abc"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.BotToken != "123:abc" {
+					t.Errorf("BotToken = %q", cfg.BotToken)
+				}
+			},
+		},
+		{
+			name: "phone login",
+			env:  map[string]string{"AUTH_MODE": "phone", "PHONE": "+79990000000"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.AuthMode != authModePhone || cfg.Phone != "+79990000000" {
+					t.Errorf("AuthMode = %q, Phone = %q", cfg.AuthMode, cfg.Phone)
+				}
+			},
+		},
+		{
+			name:    "unknown auth mode",
+			env:     map[string]string{"AUTH_MODE": "sms"},
+			wantErr: []string{"AUTH_MODE must be one of"},
+		},
+		{
+			name:    "invalid silence threshold",
+			env:     map[string]string{"SILENCE_THRESHOLD": "quiet"},
+			wantErr: []string{"SILENCE_THRESHOLD must look like -50dB"},
+		},
+		{
+			name: "rate limit",
+			env:  map[string]string{"RATE_LIMIT_INTERVAL": "250ms", "RATE_LIMIT_BURST": "2", "FLOOD_WAIT_MAX_RETRIES": "0"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.RateLimitInterval != 250*time.Millisecond || cfg.RateLimitBurst != 2 || cfg.FloodWaitMaxRetries != 0 {
+					t.Errorf("RateLimitInterval = %s, RateLimitBurst = %d, FloodWaitMaxRetries = %d",
+						cfg.RateLimitInterval, cfg.RateLimitBurst, cfg.FloodWaitMaxRetries)
+				}
+			},
+		},
+		{
+			name:    "invalid rate limit",
+			env:     map[string]string{"RATE_LIMIT_INTERVAL": "0s", "RATE_LIMIT_BURST": "0", "FLOOD_WAIT_MAX_RETRIES": "-1"},
+			wantErr: []string{"RATE_LIMIT_INTERVAL must be positive", "RATE_LIMIT_BURST must be positive", "FLOOD_WAIT_MAX_RETRIES must not be negative"},
+		},
+		{
+			name: "allowed users",
+			env:  map[string]string{"ALLOWED_USERS": "1, 2,,3"},
+			check: func(t *testing.T, cfg Config) {
+				if !slices.Equal(cfg.AllowedUsers, []int64{1, 2, 3}) {
+					t.Errorf("AllowedUsers = %v", cfg.AllowedUsers)
+				}
+			},
+		},
+		{
+			name:    "invalid allowed user",
+			env:     map[string]string{"ALLOWED_USERS": "1,alice"},
+			wantErr: []string{"ALLOWED_USERS must be a comma-separated list of integers"},
+		},
+		{
+			name: "log options",
+			env:  map[string]string{"LOG_LEVEL": "warn", "LOG_FORMAT": "console", "LOG_TO_STDERR": "true"},
+			check: func(t *testing.T, cfg Config) {
+				want := LogOptions{Level: zapcore.WarnLevel, Format: logFormatConsole, ToStderr: true}
+				if cfg.Log != want {
+					t.Errorf("Log = %+v, want %+v", cfg.Log, want)
+				}
+			},
+		},
+		{
+			name:    "invalid log level",
+			env:     map[string]string{"LOG_LEVEL": "verbose"},
+			wantErr: []string{"LOG_LEVEL must be one of"},
+		},
+		{
+			name: "test DC",
+			env:  map[string]string{"TG_TEST": "true", "TG_DC": "2"},
+			check: func(t *testing.T, cfg Config) {
+				if !cfg.TGTest || cfg.DC != 2 {
+					t.Errorf("TGTest = %t, DC = %d", cfg.TGTest, cfg.DC)
+				}
+			},
+		},
+		{
+			name: "auto DC",
+			env:  map[string]string{"TG_DC": "0"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.DC != 0 {
+					t.Errorf("DC = %d", cfg.DC)
+				}
+			},
+		},
+		{
+			name:    "invalid DC",
+			env:     map[string]string{"TG_DC": "6"},
+			wantErr: []string{"TG_DC must be 0 (auto) or between 1 and 5"},
+		},
+		{
+			name: "ogg cache size",
+			env:  map[string]string{"OGG_CACHE_BYTES": "0"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.OggCacheBytes != 0 {
+					t.Errorf("OggCacheBytes = %d", cfg.OggCacheBytes)
+				}
+			},
+		},
+		{
+			name:    "negative ogg cache size",
+			env:     map[string]string{"OGG_CACHE_BYTES": "-1"},
+			wantErr: []string{"OGG_CACHE_BYTES must not be negative"},
+		},
+		{
+			name: "max file size",
+			env:  map[string]string{"MAX_FILE_BYTES": "1048576"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.MaxFileBytes != 1048576 {
+					t.Errorf("MaxFileBytes = %d", cfg.MaxFileBytes)
+				}
+			},
+		},
+		{
+			name:    "negative max file size",
+			env:     map[string]string{"MAX_FILE_BYTES": "-1"},
+			wantErr: []string{"MAX_FILE_BYTES must not be negative"},
+		},
+		{
+			name: "retry jitter",
+			env:  map[string]string{"RETRY_JITTER": "0.2"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.RetryJitter != 0.2 {
+					t.Errorf("RetryJitter = %g", cfg.RetryJitter)
+				}
+			},
+		},
+		{
+			name:    "invalid retry jitter",
+			env:     map[string]string{"RETRY_JITTER": "1.5"},
+			wantErr: []string{"RETRY_JITTER must be between 0 and 1"},
+		},
+		{
+			name: "opus application",
+			env:  map[string]string{"OPUS_APPLICATION": "audio"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Opus.Application != "audio" {
+					t.Errorf("Application = %q", cfg.Opus.Application)
+				}
+			},
+		},
+		{
+			name:    "unknown opus application",
+			env:     map[string]string{"OPUS_APPLICATION": "music"},
+			wantErr: []string{"OPUS_APPLICATION must be one of"},
+		},
+		{
+			name: "print login url",
+			env:  map[string]string{"AUTH_PRINT_URL": "true"},
+			check: func(t *testing.T, cfg Config) {
+				if !cfg.AuthPrintURL {
+					t.Error("AuthPrintURL = false")
+				}
+			},
+		},
+		{
+			name: "loudnorm defaults",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Opus.Loudnorm != defaultLoudnorm || cfg.Opus.SampleFormat != "" {
+					t.Errorf("Loudnorm = %+v, SampleFormat = %q", cfg.Opus.Loudnorm, cfg.Opus.SampleFormat)
+				}
+			},
+		},
+		{
+			name: "loudnorm and sample format",
+			env:  map[string]string{"LOUDNORM_I": "-23", "LOUDNORM_TP": "-2", "LOUDNORM_LRA": "7", "SAMPLE_FORMAT": "s16"},
+			check: func(t *testing.T, cfg Config) {
+				want := LoudnormOptions{I: -23, TP: -2, LRA: 7}
+				if cfg.Opus.Loudnorm != want || cfg.Opus.SampleFormat != "s16" {
+					t.Errorf("Loudnorm = %+v, SampleFormat = %q", cfg.Opus.Loudnorm, cfg.Opus.SampleFormat)
+				}
+			},
+		},
+		{
+			name:    "loudnorm out of range",
+			env:     map[string]string{"LOUDNORM_I": "-80", "LOUDNORM_TP": "1", "LOUDNORM_LRA": "0", "SAMPLE_FORMAT": "s32"},
+			wantErr: []string{"LOUDNORM_I must be between", "LOUDNORM_TP must be between", "LOUDNORM_LRA must be between", "SAMPLE_FORMAT must be one of"},
+		},
+		{
+			name: "file modes",
+			env:  map[string]string{"DIR_MODE": "0750", "FILE_MODE": "640"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.DirMode != 0o750 || cfg.FileMode != 0o640 {
+					t.Errorf("DirMode = %#o, FileMode = %#o", cfg.DirMode, cfg.FileMode)
+				}
+			},
+		},
+		{
+			name:    "invalid file modes",
+			env:     map[string]string{"DIR_MODE": "0644", "FILE_MODE": "rw-r--r--"},
+			wantErr: []string{"DIR_MODE must grant the owner rwx", "FILE_MODE must be an octal mode"},
+		},
+		{
+			name: "speed",
+			env:  map[string]string{"SPEED": "1.25"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Opus.Speed != 1.25 {
+					t.Errorf("Speed = %g", cfg.Opus.Speed)
+				}
+			},
+		},
+		{
+			name:    "speed out of range",
+			env:     map[string]string{"SPEED": "5"},
+			wantErr: []string{"SPEED must be between 0.25 and 4"},
+		},
+		{
+			name: "destination chat",
+			env:  map[string]string{"DEST_CHAT": "200"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.DestChat != 200 {
+					t.Errorf("DestChat = %d", cfg.DestChat)
+				}
+			},
+		},
+		{
+			name: "user quota",
+			env:  map[string]string{"USER_QUOTA": "10"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.UserQuota != 10 {
+					t.Errorf("UserQuota = %d", cfg.UserQuota)
+				}
+			},
+		},
+		{
+			name:    "negative user quota",
+			env:     map[string]string{"USER_QUOTA": "-1"},
+			wantErr: []string{"USER_QUOTA must not be negative"},
+		},
+		{
+			name: "audio document layout",
+			env:  map[string]string{"AUDIO_CHANNELS": "2", "AUDIO_SAMPLE_RATE": "24000"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Opus.AudioChannels != 2 || cfg.Opus.AudioSampleRate != 24000 {
+					t.Errorf("AudioChannels = %d, AudioSampleRate = %d", cfg.Opus.AudioChannels, cfg.Opus.AudioSampleRate)
+				}
+			},
+		},
+		{
+			name:    "invalid audio document layout",
+			env:     map[string]string{"AUDIO_CHANNELS": "6", "AUDIO_SAMPLE_RATE": "44100"},
+			wantErr: []string{"AUDIO_CHANNELS must be 0, 1 or 2", "AUDIO_SAMPLE_RATE"},
+		},
+		{
+			name: "self-test",
+			env:  map[string]string{"SELF_TEST": "fail"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.SelfTest != selfTestFail {
+					t.Errorf("SelfTest = %q", cfg.SelfTest)
+				}
+			},
+		},
+		{
+			name:    "invalid self-test mode",
+			env:     map[string]string{"SELF_TEST": "yes"},
+			wantErr: []string{"SELF_TEST must be one of"},
+		},
+		{
+			name: "duration range",
+			env:  map[string]string{"MIN_DURATION": "5s", "MAX_DURATION": "1h"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.MinDuration != 5*time.Second || cfg.MaxDuration != time.Hour {
+					t.Errorf("MinDuration = %s, MaxDuration = %s", cfg.MinDuration, cfg.MaxDuration)
+				}
+			},
+		},
+		{
+			name:    "negative duration",
+			env:     map[string]string{"MIN_DURATION": "-5s"},
+			wantErr: []string{"MIN_DURATION and MAX_DURATION must not be negative"},
+		},
+		{
+			name:    "min above max",
+			env:     map[string]string{"MIN_DURATION": "2h", "MAX_DURATION": "1h"},
+			wantErr: []string{"MIN_DURATION 2h0m0s is greater than MAX_DURATION 1h0m0s"},
+		},
+		{
+			name: "ffmpeg threads and nice",
+			env:  map[string]string{"FFMPEG_THREADS": "2", "FFMPEG_NICE": "10"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.FFmpegThreads != 2 || cfg.FFmpegNice != 10 {
+					t.Errorf("FFmpegThreads = %d, FFmpegNice = %d", cfg.FFmpegThreads, cfg.FFmpegNice)
+				}
+			},
+		},
+		{
+			name:    "invalid ffmpeg threads and nice",
+			env:     map[string]string{"FFMPEG_THREADS": "-1", "FFMPEG_NICE": "20"},
+			wantErr: []string{"FFMPEG_THREADS must be between 0 and", "FFMPEG_NICE must be between 0 and 19"},
+		},
+		{
+			name: "session from env",
+			env:  map[string]string{"SESSION_DATA": "eyJWZXJzaW9uIjoxfQ=="},
+			check: func(t *testing.T, cfg Config) {
+				if !cfg.SessionFromEnv || string(cfg.SessionData) != `{"Version":1}` {
+					t.Errorf("SessionFromEnv = %t, SessionData = %q", cfg.SessionFromEnv, cfg.SessionData)
+				}
+			},
+		},
+		{
+			// Пустое значение включает хранение в памяти до первого входа
+			name: "empty session from env",
+			env:  map[string]string{"SESSION_DATA": ""},
+			check: func(t *testing.T, cfg Config) {
+				if !cfg.SessionFromEnv || cfg.SessionData != nil {
+					t.Errorf("SessionFromEnv = %t, SessionData = %q", cfg.SessionFromEnv, cfg.SessionData)
+				}
+			},
+		},
+		{
+			name:    "invalid session data",
+			env:     map[string]string{"SESSION_DATA": "not base64!"},
+			wantErr: []string{"invalid SESSION_DATA"},
+		},
+		{
+			name: "get message retry",
+			env:  map[string]string{"GET_MESSAGE_ATTEMPTS": "5", "GET_MESSAGE_DELAY": "2s"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.GetMessageAttempts != 5 || cfg.GetMessageDelay != 2*time.Second {
+					t.Errorf("GetMessageAttempts = %d, GetMessageDelay = %s", cfg.GetMessageAttempts, cfg.GetMessageDelay)
+				}
+			},
+		},
+		{
+			name:    "invalid get message retry",
+			env:     map[string]string{"GET_MESSAGE_ATTEMPTS": "0", "GET_MESSAGE_DELAY": "-1s"},
+			wantErr: []string{"GET_MESSAGE_ATTEMPTS must be positive", "GET_MESSAGE_DELAY must not be negative"},
+		},
+		{
+			name: "opus bitrate",
+			env:  map[string]string{"OPUS_BITRATE": "48k"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Opus.Bitrate != "48k" {
+					t.Errorf("Opus.Bitrate = %q", cfg.Opus.Bitrate)
+				}
+			},
+		},
+		{
+			name:    "invalid opus bitrate",
+			env:     map[string]string{"OPUS_BITRATE": "33k"},
+			wantErr: []string{`OPUS_BITRATE must be one of [16k 24k 32k 48k 64k 96k 128k], got "33k"`},
+		},
+		{
+			name:    "missing required",
+			env:     map[string]string{"APP_ID": "", "APP_HASH": ""},
+			wantErr: []string{"APP_ID is required", "APP_HASH is required"},
+		},
+		{
+			name:    "all errors are reported",
+			env:     map[string]string{"WORK_CHAT": "chat", "MAX_WORKERS": "0", "SEND_AS": "video", "KEEP_FILES": "maybe"},
+			wantErr: []string{"WORK_CHAT must be an integer", "MAX_WORKERS must be positive", "SEND_AS must be one of", "KEEP_FILES must be a boolean"},
+		},
+		{
+			name:    "invalid duration",
+			env:     map[string]string{"SHUTDOWN_TIMEOUT": "30"},
+			wantErr: []string{"SHUTDOWN_TIMEOUT must be a duration"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := LoadConfig()
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("LoadConfig() succeeded, want error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("LoadConfig() error = %v, want %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		ext     string
+		env     map[string]string
+		check   func(t *testing.T, cfg Config)
+		wantErr string
+	}{
+		{
+			name: "yaml values",
+			file: "MAX_WORKERS: 3\nKEEP_FILES: true\nALLOWED_USERS: [1, 2]\n",
+			ext:  ".yaml",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.MaxWorkers != 3 || !cfg.Files.KeepFiles || !slices.Equal(cfg.AllowedUsers, []int64{1, 2}) {
+					t.Errorf("MaxWorkers = %d, KeepFiles = %t, AllowedUsers = %v", cfg.MaxWorkers, cfg.Files.KeepFiles, cfg.AllowedUsers)
+				}
+			},
+		},
+		{
+			name: "json values",
+			file: `{"MAX_WORKERS": 3, "SEND_AS": "audio"}`,
+			ext:  ".json",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.MaxWorkers != 3 || cfg.SendAs != sendAsAudio {
+					t.Errorf("MaxWorkers = %d, SendAs = %q", cfg.MaxWorkers, cfg.SendAs)
+				}
+			},
+		},
+		{
+			name: "env overrides file, file overrides defaults",
+			file: "MAX_WORKERS: 3\nRATE_LIMIT_BURST: 7\n",
+			ext:  ".yaml",
+			env:  map[string]string{"MAX_WORKERS": "5"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.MaxWorkers != 5 || cfg.RateLimitBurst != 7 || cfg.RateLimitInterval != 100*time.Millisecond {
+					t.Errorf("MaxWorkers = %d, RateLimitBurst = %d, RateLimitInterval = %s", cfg.MaxWorkers, cfg.RateLimitBurst, cfg.RateLimitInterval)
+				}
+			},
+		},
+		{name: "nested object", file: "LOG:\n  LEVEL: info\n", ext: ".yaml", wantErr: "nested objects are not supported"},
+		{name: "invalid syntax", file: "MAX_WORKERS: [3", ext: ".yaml", wantErr: "parse config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			// loadConfigFile пишет значения в окружение, t.Setenv восстановит его после теста
+			for _, key := range []string{"MAX_WORKERS", "KEEP_FILES", "ALLOWED_USERS", "SEND_AS", "RATE_LIMIT_BURST", "LOG"} {
+				if _, ok := tt.env[key]; !ok {
+					t.Setenv(key, "")
+					_ = os.Unsetenv(key)
+				}
+			}
+			path := filepath.Join(t.TempDir(), "config"+tt.ext)
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadConfigFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfigFile() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
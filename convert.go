@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Пути к ffmpeg и ffprobe, переопределяются через FFMPEG_PATH и FFPROBE_PATH
+var (
+	ffmpegBin  = "ffmpeg"
+	ffprobeBin = "ffprobe"
+)
+
+// ffmpegTimeout ограничивает время одной конвертации, задаётся через FFMPEG_TIMEOUT
+var ffmpegTimeout = 2 * time.Minute
+
+var errConversionTimeout = errors.New("ffmpeg conversion timed out")
+
+// Ограничения нагрузки ffmpeg на CPU, задаются через FFMPEG_THREADS и FFMPEG_NICE.
+// 0 — без ограничения
+var (
+	ffmpegThreads int
+	ffmpegNice    int
+)
+
+// niceEnabled сообщает, что ffmpeg запускается через nice.
+func niceEnabled() bool {
+	return ffmpegNice > 0 && runtime.GOOS != "windows"
+}
+
+// ffmpegCommand запускает ffmpeg с аргументами args. При FFMPEG_NICE на Unix
+// ffmpeg запускается через nice с пониженным приоритетом.
+func ffmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	if niceEnabled() {
+		return exec.CommandContext(ctx, "nice", append([]string{"-n", strconv.Itoa(ffmpegNice), ffmpegBin}, args...)...)
+	}
+	return exec.CommandContext(ctx, ffmpegBin, args...)
+}
+
+// checkFFmpeg проверяет при запуске, что ffmpeg и ffprobe доступны, а при
+// FFMPEG_NICE — ещё и nice, через который запускается ffmpeg.
+func checkFFmpeg() error {
+	for _, bin := range []string{ffmpegBin, ffprobeBin} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return missingBinaryError(bin, err)
+		}
+	}
+	if niceEnabled() {
+		if _, err := exec.LookPath("nice"); err != nil {
+			return fmt.Errorf("nice is not found, it is required for FFMPEG_NICE: install coreutils or unset FFMPEG_NICE: %w", err)
+		}
+	}
+	return nil
+}
+
+// Кодировщики для голосовых в порядке предпочтения: libopus есть не во всех
+// сборках ffmpeg, встроенный opus экспериментальный, а OGG Vorbis — крайний
+// случай, клиенты Telegram могут не воспроизвести его как голосовое
+var opusEncoderFallbacks = []string{"libopus", "opus", "libvorbis"}
+
+// selectOpusEncoder выбирает доступный кодировщик для голосовых по списку
+// ffmpeg -encoders и подставляет его в audioCodecs.
+func selectOpusEncoder(ctx context.Context) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegBin, "-hide_banner", "-encoders")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list ffmpeg encoders: %w", execError(ffmpegBin, err, stderr.Bytes()))
+	}
+	encoder := pickEncoder(string(out), opusEncoderFallbacks)
+	if encoder == "" {
+		return "", fmt.Errorf("ffmpeg has none of the encoders %v", opusEncoderFallbacks)
+	}
+	audioCodecs[formatOpus] = encoder
+	return encoder, nil
+}
+
+// pickEncoder возвращает первый из preferred, найденный в выводе ffmpeg -encoders.
+// Строки вывода имеют вид " A....D libopus  libopus Opus ...".
+func pickEncoder(encoders string, preferred []string) string {
+	available := map[string]bool{}
+	for _, line := range strings.Split(encoders, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "A") {
+			available[fields[1]] = true
+		}
+	}
+	for _, name := range preferred {
+		if available[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+func missingBinaryError(bin string, err error) error {
+	return fmt.Errorf("%s is not installed or not found at %q: install ffmpeg or set FFMPEG_PATH and FFPROBE_PATH: %w",
+		filepath.Base(bin), bin, err)
+}
+
+const stderrTailLines = 5
+
+// execError поясняет ошибку запуска внешней команды: сообщает, если бинарник
+// не найден, и добавляет последние строки её stderr.
+func execError(bin string, err error, stderr []byte) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return missingBinaryError(bin, err)
+	}
+	if tail := lastLines(string(stderr), stderrTailLines); tail != "" {
+		return fmt.Errorf("%w: %s", err, tail)
+	}
+	return err
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Голосовые сообщения Telegram ожидаются в моно с частотой 48 кГц
+const (
+	voiceChannels   = 1
+	voiceSampleRate = 48000
+)
+
+// OpusOptions задаёт параметры кодирования в libopus.
+// Пустые поля не передаются в ffmpeg, и используются значения по умолчанию.
+type OpusOptions struct {
+	Bitrate string // например "24k" или "32k"
+	VBR     string // "on", "off" или "constrained"
+	// Режим libopus: "voip", "audio" или "lowdelay", по умолчанию defaultOpusApplication
+	Application string
+
+	Channels   int // по умолчанию voiceChannels
+	SampleRate int // по умолчанию voiceSampleRate
+
+	// AudioDocument отключает приведение к моно 48 кГц для отправки обычным
+	// аудио: каналы и частота берутся из AudioChannels и AudioSampleRate,
+	// а если они не заданы, из исходника
+	AudioDocument   bool
+	AudioChannels   int
+	AudioSampleRate int
+
+	Normalize bool            // выравнивать громкость фильтром loudnorm
+	Loudnorm  LoudnormOptions // по умолчанию defaultLoudnorm
+
+	SampleFormat string // формат сэмплов для -sample_fmt, например "s16" или "flt"
+
+	TrimSilence      bool   // обрезать тишину в начале и в конце
+	SilenceThreshold string // уровень тишины, например "-50dB"
+
+	Speed float64 // ускорение воспроизведения, 0 и 1 — без изменений
+
+	PreventClipping bool    // понижать громкость, если пик выше 0 dBFS
+	Gain            float64 // изменение громкости в dB, вычисляется по пику файла
+}
+
+const defaultSilenceThreshold = "-50dB"
+
+// Режим voip улучшает разборчивость речи, что и нужно голосовым сообщениям
+const defaultOpusApplication = "voip"
+
+// LoudnormOptions задаёт параметры фильтра loudnorm.
+type LoudnormOptions struct {
+	I   float64 // целевая громкость в LUFS
+	TP  float64 // предел истинного пика в dBTP
+	LRA float64 // допустимый разброс громкости в LU
+}
+
+// Параметры loudnorm для речи: целевая громкость -16 LUFS и запас
+// по истинному пику, чтобы не было клиппинга
+var defaultLoudnorm = LoudnormOptions{I: -16, TP: -1.5, LRA: 11}
+
+func loudnormFilter(o LoudnormOptions) string {
+	if o == (LoudnormOptions{}) {
+		o = defaultLoudnorm
+	}
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", o.I, o.TP, o.LRA)
+}
+
+// audioFilters возвращает цепочку фильтров ffmpeg для -af.
+func audioFilters(opts OpusOptions) []string {
+	var filters []string
+	if opts.Gain != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%.1fdB", opts.Gain))
+	}
+	if opts.TrimSilence {
+		filters = append(filters, silenceRemoveFilters(opts.SilenceThreshold)...)
+	}
+	if opts.Speed != 0 && opts.Speed != 1 {
+		filters = append(filters, atempoFilters(opts.Speed)...)
+	}
+	if opts.Normalize {
+		filters = append(filters, loudnormFilter(opts.Loudnorm))
+	}
+	return filters
+}
+
+// silenceRemoveFilters убирает тишину в начале, затем разворачивает запись,
+// чтобы тем же фильтром убрать тишину в конце, и разворачивает обратно.
+func silenceRemoveFilters(threshold string) []string {
+	if threshold == "" {
+		threshold = defaultSilenceThreshold
+	}
+	trim := "silenceremove=start_periods=1:start_threshold=" + threshold
+	return []string{trim, "areverse", trim, "areverse"}
+}
+
+// Один фильтр atempo принимает множитель от 0.5 до 2.0
+const (
+	atempoMin = 0.5
+	atempoMax = 2.0
+)
+
+// atempoFilters меняет скорость в speed раз, разбивая множитель вне диапазона
+// atempo на цепочку фильтров: 3.0 → atempo=2,atempo=1.5.
+func atempoFilters(speed float64) []string {
+	var filters []string
+	for speed > atempoMax {
+		filters = append(filters, fmt.Sprintf("atempo=%g", atempoMax))
+		speed /= atempoMax
+	}
+	for speed < atempoMin {
+		filters = append(filters, fmt.Sprintf("atempo=%g", atempoMin))
+		speed /= atempoMin
+	}
+	return append(filters, fmt.Sprintf("atempo=%g", speed))
+}
+
+var maxVolumePattern = regexp.MustCompile(`max_volume: (-?[\d.]+) dB`)
+
+// detectPeak измеряет пиковый уровень файла в dBFS фильтром volumedetect.
+func detectPeak(ctx context.Context, path string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, ffmpegTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := ffmpegCommand(ctx, "-i", path, "-af", "volumedetect", "-f", "null", "-")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("failed to detect peak: %w", execError(ffmpegBin, err, stderr.Bytes()))
+	}
+	m := maxVolumePattern.FindSubmatch(stderr.Bytes())
+	if m == nil {
+		return 0, fmt.Errorf("max_volume not found in volumedetect output")
+	}
+	return strconv.ParseFloat(string(m[1]), 64)
+}
+
+// Форматы, в которые умеет конвертировать convertAudio
+type audioFormat string
+
+const (
+	formatOpus audioFormat = "opus" // Opus в OGG, единственный формат для голосовых
+	formatAAC  audioFormat = "aac"  // AAC в M4A
+	formatMP3  audioFormat = "mp3"
+)
+
+// audioCodecs сопоставляет формату кодек ffmpeg
+var audioCodecs = map[audioFormat]string{
+	formatOpus: "libopus",
+	formatAAC:  "aac",
+	formatMP3:  "libmp3lame",
+}
+
+func ffmpegArgs(inputPath, outputPath string, format audioFormat, opts OpusOptions) []string {
+	channels := opts.Channels
+	sampleRate := opts.SampleRate
+	// Голосовые сообщения требуют моно 48 кГц, остальные форматы и Opus для
+	// обычного аудио сохраняют параметры исходника, чтобы не портить музыку
+	switch {
+	case format == formatOpus && opts.AudioDocument:
+		channels, sampleRate = opts.AudioChannels, opts.AudioSampleRate
+	case format == formatOpus:
+		if channels == 0 {
+			channels = voiceChannels
+		}
+		if sampleRate == 0 {
+			sampleRate = voiceSampleRate
+		}
+	}
+
+	// -vn отбрасывает видеодорожки: обложки MP3 и видео, из которого извлекается звук
+	args := []string{"-i", inputPath, "-vn", "-c:a", audioCodecs[format]}
+	if channels != 0 {
+		args = append(args, "-ac", strconv.Itoa(channels))
+	}
+	if sampleRate != 0 {
+		args = append(args, "-ar", strconv.Itoa(sampleRate))
+	}
+	if opts.SampleFormat != "" {
+		args = append(args, "-sample_fmt", opts.SampleFormat)
+	}
+	if filters := audioFilters(opts); len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	if opts.Bitrate != "" {
+		args = append(args, "-b:a", opts.Bitrate)
+	}
+	if ffmpegThreads > 0 {
+		args = append(args, "-threads", strconv.Itoa(ffmpegThreads))
+	}
+	// -vbr и -application есть только у libopus
+	switch audioCodecs[format] {
+	case "libopus":
+		if opts.VBR != "" {
+			args = append(args, "-vbr", opts.VBR)
+		}
+		application := opts.Application
+		if application == "" {
+			application = defaultOpusApplication
+		}
+		args = append(args, "-application", application)
+	case "opus":
+		// Встроенный кодировщик Opus помечен в ffmpeg как экспериментальный
+		args = append(args, "-strict", "experimental")
+	}
+	return append(args, outputPath)
+}
+
+// convertAudio конвертирует inputPath в outputPath в формате format.
+// ffmpeg пишет во временный файл, который переименовывается в outputPath
+// только после успешной конвертации и проверки, поэтому прерванная
+// конвертация не оставляет в кэше обрезанный файл.
+func convertAudio(ctx context.Context, inputPath, outputPath string, format audioFormat, opts OpusOptions) error {
+	if _, ok := audioCodecs[format]; !ok {
+		return fmt.Errorf("unsupported audio format %q", format)
+	}
+
+	// Проверяем, существует ли файл outputPath
+	if _, err := os.Stat(outputPath); err == nil {
+		// Исправный файл уже сконвертирован, повреждённый конвертируем заново
+		if validateOutput(ctx, outputPath, format) == nil {
+			return nil
+		}
+		if err := os.Remove(outputPath); err != nil {
+			return fmt.Errorf("failed to remove broken output file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		// Если ошибка не связана с отсутствием файла, возвращаем её
+		return fmt.Errorf("failed to check output file: %w", err)
+	}
+
+	// Создаём директорию для outputPath, если она не существует
+	if err := os.MkdirAll(filepath.Dir(outputPath), dirMode); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Выполняем конвертацию с помощью ffmpeg
+	ctx, cancel := context.WithTimeout(ctx, ffmpegTimeout)
+	defer cancel()
+
+	partPath := partialPath(outputPath)
+	defer func() { _ = os.Remove(partPath) }()
+
+	var stderr bytes.Buffer
+	cmd := ffmpegCommand(ctx, append([]string{"-y"}, ffmpegArgs(inputPath, partPath, format, opts)...)...)
+	cmd.Stderr = &stderr
+	started := time.Now()
+	err := cmd.Run()
+	recordConversion(started, err)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s", errConversionTimeout, ffmpegTimeout)
+		}
+		return fmt.Errorf("failed to convert audio to %s: %w", format, execError(ffmpegBin, err, stderr.Bytes()))
+	}
+	if err := validateOutput(ctx, partPath, format); err != nil {
+		return fmt.Errorf("converted file is invalid: %w", err)
+	}
+	// ffmpeg создаёт файл с правами 0666 и umask, заданный FILE_MODE выставляем явно
+	if fileMode != defaultFileMode {
+		if err := os.Chmod(partPath, fileMode); err != nil {
+			return fmt.Errorf("failed to set output file mode: %w", err)
+		}
+	}
+	if err := os.Rename(partPath, outputPath); err != nil {
+		return fmt.Errorf("failed to save output file: %w", err)
+	}
+
+	return nil
+}
+
+var partialSeq atomic.Int64
+
+// partialPath возвращает уникальное имя временного файла рядом с outputPath.
+// Расширение сохраняется, по нему ffmpeg выбирает контейнер.
+func partialPath(outputPath string) string {
+	return filepath.Join(filepath.Dir(outputPath),
+		fmt.Sprintf(".partial-%d-%d-%s", os.Getpid(), partialSeq.Add(1), filepath.Base(outputPath)))
+}
+
+// validateOutput проверяет, что результат конвертации не пустой, читается
+// ffprobe и, для OGG, дописан до последней страницы.
+func validateOutput(ctx context.Context, path string, format audioFormat) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return errors.New("output file is empty")
+	}
+	if format == formatOpus {
+		if err := checkOggComplete(path); err != nil {
+			return err
+		}
+	}
+	_, err = probeAudio(ctx, path)
+	return err
+}
+
+// checkOggComplete проходит по страницам OGG и проверяет, что файл
+// заканчивается целой страницей с флагом конца потока. У обрезанного файла
+// последняя страница неполная или флага нет.
+func checkOggComplete(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Заголовок страницы — 27 байт, затем таблица из до 255 сегментов
+	var header [27 + 255]byte
+	var offset int64
+	var eos bool
+	for offset < info.Size() {
+		if info.Size()-offset < 27 {
+			return errors.New("ogg file is truncated: incomplete page header")
+		}
+		if _, err := f.ReadAt(header[:27], offset); err != nil {
+			return err
+		}
+		if string(header[:4]) != "OggS" {
+			return fmt.Errorf("ogg file is corrupted: no page at offset %d", offset)
+		}
+		segments := int(header[26])
+		if info.Size()-offset < int64(27+segments) {
+			return errors.New("ogg file is truncated: incomplete segment table")
+		}
+		if _, err := f.ReadAt(header[27:27+segments], offset+27); err != nil {
+			return err
+		}
+		size := int64(27 + segments)
+		for _, n := range header[27 : 27+segments] {
+			size += int64(n)
+		}
+		eos = header[5]&0x04 != 0
+		offset += size
+	}
+	if offset != info.Size() {
+		return errors.New("ogg file is truncated: incomplete last page")
+	}
+	if !eos {
+		return errors.New("ogg file is truncated: no end of stream page")
+	}
+	return nil
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// containsSeq сообщает, что seq встречается в args подряд.
+func containsSeq(args, seq []string) bool {
+	for i := 0; i+len(seq) <= len(args); i++ {
+		if slices.Equal(args[i:i+len(seq)], seq) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFFmpegArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		format audioFormat
+		opts   OpusOptions
+		want   [][]string // последовательности аргументов, которые должны быть
+		absent []string   // флаги, которых быть не должно
+	}{
+		{
+			name:   "default bitrate",
+			format: formatOpus,
+			want:   [][]string{{"-i", "in.mp3", "-vn", "-c:a", "libopus"}},
+			absent: []string{"-b:a"},
+		},
+		{
+			name:   "bitrate",
+			format: formatOpus,
+			opts:   OpusOptions{Bitrate: "32k"},
+			want:   [][]string{{"-b:a", "32k"}},
+		},
+		{
+			name:   "voice is mono 48 kHz",
+			format: formatOpus,
+			want:   [][]string{{"-ac", "1"}, {"-ar", "48000"}},
+		},
+		{
+			name:   "explicit channels and sample rate",
+			format: formatOpus,
+			opts:   OpusOptions{Channels: 2, SampleRate: 24000},
+			want:   [][]string{{"-ac", "2"}, {"-ar", "24000"}},
+		},
+		{
+			name:   "voip application by default",
+			format: formatOpus,
+			want:   [][]string{{"-application", "voip"}},
+		},
+		{
+			name:   "custom application",
+			format: formatOpus,
+			opts:   OpusOptions{Application: "lowdelay"},
+			want:   [][]string{{"-application", "lowdelay"}},
+		},
+		{
+			name:   "sample format",
+			format: formatOpus,
+			opts:   OpusOptions{SampleFormat: "s16"},
+			want:   [][]string{{"-sample_fmt", "s16"}},
+		},
+		{
+			name:   "native sample format by default",
+			format: formatOpus,
+			absent: []string{"-sample_fmt"},
+		},
+		{
+			name:   "loudnorm filter",
+			format: formatOpus,
+			opts:   OpusOptions{Normalize: true, Loudnorm: LoudnormOptions{I: -23, TP: -2, LRA: 7}},
+			want:   [][]string{{"-af", "loudnorm=I=-23:TP=-2:LRA=7"}},
+		},
+		{
+			name:   "audio document keeps source layout",
+			format: formatOpus,
+			opts:   OpusOptions{AudioDocument: true},
+			absent: []string{"-ac", "-ar"},
+		},
+		{
+			name:   "audio document ignores voice layout",
+			format: formatOpus,
+			opts:   OpusOptions{AudioDocument: true, Channels: 1, SampleRate: 16000, AudioChannels: 2, AudioSampleRate: 48000},
+			want:   [][]string{{"-ac", "2"}, {"-ar", "48000"}},
+		},
+		{
+			name:   "aac keeps source layout",
+			format: formatAAC,
+			opts:   OpusOptions{Bitrate: "64k"},
+			want:   [][]string{{"-c:a", "aac"}, {"-b:a", "64k"}},
+			absent: []string{"-ac", "-ar", "-application", "-vbr"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := ffmpegArgs("in.mp3", "out.ogg", tt.format, tt.opts)
+			if args[len(args)-1] != "out.ogg" {
+				t.Errorf("output path must be the last argument: %q", args)
+			}
+			for _, seq := range tt.want {
+				if !containsSeq(args, seq) {
+					t.Errorf("args %q do not contain %q", args, seq)
+				}
+			}
+			for _, flag := range tt.absent {
+				if slices.Contains(args, flag) {
+					t.Errorf("args %q must not contain %s", args, flag)
+				}
+			}
+		})
+	}
+}
+
+func TestFFmpegThreads(t *testing.T) {
+	tests := []struct {
+		name    string
+		threads int
+		want    []string
+	}{
+		{name: "ffmpeg default", threads: 0},
+		{name: "limited", threads: 2, want: []string{"-threads", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &ffmpegThreads, tt.threads)
+			args := ffmpegArgs("in.mp3", "out.ogg", formatOpus, OpusOptions{})
+			if tt.want == nil {
+				if slices.Contains(args, "-threads") {
+					t.Errorf("args %q must not contain -threads", args)
+				}
+				return
+			}
+			if !containsSeq(args, tt.want) {
+				t.Errorf("args %q do not contain %q", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestFFmpegCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("nice is not used on windows")
+	}
+	setVar(t, &ffmpegBin, "/usr/bin/ffmpeg")
+
+	tests := []struct {
+		name string
+		nice int
+		want []string
+	}{
+		{name: "normal priority", want: []string{"/usr/bin/ffmpeg", "-i", "in.mp3"}},
+		{name: "nice", nice: 10, want: []string{"nice", "-n", "10", "/usr/bin/ffmpeg", "-i", "in.mp3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &ffmpegNice, tt.nice)
+			cmd := ffmpegCommand(context.Background(), "-i", "in.mp3")
+			if !slices.Equal(cmd.Args, tt.want) {
+				t.Errorf("command = %q, want %q", cmd.Args, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFFmpeg(t *testing.T) {
+	fake := fakeBinary(t, "ffmpeg", "exit 0")
+	missing := t.TempDir()
+
+	tests := []struct {
+		name    string
+		ffmpeg  string
+		ffprobe string
+		nice    int
+		wantErr string
+	}{
+		{name: "both found", ffmpeg: fake, ffprobe: fake},
+		// В PATH нет nice, а FFMPEG_NICE задан
+		{name: "nice missing", ffmpeg: fake, ffprobe: fake, nice: 10, wantErr: "nice is not found"},
+		{name: "ffmpeg missing", ffmpeg: filepath.Join(missing, "ffmpeg"), ffprobe: fake, wantErr: "ffmpeg is not installed"},
+		{name: "ffprobe missing", ffmpeg: fake, ffprobe: filepath.Join(missing, "ffprobe"), wantErr: "ffprobe is not installed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldFFmpeg, oldFFprobe := ffmpegBin, ffprobeBin
+			ffmpegBin, ffprobeBin = tt.ffmpeg, tt.ffprobe
+			t.Cleanup(func() { ffmpegBin, ffprobeBin = oldFFmpeg, oldFFprobe })
+			setVar(t, &ffmpegNice, tt.nice)
+			if tt.nice > 0 {
+				t.Setenv("PATH", missing)
+			}
+
+			err := checkFFmpeg()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkFFmpeg() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkFFmpeg() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectOpusEncoder(t *testing.T) {
+	const header = `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC
+ A....D aac                  AAC (Advanced Audio Coding)`
+
+	tests := []struct {
+		name     string
+		script   string
+		want     string
+		wantArgs []string // параметры, которые кодировщик добавляет к команде ffmpeg
+		wantErr  string
+	}{
+		{name: "libopus", script: header + "\n A....D libopus              libopus Opus\n A....D opus                 Opus", want: "libopus", wantArgs: []string{"-application", "voip"}},
+		{name: "built-in opus", script: header + "\n A..X.. opus                 Opus\n A....D libvorbis            libvorbis", want: "opus", wantArgs: []string{"-strict", "experimental"}},
+		{name: "vorbis only", script: header + "\n A....D libvorbis            libvorbis", want: "libvorbis", wantArgs: []string{"-c:a", "libvorbis"}},
+		// Видеокодировщик с тем же именем не подходит
+		{name: "no audio encoder", script: header + "\n V....D libopus              fake", wantErr: "none of the encoders"},
+		{name: "ffmpeg fails", script: "", wantErr: "failed to list ffmpeg encoders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := "exit 1"
+			if tt.script != "" {
+				script = "cat <<'EOF'\n" + tt.script + "\nEOF"
+			}
+			setFFmpeg(t, script)
+			setVar(t, &audioCodecs, maps.Clone(audioCodecs))
+			before := audioCodecs[formatOpus]
+
+			got, err := selectOpusEncoder(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectOpusEncoder() error = %v, want %q", err, tt.wantErr)
+				}
+				if audioCodecs[formatOpus] != before {
+					t.Errorf("audioCodecs[opus] = %q, want unchanged %q", audioCodecs[formatOpus], before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || audioCodecs[formatOpus] != tt.want {
+				t.Errorf("selectOpusEncoder() = %q, codec %q, want %q", got, audioCodecs[formatOpus], tt.want)
+			}
+			if args := ffmpegArgs("in.mp3", "out.ogg", formatOpus, OpusOptions{}); !containsSeq(args, tt.wantArgs) {
+				t.Errorf("ffmpeg args %q do not contain %q", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestExecError(t *testing.T) {
+	exitErr := exec.Command("false").Run()
+	if exitErr == nil {
+		t.Skip("false is not available")
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		stderr string
+		want   []string
+		absent []string
+	}{
+		{
+			name:   "last stderr lines",
+			err:    exitErr,
+			stderr: "line 1\nline 2\nline 3\nline 4\nline 5\nline 6\nInvalid data found when processing input\n",
+			want:   []string{"exit status 1", "line 3", "Invalid data found when processing input"},
+			absent: []string{"line 2"},
+		},
+		{name: "empty stderr", err: exitErr, want: []string{"exit status 1"}, absent: []string{": "}},
+		{name: "binary not found", err: exec.ErrNotFound, want: []string{"ffmpeg is not installed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := execError("ffmpeg", tt.err, []byte(tt.stderr)).Error()
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("execError() = %q, want %q", got, w)
+				}
+			}
+			for _, a := range tt.absent {
+				if strings.Contains(got, a) {
+					t.Errorf("execError() = %q, must not contain %q", got, a)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertAudioUnsupportedFormat(t *testing.T) {
+	err := convertAudio(context.Background(), "in.mp3", filepath.Join(t.TempDir(), "out.wav"), "wav", OpusOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unsupported audio format") {
+		t.Errorf("convertAudio() = %v, want unsupported format", err)
+	}
+}
+
+func TestConvertAudioFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		ffmpeg  string
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name:    "stderr is reported",
+			ffmpeg:  `echo "input.mp3: Invalid data found when processing input" >&2; exit 1`,
+			wantErr: "Invalid data found when processing input",
+		},
+		{
+			// ffmpeg убит посреди записи: страница без флага конца потока
+			name:    "interrupted conversion",
+			ffmpeg:  `for last; do :; done; printf 'OggS\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000' > "$last"; kill -9 $$`,
+			wantErr: "failed to convert audio",
+		},
+		{
+			name:    "truncated output with success status",
+			ffmpeg:  `for last; do :; done; printf 'OggS\000\004\000\000' > "$last"`,
+			wantErr: "converted file is invalid",
+		},
+		{
+			name:    "timeout",
+			ffmpeg:  "exec sleep 5",
+			timeout: 50 * time.Millisecond,
+			wantErr: errConversionTimeout.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFmpeg(t, tt.ffmpeg)
+			setFFprobe(t, fakeFFprobeScript)
+			if tt.timeout > 0 {
+				old := ffmpegTimeout
+				ffmpegTimeout = tt.timeout
+				t.Cleanup(func() { ffmpegTimeout = old })
+			}
+			dir := t.TempDir()
+			output := filepath.Join(dir, "out.ogg")
+
+			err := convertAudio(context.Background(), filepath.Join(dir, "in.mp3"), output, formatOpus, OpusOptions{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("convertAudio() = %v, want %q", err, tt.wantErr)
+			}
+			// Ни результата, ни временного файла не остаётся
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("files left after failed conversion: %v", entries)
+			}
+		})
+	}
+}
+
+// oggPage собирает страницу OGG с флагами заголовка flags и телом payload
+// из одного сегмента. Контрольная сумма не заполняется, checkOggComplete её
+// не проверяет.
+func oggPage(flags byte, payload []byte) []byte {
+	page := make([]byte, 27, 28+len(payload))
+	copy(page, "OggS")
+	page[5] = flags
+	page[26] = 1
+	page = append(page, byte(len(payload)))
+	return append(page, payload...)
+}
+
+func TestCheckOggComplete(t *testing.T) {
+	const eos = 0x04
+	first := oggPage(0x02, []byte("OpusHead"))
+	last := oggPage(eos, []byte("audio"))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "complete", data: append(slices.Clone(first), last...)},
+		{name: "single page", data: last},
+		{name: "no end of stream", data: first, wantErr: "no end of stream page"},
+		{name: "incomplete last page", data: append(slices.Clone(first), last[:len(last)-2]...), wantErr: "incomplete last page"},
+		{name: "incomplete page header", data: append(slices.Clone(first), last[:10]...), wantErr: "incomplete page header"},
+		{name: "incomplete segment table", data: append(slices.Clone(first), last[:27]...), wantErr: "incomplete segment table"},
+		{name: "not ogg", data: []byte("ID3\x03\x00\x00\x00\x00\x00\x00 not an ogg file at all"), wantErr: "no page at offset 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "voice.ogg")
+			if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			err := checkOggComplete(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkOggComplete() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkOggComplete() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConvertAudioReplacesTruncatedOutput(t *testing.T) {
+	setFakeConverter(t)
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.ogg")
+	// Обрезанный файл от прерванной конвертации прошлого запуска
+	truncated := oggPage(0, []byte("audio"))
+	if err := os.WriteFile(output, truncated, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := convertAudio(context.Background(), filepath.Join(dir, "in.mp3"), output, formatOpus, OpusOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOggComplete(output); err != nil {
+		t.Errorf("cached output is still broken: %v", err)
+	}
+}
+
+func TestAudioFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		opts OpusOptions
+		want []string
+	}{
+		{name: "no filters", want: nil},
+		{name: "normalize with defaults", opts: OpusOptions{Normalize: true}, want: []string{"loudnorm=I=-16:TP=-1.5:LRA=11"}},
+		{
+			name: "normalize with custom target",
+			opts: OpusOptions{Normalize: true, Loudnorm: LoudnormOptions{I: -23, TP: -2, LRA: 7}},
+			want: []string{"loudnorm=I=-23:TP=-2:LRA=7"},
+		},
+		{
+			name: "gain goes first",
+			opts: OpusOptions{Gain: -2.5, Normalize: true},
+			want: []string{"volume=-2.5dB", "loudnorm=I=-16:TP=-1.5:LRA=11"},
+		},
+		{
+			name: "trim silence with default threshold",
+			opts: OpusOptions{TrimSilence: true},
+			want: []string{
+				"silenceremove=start_periods=1:start_threshold=-50dB", "areverse",
+				"silenceremove=start_periods=1:start_threshold=-50dB", "areverse",
+			},
+		},
+		{name: "normal speed", opts: OpusOptions{Speed: 1}, want: nil},
+		{
+			name: "speed before normalize",
+			opts: OpusOptions{Speed: 1.25, Normalize: true},
+			want: []string{"atempo=1.25", "loudnorm=I=-16:TP=-1.5:LRA=11"},
+		},
+		{
+			name: "trim silence before normalize",
+			opts: OpusOptions{TrimSilence: true, SilenceThreshold: "-40dB", Normalize: true},
+			want: []string{
+				"silenceremove=start_periods=1:start_threshold=-40dB", "areverse",
+				"silenceremove=start_periods=1:start_threshold=-40dB", "areverse",
+				"loudnorm=I=-16:TP=-1.5:LRA=11",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := audioFilters(tt.opts); !slices.Equal(got, tt.want) {
+				t.Errorf("audioFilters() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClippingOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		prevent  bool
+		ffmpeg   string
+		wantGain float64
+	}{
+		{name: "peak above 0 dBFS", prevent: true, ffmpeg: `echo "[Parsed_volumedetect_0] max_volume: 2.5 dB" >&2`, wantGain: -2.5},
+		{name: "peak below 0 dBFS", prevent: true, ffmpeg: `echo "[Parsed_volumedetect_0] max_volume: -3.1 dB" >&2`},
+		{name: "detection failed", prevent: true, ffmpeg: "exit 1"},
+		// ffmpeg с пиком выше нуля не запускается, если PREVENT_CLIPPING выключен
+		{name: "disabled", ffmpeg: `echo "max_volume: 2.5 dB" >&2`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFmpeg(t, tt.ffmpeg)
+			opts := clippingOptions(context.Background(), zap.NewNop(), "in.mp3", OpusOptions{PreventClipping: tt.prevent})
+			if opts.Gain != tt.wantGain {
+				t.Errorf("Gain = %g, want %g", opts.Gain, tt.wantGain)
+			}
+		})
+	}
+}
+
+func TestAtempoFilters(t *testing.T) {
+	tests := []struct {
+		speed float64
+		want  []string
+	}{
+		{speed: 1.25, want: []string{"atempo=1.25"}},
+		{speed: 2, want: []string{"atempo=2"}},
+		{speed: 0.5, want: []string{"atempo=0.5"}},
+		{speed: 3, want: []string{"atempo=2", "atempo=1.5"}},
+		{speed: 4, want: []string{"atempo=2", "atempo=2"}},
+		{speed: 0.25, want: []string{"atempo=0.5", "atempo=0.5"}},
+	}
+	for _, tt := range tests {
+		if got := atempoFilters(tt.speed); !slices.Equal(got, tt.want) {
+			t.Errorf("atempoFilters(%g) = %q, want %q", tt.speed, got, tt.want)
+		}
+	}
+}
+
+// TestSpeedDuration проверяет настоящим ffmpeg, что ускоренная запись
+// становится короче. Без ffmpeg в PATH тест пропускается.
+func TestSpeedDuration(t *testing.T) {
+	requireFFmpeg(t)
+	input := generateMedia(t, "tone.wav", "-f", "lavfi", "-i", "sine=frequency=440:duration=4", "-c:a", "pcm_s16le")
+
+	tests := []struct {
+		speed float64
+		want  int
+	}{
+		{speed: 1, want: 4},
+		{speed: 2, want: 2},
+		{speed: 4, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.speed), func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "voice.ogg")
+			if err := convertAudio(context.Background(), input, output, formatOpus, OpusOptions{Speed: tt.speed}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := audioDuration(context.Background(), output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("duration = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConvertAudioChannels проверяет ffprobe каналы и частоту результата
+// настоящей конвертации. Без ffmpeg в PATH тест пропускается.
+func TestConvertAudioChannels(t *testing.T) {
+	requireFFmpeg(t)
+	// Vorbis сохраняет частоту исходника, проверка рассчитана на Opus
+	if audioCodecs[formatOpus] == "libvorbis" {
+		t.Skip("ffmpeg has no Opus encoder")
+	}
+	stereo := generateMedia(t, "stereo.wav", "-f", "lavfi", "-i", "sine=frequency=440:duration=1:sample_rate=44100", "-ac", "2", "-c:a", "pcm_s16le")
+
+	tests := []struct {
+		name         string
+		opts         OpusOptions
+		wantChannels int
+	}{
+		{name: "voice is mono", wantChannels: voiceChannels},
+		{name: "audio keeps source channels", opts: OpusOptions{AudioDocument: true}, wantChannels: 2},
+		{name: "audio channels", opts: OpusOptions{AudioDocument: true, AudioChannels: 1}, wantChannels: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "voice.ogg")
+			if err := convertAudio(context.Background(), stereo, output, formatOpus, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			info, err := probeAudio(context.Background(), output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Opus всегда декодируется в 48 кГц
+			if info.Channels != tt.wantChannels || info.SampleRate != voiceSampleRate {
+				t.Errorf("output has %d channels at %d Hz, want %d at %d", info.Channels, info.SampleRate, tt.wantChannels, voiceSampleRate)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tgerr"
+)
+
+var errFileTooLarge = errors.New("file is too large")
+
+// failureReason объясняет пользователю, почему файл не удалось обработать.
+// Подробности ошибки, вроде путей и вывода ffmpeg, остаются только в логе.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, errUnreadableAudio):
+		return "файл повреждён или это не аудио"
+	case errors.Is(err, errConversionTimeout):
+		return "конвертация заняла слишком много времени"
+	case errors.Is(err, errFileTooLarge):
+		return "файл слишком большой"
+	case errors.Is(err, exec.ErrNotFound):
+		return "конвертер недоступен на сервере"
+	case tgerr.Is(err, "FILE_REFERENCE_EXPIRED"):
+		return "файл больше недоступен, пришлите его заново"
+	case tgerr.Is(err, tgerr.FloodWaitErrors...):
+		return "Telegram ограничил частоту запросов, попробуйте позже"
+	default:
+		return "ошибка конвертации"
+	}
+}
+
+// shouldReportFailure сообщает, нужно ли отвечать в чат об ошибке. При
+// остановке бота задачи прерываются, и это не ошибка файла.
+func shouldReportFailure(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && !errors.Is(err, context.Canceled)
+}
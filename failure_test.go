@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"go.uber.org/zap"
+)
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "unreadable audio", err: fmt.Errorf("%w: Invalid data found", errUnreadableAudio), want: "файл повреждён или это не аудио"},
+		{name: "timeout", err: errors.Wrap(errConversionTimeout, "convert audio to ogg"), want: "конвертация заняла слишком много времени"},
+		{name: "too large", err: errFileTooLarge, want: "файл слишком большой"},
+		{name: "missing ffmpeg", err: &exec.Error{Name: "ffmpeg", Err: exec.ErrNotFound}, want: "конвертер недоступен на сервере"},
+		{name: "expired file reference", err: errors.Wrap(tgerr.New(400, "FILE_REFERENCE_EXPIRED"), "download"), want: "файл больше недоступен, пришлите его заново"},
+		{name: "flood wait", err: tgerr.New(420, "FLOOD_WAIT_30"), want: "Telegram ограничил частоту запросов, попробуйте позже"},
+		{name: "other error", err: errors.New("exit status 1: /srv/downloads/song.mp3: Invalid argument"), want: "ошибка конвертации"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Errorf("failureReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldReportFailure(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "success", ctx: context.Background()},
+		{name: "failure", ctx: context.Background(), err: errors.New("convert audio"), want: true},
+		{name: "bot is stopping", ctx: canceled, err: errors.New("convert audio")},
+		{name: "job canceled", ctx: context.Background(), err: errors.Wrap(context.Canceled, "download")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldReportFailure(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("shouldReportFailure() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAudioReportsFailure(t *testing.T) {
+	setFFprobe(t, fakeFFprobeScript)
+	setOggCache(t)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name      string
+		ffmpeg    string
+		dryRun    bool
+		wantReply string
+	}{
+		{name: "conversion fails", ffmpeg: "echo \"$0: Invalid argument\" >&2; exit 1", wantReply: "Не удалось обработать song.mp3: ошибка конвертации"},
+		{name: "dry run is silent", ffmpeg: "exit 1", dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFmpeg(t, tt.ffmpeg)
+			setVar(t, &dryRun, tt.dryRun)
+			doc, content := testAudio("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{Duration: 3})
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			err := processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files)
+			if err == nil {
+				t.Fatal("processAudio() succeeded, want error")
+			}
+			if tt.wantReply == "" {
+				if len(api.sentMessages) != 0 {
+					t.Errorf("sent %d messages, want none", len(api.sentMessages))
+				}
+				return
+			}
+			if len(api.sentMessages) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(api.sentMessages))
+			}
+			req := api.sentMessages[0]
+			if req.Message != tt.wantReply {
+				t.Errorf("reply = %q, want %q", req.Message, tt.wantReply)
+			}
+			// Пути и вывод ffmpeg остаются в логе
+			if strings.Contains(req.Message, dir) || strings.Contains(req.Message, "Invalid argument") {
+				t.Errorf("reply %q leaks error details", req.Message)
+			}
+			if reply, ok := req.ReplyTo.(*tg.InputReplyToMessage); !ok || reply.ReplyToMsgID != 10 {
+				t.Errorf("ReplyTo = %v, want message 10", req.ReplyTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// fileRefs считает, сколько обработчиков сейчас используют файл, чтобы
+// не удалить его из-под другой конвертации того же документа.
+type fileRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+var activeFiles = &fileRefs{refs: map[string]int{}}
+
+func (r *fileRefs) acquire(paths ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range paths {
+		r.refs[p]++
+	}
+}
+
+// release освобождает файлы и, если remove установлен, удаляет те из них,
+// которые больше никем не используются.
+func (r *fileRefs) release(remove bool, paths ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range paths {
+		r.refs[p]--
+		if r.refs[p] > 0 {
+			continue
+		}
+		delete(r.refs, p)
+		if remove {
+			_ = os.Remove(p)
+		}
+	}
+}
+
+// removeUnused удаляет файл, если его никто не использует. removed равен
+// false, если файл занят.
+func (r *fileRefs) removeUnused(path string) (removed bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs[path] > 0 {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// keyedMutex позволяет выполнять не более одной операции на ключ одновременно.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[int64]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// conversionLocks не даёт параллельно скачивать и конвертировать один и тот же документ
+var conversionLocks = &keyedMutex{locks: map[int64]*keyedLock{}}
+
+// Lock захватывает блокировку для key и возвращает функцию для её освобождения.
+func (k *keyedMutex) Lock(key int64) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
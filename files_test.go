@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestFileRefsRelease(t *testing.T) {
+	tests := []struct {
+		name     string
+		holders  int
+		releases int
+		remove   bool
+		wantFile bool
+	}{
+		{name: "removed after send", holders: 1, releases: 1, remove: true, wantFile: false},
+		{name: "kept while used by another job", holders: 2, releases: 1, remove: true, wantFile: true},
+		{name: "removed by the last holder", holders: 2, releases: 2, remove: true, wantFile: false},
+		{name: "kept on failure", holders: 1, releases: 1, remove: false, wantFile: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "voice.ogg")
+			if err := os.WriteFile(path, []byte("ogg"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			refs := &fileRefs{refs: map[string]int{}}
+			for range tt.holders {
+				refs.acquire(path)
+			}
+			for range tt.releases {
+				refs.release(tt.remove, path)
+			}
+			_, err := os.Stat(path)
+			if exists := err == nil; exists != tt.wantFile {
+				t.Errorf("file exists = %t, want %t", exists, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []int64 // ключ для каждой горутины
+	}{
+		{name: "same document", keys: []int64{1, 1, 1, 1}},
+		{name: "different documents", keys: []int64{1, 2, 3}},
+		{name: "mixed", keys: []int64{1, 2, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &keyedMutex{locks: map[int64]*keyedLock{}}
+			var (
+				mu      sync.Mutex
+				holders = map[int64]int{}
+				wg      sync.WaitGroup
+			)
+			for _, key := range tt.keys {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					unlock := k.Lock(key)
+					defer unlock()
+
+					mu.Lock()
+					holders[key]++
+					if holders[key] > 1 {
+						t.Errorf("key %d is held by %d goroutines", key, holders[key])
+					}
+					mu.Unlock()
+					time.Sleep(time.Millisecond)
+					mu.Lock()
+					holders[key]--
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			if len(k.locks) != 0 {
+				t.Errorf("%d locks left after unlock", len(k.locks))
+			}
+		})
+	}
+}
+
+func TestKeyedMutexDifferentKeysDoNotBlock(t *testing.T) {
+	k := &keyedMutex{locks: map[int64]*keyedLock{}}
+	unlock := k.Lock(1)
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		k.Lock(2)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of another key is blocked")
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	setFakeConverter(t)
+	// Права выбраны так, чтобы их не менял обычный umask 022
+	setVar(t, &dirMode, 0o750)
+	setVar(t, &fileMode, 0o640)
+	doc, content := testAudio("audio/mpeg", "song.mp3")
+	api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+	dir := t.TempDir()
+
+	checks := []struct {
+		name string
+		path string
+		make func(path string) error
+		want os.FileMode
+	}{
+		{
+			name: "writable dir",
+			path: filepath.Join(dir, "session"),
+			make: ensureWritableDir,
+			want: 0o750 | os.ModeDir,
+		},
+		{
+			name: "download",
+			path: filepath.Join(dir, "downloads", "1.mp3"),
+			make: func(path string) error {
+				_, err := downloadFile(context.Background(), zap.NewNop(), api, doc, path)
+				return err
+			},
+			want: 0o640,
+		},
+		{
+			name: "download dir",
+			path: filepath.Join(dir, "downloads"),
+			make: func(string) error { return nil },
+			want: 0o750 | os.ModeDir,
+		},
+		{
+			name: "converted",
+			path: filepath.Join(dir, "ogg", "voice.ogg"),
+			make: func(path string) error {
+				return convertAudio(context.Background(), filepath.Join(dir, "downloads", "1.mp3"), path, formatOpus, OpusOptions{})
+			},
+			want: 0o640,
+		},
+		{
+			name: "ogg dir",
+			path: filepath.Join(dir, "ogg"),
+			make: func(string) error { return nil },
+			want: 0o750 | os.ModeDir,
+		},
+	}
+	// Проверки идут по порядку: конвертация использует скачанный файл
+	for _, c := range checks {
+		if err := c.make(c.path); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		info, err := os.Stat(c.path)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := info.Mode() & (os.ModeDir | os.ModePerm); got != c.want {
+			t.Errorf("%s mode = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
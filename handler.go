@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/contrib/storage"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// messageHandler обрабатывает новые сообщения рабочего чата и личных диалогов.
+// Все зависимости передаются полями, поэтому обработчик можно собрать с
+// заглушкой telegramAPI и хранилищами во временной директории.
+type messageHandler struct {
+	lg        *zap.Logger
+	api       telegramAPI
+	peers     storage.PeerStorage
+	files     fileOptions
+	queue     *jobQueue
+	processed *processedStore
+	settings  *settingsStore
+	configs   *configSource // источник настроек для /reload
+	// albums собирает файлы альбомов; nil — каждый файл обрабатывается отдельно
+	albums *albumBuffer
+}
+
+// Register подписывает обработчик на новые сообщения каналов и, если
+// allowDM, личных диалогов, а если onEdit, то и на их редактирование.
+// Ошибка обработки одного сообщения не должна останавливать получение
+// апдейтов, поэтому она только логируется.
+func (h *messageHandler) Register(dispatcher tg.UpdateDispatcher, allowDM, onEdit bool) {
+	dispatcher.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateNewChannelMessage) error {
+		h.handleUpdate(ctx, e, u.Message, false)
+		return nil
+	})
+	if allowDM {
+		dispatcher.OnNewMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateNewMessage) error {
+			h.handleUpdate(ctx, e, u.Message, false)
+			return nil
+		})
+	}
+	if !onEdit {
+		return
+	}
+	dispatcher.OnEditChannelMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateEditChannelMessage) error {
+		h.handleUpdate(ctx, e, u.Message, true)
+		return nil
+	})
+	if allowDM {
+		dispatcher.OnEditMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateEditMessage) error {
+			h.handleUpdate(ctx, e, u.Message, true)
+			return nil
+		})
+	}
+}
+
+func (h *messageHandler) handleUpdate(ctx context.Context, e tg.Entities, m tg.MessageClass, edited bool) {
+	msg, ok := m.(*tg.Message)
+	if !ok {
+		return
+	}
+	var err error
+	if edited {
+		err = h.HandleEdit(ctx, e, msg)
+	} else {
+		err = h.Handle(ctx, e, msg)
+	}
+	if err != nil {
+		h.lg.Error("Handle message", zap.Int("msg_id", msg.ID), zap.Bool("edited", edited), zap.Error(err))
+	}
+}
+
+// Handle выполняет команду из сообщения, ставит в очередь его аудио
+// и подписывает голосовое, на которое ответили текстом.
+func (h *messageHandler) Handle(ctx context.Context, e tg.Entities, msg *tg.Message) error {
+	return h.handle(ctx, e, msg, false)
+}
+
+// HandleEdit заново обрабатывает отредактированное сообщение: аудио
+// конвертируется повторно, даже если уже было обработано, а команды
+// не выполняются второй раз. Свои сообщения бот не перерабатывает.
+// Апдейты без настоящего редактирования, например после реакции, и правки,
+// которые не меняют файл и текст, пропускаются.
+func (h *messageHandler) HandleEdit(ctx context.Context, e tg.Entities, msg *tg.Message) error {
+	if msg.Out || msg.EditDate == 0 {
+		return nil
+	}
+	return h.handle(ctx, e, msg, true)
+}
+
+// newVersion запоминает версию сообщения и сообщает, изменилось ли оно
+// с прошлой обработки.
+func (h *messageHandler) newVersion(peer tg.InputPeerClass, msg *tg.Message) (bool, error) {
+	changed, err := h.processed.UpdateVersion(inputPeerID(peer), msg.ID, messageVersionOf(msg))
+	if err != nil {
+		return false, errors.Wrap(err, "update message version")
+	}
+	return changed, nil
+}
+
+// alreadyProcessed сообщает, что сообщение уже обработано и повторный апдейт
+// нужно пропустить. Отредактированные сообщения обрабатываются заново.
+func (h *messageHandler) alreadyProcessed(peer tg.InputPeerClass, msg *tg.Message, edited bool) (bool, error) {
+	seen, err := h.processed.Seen(inputPeerID(peer), msg.ID)
+	if err != nil {
+		return false, errors.Wrap(err, "check processed")
+	}
+	if seen && !edited {
+		h.lg.Info("Skip already processed message", zap.Int("msg_id", msg.ID))
+		return true, nil
+	}
+	return false, nil
+}
+
+func (h *messageHandler) handle(ctx context.Context, e tg.Entities, msg *tg.Message, edited bool) error {
+	peer, err := messagePeer(ctx, h.api, h.peers, e, msg)
+	if err != nil || peer == nil {
+		return err
+	}
+	if edited {
+		changed, err := h.newVersion(peer, msg)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			h.lg.Debug("Skip edit without changes", zap.Int("msg_id", msg.ID))
+			return nil
+		}
+	}
+
+	// Обработка команд
+	if cmd, args, ok := parseCommand(msg.Message); ok && !edited {
+		if maintenance.Load() && (cmd == "reprocess" || cmd == "schedule") {
+			return sendMessage(ctx, h.api, peer, maintenanceReply, msg.ID)
+		}
+		switch cmd {
+		case "maintenance":
+			return handleMaintenance(ctx, h.api, peer, msg, args, h.settings)
+		case "reprocess":
+			return handleReprocess(ctx, h.lg, h.api, peer, msg, args, h.files, h.queue, h.processed)
+		case "schedule":
+			return handleSchedule(ctx, h.lg, h.api, peer, msg, args, h.files, h.queue, h.processed)
+		case "reload":
+			return handleReload(ctx, h.api, peer, msg, h.queue, h.configs)
+		case "bitrate":
+			return handleBitrate(ctx, h.api, peer, msg, args, h.settings)
+		case "normalize":
+			return handleNormalize(ctx, h.api, peer, msg, args, h.settings)
+		case "queue":
+			return handleQueue(ctx, h.api, peer, msg, h.queue)
+		case "cancel":
+			return handleCancel(ctx, h.api, peer, msg, args, h.queue)
+		case "stats":
+			return handleStats(ctx, h.api, peer, msg)
+		}
+		if handled, err := handleCommand(ctx, h.api, peer, msg, cmd, h.queue); handled {
+			return err
+		}
+	}
+
+	// Обработка аудиофайлов
+	if media, ok := msg.Media.(*tg.MessageMediaDocument); ok {
+		if doc, ok := media.Document.(*tg.Document); ok {
+			if isConvertible(doc) {
+				if !isAllowedSender(messageSender(msg)) {
+					h.lg.Info("Skip audio from not allowed sender", zap.Int("msg_id", msg.ID))
+					return nil
+				}
+
+				if maintenance.Load() {
+					return sendMessage(ctx, h.api, peer, maintenanceReply, msg.ID)
+				}
+
+				if skip, err := h.alreadyProcessed(peer, msg, edited); skip || err != nil {
+					return err
+				}
+
+				if user, ok := messageSender(msg).(*tg.PeerUser); ok && quota != nil && !quota.Allow(user.UserID) {
+					h.lg.Info("Skip audio over user quota", zap.Int64("user_id", user.UserID), zap.Int("msg_id", msg.ID))
+					return sendMessage(ctx, h.api, peer, quotaExceededReply, msg.ID)
+				}
+
+				// Версия нужна, чтобы отличить будущую правку от апдейта без изменений
+				if !edited {
+					if _, err := h.newVersion(peer, msg); err != nil {
+						return err
+					}
+				}
+
+				if groupID, ok := msg.GetGroupedID(); ok && h.albums != nil {
+					h.albums.Add(groupID, peer, msg.ID, doc)
+					return nil
+				}
+				if err := enqueueAudio(h.lg, h.api, peer, msg.ID, doc, time.Time{}, h.files, h.queue, h.processed); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Обработка ответов на голосовые сообщения. Сообщение, на которое ответили,
+	// запрашивается с повторами, поэтому это делается в очереди, а не здесь,
+	// чтобы не задерживать обработку остальных апдейтов
+	if reply, ok := msg.ReplyTo.(*tg.MessageReplyHeader); ok && msg.Message != "" {
+		if !isAllowedSender(messageSender(msg)) {
+			h.lg.Info("Skip caption from not allowed sender", zap.Int("msg_id", msg.ID))
+			return nil
+		}
+		// Ответ мог быть адресован не боту, поэтому в чат о режиме
+		// обслуживания не пишем
+		if maintenance.Load() {
+			h.lg.Info("Skip caption during maintenance", zap.Int("msg_id", msg.ID))
+			return nil
+		}
+		if skip, err := h.alreadyProcessed(peer, msg, edited); skip || err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("caption %d", msg.ID)
+		if err := h.queue.Enqueue(name, func(ctx context.Context) error {
+			return h.captionVoice(ctx, peer, msg, reply.ReplyToMsgID, edited)
+		}); err != nil {
+			return errors.Wrap(err, "enqueue caption")
+		}
+	}
+	return nil
+}
+
+// captionVoice отправляет заново голосовое replyToMsgID с подписью из текста
+// ответа msg и отмечает ответ обработанным. Ответы на другие сообщения
+// пропускаются.
+func (h *messageHandler) captionVoice(ctx context.Context, peer tg.InputPeerClass, msg *tg.Message, replyToMsgID int, edited bool) error {
+	repliedMsg, err := getMessage(ctx, h.api, peer, replyToMsgID)
+	if err != nil {
+		return errors.Wrap(err, "get replied message")
+	}
+	repliedMedia, ok := repliedMsg.Media.(*tg.MessageMediaDocument)
+	if !ok {
+		return nil
+	}
+	repliedDoc, ok := repliedMedia.Document.(*tg.Document)
+	if !ok || !isVoiceMessage(repliedDoc) {
+		return nil
+	}
+	if !edited {
+		if _, err := h.newVersion(peer, msg); err != nil {
+			return err
+		}
+	}
+	voice := voiceOptions{
+		Caption:  msg.Message,
+		Entities: msg.Entities,
+		RandomID: nextSendRandomID(inputPeerID(peer), msg.ID, repliedDoc.ID),
+	}
+	if err := sendVoiceByReference(ctx, h.api, resultPeer(peer), repliedDoc, voice); err != nil {
+		return errors.Wrap(err, "send voice with caption")
+	}
+	return h.processed.Mark(inputPeerID(peer), msg.ID)
+}
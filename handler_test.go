@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHandlerLogsErrors(t *testing.T) {
+	const chatID = 100
+	setVar(t, &workChat, chatID)
+
+	tests := []struct {
+		name    string
+		peer    tg.PeerClass
+		wantLog bool
+	}{
+		// Канал не найден ни в апдейте, ни в хранилище, ни в Telegram
+		{name: "unresolved work chat", peer: &tg.PeerChannel{ChannelID: chatID}, wantLog: true},
+		{name: "other chat is ignored", peer: &tg.PeerChannel{ChannelID: chatID + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			h := &messageHandler{lg: zap.New(core), api: &stubAPI{}, peers: testPeerStorage(t)}
+			dispatcher := tg.NewUpdateDispatcher()
+			h.Register(dispatcher, false, false)
+
+			update := &tg.Updates{Updates: []tg.UpdateClass{
+				&tg.UpdateNewChannelMessage{Message: &tg.Message{ID: 1, PeerID: tt.peer, Message: "hello"}},
+			}}
+			// Ошибка обработки не должна останавливать получение апдейтов
+			if err := dispatcher.Handle(context.Background(), update); err != nil {
+				t.Fatalf("dispatcher returned %v", err)
+			}
+			if got := logs.FilterMessage("Handle message").Len() > 0; got != tt.wantLog {
+				t.Errorf("error logged = %t, want %t", got, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestCaptionVoice(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	voice := &tg.Document{ID: 7, AccessHash: 8, Attributes: []tg.DocumentAttributeClass{
+		&tg.DocumentAttributeAudio{Voice: true, Duration: 3, Waveform: []byte{1}},
+	}}
+	bold := []tg.MessageEntityClass{&tg.MessageEntityBold{Offset: 0, Length: 4}}
+
+	tests := []struct {
+		name     string
+		replied  *tg.Message
+		wantSent bool
+	}{
+		{name: "voice is resent with caption", replied: documentMessageOf(5, voice), wantSent: true},
+		{name: "reply to music", replied: documentMessageOf(5, testDocument("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{}))},
+		{name: "reply to text", replied: &tg.Message{ID: 5, Message: "hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processed, err := newProcessedStore(testBolt(t), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &stubAPI{messages: map[int]*tg.Message{5: tt.replied}}
+			h := &messageHandler{lg: zap.NewNop(), api: api, processed: processed}
+			msg := &tg.Message{ID: 6, Message: "Note about the call", Entities: bold}
+
+			if err := h.captionVoice(context.Background(), peer, msg, 5, false); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantSent {
+				if len(api.sentMedia) != 0 {
+					t.Errorf("sent %d media, want none", len(api.sentMedia))
+				}
+				return
+			}
+			if len(api.sentMedia) != 1 {
+				t.Fatalf("sent %d media, want 1", len(api.sentMedia))
+			}
+			req := api.sentMedia[0]
+			media, ok := req.Media.(*tg.InputMediaDocument)
+			if !ok {
+				t.Fatalf("media %T is not sent by reference", req.Media)
+			}
+			if id, ok := media.ID.(*tg.InputDocument); !ok || id.ID != voice.ID || id.AccessHash != voice.AccessHash {
+				t.Errorf("document %v, want %d", media.ID, voice.ID)
+			}
+			if req.Message != msg.Message || len(req.Entities) != 1 {
+				t.Errorf("caption %q with %d entities", req.Message, len(req.Entities))
+			}
+		})
+	}
+}
+
+func TestHandlerConvertsChannelAudio(t *testing.T) {
+	setFakeConverter(t)
+	hh := newHandlerHarness(t, &stubAPI{})
+
+	hh.post(t, hh.audioMessage(10, "audio/mpeg", "song.mp3"))
+
+	audio := hh.checkVoiceSent(t, 10)
+	if audio.Duration != 3 || len(audio.Waveform) == 0 {
+		t.Errorf("audio attribute = %+v", audio)
+	}
+	if seen, err := hh.h.processed.Seen(hh.channel.ID, 10); err != nil || !seen {
+		t.Errorf("message is not marked processed: %t, %v", seen, err)
+	}
+}
+
+// TestHandlerEndToEnd проводит сообщение с WAV через обработчик и настоящий
+// ffmpeg. Без ffmpeg в PATH тест пропускается.
+func TestHandlerEndToEnd(t *testing.T) {
+	requireFFmpeg(t)
+	sample := generateMedia(t, "tone.wav", "-f", "lavfi", "-i", "sine=frequency=440:duration=2", "-c:a", "pcm_s16le")
+	content, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := testDocument("audio/wav", "tone.wav", &tg.DocumentAttributeAudio{Duration: 2})
+	doc.Size = int64(len(content))
+	hh := newHandlerHarness(t, &stubAPI{files: map[int64][]byte{doc.ID: content}})
+
+	hh.post(t, documentMessageOf(10, doc))
+
+	audio := hh.checkVoiceSent(t, 10)
+	if audio.Duration != 2 || len(audio.Waveform) == 0 {
+		t.Errorf("audio attribute = %+v", audio)
+	}
+}
+
+// TestHandlerReportsUnreadableAudio проверяет, что файл, который ffprobe не
+// смог прочитать, не передаётся ffmpeg, а в чат приходит понятная причина.
+func TestHandlerReportsUnreadableAudio(t *testing.T) {
+	setFFprobe(t, `echo 'Invalid data found when processing input' >&2; exit 1`)
+	marker := filepath.Join(t.TempDir(), "ffmpeg-called")
+	setFFmpeg(t, "touch "+marker)
+	hh := newHandlerHarness(t, &stubAPI{})
+
+	hh.post(t, hh.audioMessage(10, "audio/mpeg", "broken.mp3"))
+
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("ffmpeg was run for unreadable input")
+	}
+	if len(hh.api.sentMedia) != 0 {
+		t.Errorf("sent %d media, want none", len(hh.api.sentMedia))
+	}
+	if len(hh.api.sentMessages) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(hh.api.sentMessages))
+	}
+	if text := hh.api.sentMessages[0].Message; !strings.Contains(text, failureReason(errUnreadableAudio)) {
+		t.Errorf("failure message %q does not explain the reason", text)
+	}
+}
+
+func TestHandlerEdit(t *testing.T) {
+	tests := []struct {
+		name     string
+		onEdit   bool
+		edit     func(msg *tg.Message)
+		prepare  func(t *testing.T, hh *handlerHarness, msg *tg.Message) // состояние до правки
+		wantSent bool
+	}{
+		{name: "caption edit is reprocessed", onEdit: true, edit: func(msg *tg.Message) { msg.Message = "new caption" }, wantSent: true},
+		{name: "ON_EDIT disabled", edit: func(msg *tg.Message) { msg.Message = "new caption" }},
+		// Апдейт после реакции приходит без даты редактирования
+		{name: "update without edit date", onEdit: true, edit: func(msg *tg.Message) { msg.EditDate = 0 }},
+		{name: "own message", onEdit: true, edit: func(msg *tg.Message) { msg.Out = true }},
+		{
+			name:   "edit without changes",
+			onEdit: true,
+			prepare: func(t *testing.T, hh *handlerHarness, msg *tg.Message) {
+				if _, err := hh.h.processed.UpdateVersion(hh.channel.ID, msg.ID, messageVersionOf(msg)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFakeConverter(t)
+			hh := newHandlerHarness(t, &stubAPI{})
+			hh.h.Register(hh.dispatcher, false, tt.onEdit)
+
+			msg := hh.audioMessage(10, "audio/mpeg", "song.mp3")
+			msg.EditDate = 1700000000
+			// Исходное сообщение уже сконвертировано
+			if err := hh.h.processed.Mark(hh.channel.ID, msg.ID); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, hh, msg)
+			}
+			if tt.edit != nil {
+				tt.edit(msg)
+			}
+
+			hh.edit(t, msg)
+
+			if !tt.wantSent {
+				if len(hh.api.sentMedia) != 0 {
+					t.Errorf("sent %d media, want none", len(hh.api.sentMedia))
+				}
+				return
+			}
+			hh.checkVoiceSent(t, msg.ID)
+		})
+	}
+}
+
+func TestHandlerDestChat(t *testing.T) {
+	dest := &tg.InputPeerChannel{ChannelID: 200, AccessHash: 9}
+
+	tests := []struct {
+		name string
+		dest *tg.InputPeerChannel
+	}{
+		{name: "source chat"},
+		{name: "destination chat", dest: dest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destPeer.Store(tt.dest)
+			t.Cleanup(func() { destPeer.Store(nil) })
+			setFakeConverter(t)
+			hh := newHandlerHarness(t, &stubAPI{})
+
+			hh.post(t, hh.audioMessage(10, "audio/mpeg", "song.mp3"))
+
+			if tt.dest == nil {
+				hh.checkVoiceSent(t, 10)
+				return
+			}
+			if len(hh.api.sentMedia) != 1 {
+				t.Fatalf("sent %d media, want 1", len(hh.api.sentMedia))
+			}
+			req := hh.api.sentMedia[0]
+			if peer, ok := req.Peer.(*tg.InputPeerChannel); !ok || *peer != *tt.dest {
+				t.Errorf("sent to %v, want %v", req.Peer, tt.dest)
+			}
+			// В другом канале ответить на исходное сообщение нельзя
+			if req.ReplyTo != nil {
+				t.Errorf("ReplyTo = %v, want none", req.ReplyTo)
+			}
+		})
+	}
+}
+
+func TestHandlerCaption(t *testing.T) {
+	const admin = 10
+	voice := documentMessageOf(5, &tg.Document{ID: 7, AccessHash: 8, Attributes: []tg.DocumentAttributeClass{
+		&tg.DocumentAttributeAudio{Voice: true, Duration: 3, Waveform: []byte{1}},
+	}})
+
+	tests := []struct {
+		name        string
+		from        int64
+		maintenance bool
+		processed   bool // ответ уже обработан до апдейта
+		replay      bool // апдейт приходит повторно
+		wantSent    int
+	}{
+		{name: "allowed sender", from: admin, wantSent: 1},
+		{name: "not allowed sender", from: admin + 1},
+		{name: "maintenance", from: admin, maintenance: true},
+		{name: "already processed", from: admin, processed: true},
+		{name: "replayed update", from: admin, replay: true, wantSent: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &allowedUsers, map[int64]struct{}{admin: {}})
+			resetMaintenance(t)
+			maintenance.Store(tt.maintenance)
+			hh := newHandlerHarness(t, &stubAPI{messages: map[int]*tg.Message{5: voice}})
+			reply := func() *tg.Message {
+				return &tg.Message{
+					ID:      6,
+					FromID:  &tg.PeerUser{UserID: tt.from},
+					ReplyTo: &tg.MessageReplyHeader{ReplyToMsgID: 5},
+					Message: "Note about the call",
+				}
+			}
+			if tt.processed {
+				if err := hh.h.processed.Mark(hh.channel.ID, 6); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.replay {
+				msg := reply()
+				hh.deliver(t, &tg.UpdateNewChannelMessage{Message: msg}, msg)
+				// Повтор приходит после того, как первый апдейт обработан
+				for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+					if seen, err := hh.h.processed.Seen(hh.channel.ID, 6); err != nil || seen {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("first update was not processed")
+					}
+				}
+			}
+			hh.post(t, reply())
+
+			if got := len(hh.api.sentMedia); got != tt.wantSent {
+				t.Errorf("sent %d media, want %d", got, tt.wantSent)
+			}
+			if len(hh.api.sentMessages) != 0 {
+				t.Errorf("replies = %v, want none", hh.api.sentMessages)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// healthState отражает состояние клиента для проверок оркестратора.
+type healthState struct {
+	authorized atomic.Bool
+	ready      atomic.Bool
+}
+
+// SetAuthorized отмечает, что клиент подключён и авторизован.
+func (h *healthState) SetAuthorized(authorized bool) {
+	h.authorized.Store(authorized)
+}
+
+func (h *healthState) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// Register добавляет /healthz и /readyz. /healthz отвечает 200, когда клиент
+// авторизован и работает, /readyz — когда он к тому же слушает апдейты.
+func (h *healthState) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.authorized.Load() {
+			http.Error(w, "not authorized", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.ready.Load() {
+			http.Error(w, "connecting", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ready"))
+	})
+}
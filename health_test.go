@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthState(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		authorized bool
+		ready      bool
+		want       int
+	}{
+		{name: "not alive while connecting", path: "/healthz", want: http.StatusServiceUnavailable},
+		{name: "alive once authorized", path: "/healthz", authorized: true, want: http.StatusOK},
+		{name: "alive when ready", path: "/healthz", authorized: true, ready: true, want: http.StatusOK},
+		{name: "not ready while connecting", path: "/readyz", want: http.StatusServiceUnavailable},
+		{name: "not ready before listening for updates", path: "/readyz", authorized: true, want: http.StatusServiceUnavailable},
+		{name: "ready", path: "/readyz", authorized: true, ready: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &healthState{}
+			h.SetAuthorized(tt.authorized)
+			h.SetReady(tt.ready)
+			mux := http.NewServeMux()
+			h.Register(mux)
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	pebbledb "github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/gotd/contrib/pebble"
+	"github.com/gotd/contrib/storage"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// fakeBinary создаёт исполняемый shell-скрипт с телом script и возвращает путь
+// к нему. Скрипт подменяет ffmpeg и ffprobe, которых может не быть на машине.
+func fakeBinary(t *testing.T, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setFFprobe подменяет ffprobe скриптом до конца теста.
+func setFFprobe(t *testing.T, script string) {
+	t.Helper()
+	old := ffprobeBin
+	ffprobeBin = fakeBinary(t, "ffprobe", script)
+	t.Cleanup(func() { ffprobeBin = old })
+}
+
+// Скрипты, которые изображают ffmpeg и ffprobe для входа в любом формате.
+// ffmpeg записывает в последний аргумент OGG из одной пустой страницы
+// с флагом конца потока, а при выводе в "-" отдаёт несколько сэмплов PCM.
+// ffprobe сообщает об одной дорожке Opus длительностью 3.4 секунды
+const (
+	fakeFFmpegScript = `for last; do :; done
+if [ "$last" = "-" ]; then printf '\001\020\002\040'; exit 0; fi
+printf 'OggS\000\004\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000' > "$last"`
+	fakeFFprobeScript = `case "$*" in
+*codec_name*) echo '{"streams":[{"codec_name":"opus","channels":1,"sample_rate":"48000"}]}' ;;
+*) echo 3.4 ;;
+esac`
+)
+
+// setFakeConverter подменяет ffmpeg и ffprobe скриптами, с которыми
+// конвертация и проверка результата проходят успешно.
+func setFakeConverter(t *testing.T) {
+	t.Helper()
+	setFFmpeg(t, fakeFFmpegScript)
+	setFFprobe(t, fakeFFprobeScript)
+}
+
+// setFFmpeg подменяет ffmpeg скриптом до конца теста.
+func setFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	old := ffmpegBin
+	ffmpegBin = fakeBinary(t, "ffmpeg", script)
+	t.Cleanup(func() { ffmpegBin = old })
+}
+
+// requireFFmpeg пропускает тест, если настоящих ffmpeg и ffprobe нет в PATH,
+// и выбирает доступный кодировщик Opus.
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s is not installed", bin)
+		}
+	}
+	setVar(t, &ffmpegBin, "ffmpeg")
+	setVar(t, &ffprobeBin, "ffprobe")
+	setVar(t, &audioCodecs, maps.Clone(audioCodecs))
+	if _, err := selectOpusEncoder(context.Background()); err != nil {
+		t.Skip(err)
+	}
+}
+
+// generateMedia создаёт файл name синтетическим сигналом через ffmpeg lavfi
+// и возвращает путь к нему.
+func generateMedia(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	cmd := exec.Command("ffmpeg", append(append([]string{"-hide_banner", "-loglevel", "error", "-y"}, args...), path)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generate %s: %v\n%s", name, err, out)
+	}
+	return path
+}
+
+// testPebble открывает базу pebble в памяти.
+func testPebble(t *testing.T) *pebbledb.DB {
+	t.Helper()
+	db, err := pebbledb.Open("db", &pebbledb.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// testPeerStorage возвращает хранилище пиров в памяти.
+func testPeerStorage(t *testing.T) storage.PeerStorage {
+	t.Helper()
+	return pebble.NewPeerStorage(testPebble(t))
+}
+
+// setOggCache подменяет кеш хешей содержимого пустым до конца теста.
+func setOggCache(t *testing.T) {
+	t.Helper()
+	old := oggCache
+	oggCache = &contentCache{db: testPebble(t)}
+	t.Cleanup(func() { oggCache = old })
+}
+
+// testAudioContent — содержимое аудиофайлов в тестах с поддельным ffmpeg.
+var testAudioContent = []byte("ID3 audio content")
+
+// testAudio возвращает документ с содержимым testAudioContent и размером,
+// как у загруженного в Telegram файла, и само содержимое.
+func testAudio(mime, name string, attrs ...tg.DocumentAttributeClass) (*tg.Document, []byte) {
+	doc := testDocument(mime, name, attrs...)
+	doc.Size = int64(len(testAudioContent))
+	return doc, testAudioContent
+}
+
+// stubAPI — заглушка telegramAPI. Методы без реализации паникуют через
+// nil-интерфейс, поэтому тест сразу показывает неожиданный запрос.
+type stubAPI struct {
+	telegramAPI
+
+	mu       sync.Mutex
+	channels []tg.ChatClass // ответ ChannelsGetChannels
+	// files — содержимое документов по ID. Если fileRef не пуст, документ
+	// с другим file reference получает FILE_REFERENCE_EXPIRED
+	files    map[int64][]byte
+	fileRef  []byte
+	thumbs   map[string][]byte   // обложки по типу размера
+	messages map[int]*tg.Message // сообщения по ID
+	// hidden — сколько первых запросов сообщений получат пустой ответ, как
+	// при задержке репликации сразу после ответа на сообщение
+	hidden int
+	calls  []string // имена вызванных методов
+
+	channelGets  []*tg.ChannelsGetMessagesRequest
+	uploaded     map[int64][]byte // загруженные файлы по ID
+	sentMessages []*tg.MessagesSendMessageRequest
+	sentMedia    []*tg.MessagesSendMediaRequest
+	deleted      []int    // ID удалённых сообщений
+	deleteErr    error    // ответ на удаление, например нехватка прав
+	reactions    []string // отправленные реакции, пустая строка снимает реакцию
+}
+
+// called записывает вызов метода, вызывается под s.mu.
+func (s *stubAPI) called(method string) {
+	s.calls = append(s.calls, method)
+}
+
+// count возвращает, сколько раз вызывался метод.
+func (s *stubAPI) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.calls {
+		if c == method {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *stubAPI) ChannelsGetChannels(_ context.Context, _ []tg.InputChannelClass) (tg.MessagesChatsClass, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("ChannelsGetChannels")
+	return &tg.MessagesChats{Chats: s.channels}, nil
+}
+
+func (s *stubAPI) UploadGetFile(_ context.Context, req *tg.UploadGetFileRequest) (tg.UploadFileClass, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("UploadGetFile")
+	loc, ok := req.Location.(*tg.InputDocumentFileLocation)
+	if !ok {
+		return nil, tgerr.New(400, "LOCATION_INVALID")
+	}
+	if len(s.fileRef) > 0 && !bytes.Equal(loc.FileReference, s.fileRef) {
+		return nil, tgerr.New(400, "FILE_REFERENCE_EXPIRED")
+	}
+	data, ok := s.files[loc.ID]
+	if loc.ThumbSize != "" {
+		data, ok = s.thumbs[loc.ThumbSize]
+	}
+	if !ok {
+		return nil, tgerr.New(400, "FILE_ID_INVALID")
+	}
+	start := min(req.Offset, int64(len(data)))
+	end := min(start+int64(req.Limit), int64(len(data)))
+	return &tg.UploadFile{Type: &tg.StorageFileUnknown{}, Bytes: data[start:end]}, nil
+}
+
+func (s *stubAPI) getMessages(method string, ids []tg.InputMessageClass) tg.MessagesMessagesClass {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called(method)
+	var found []tg.MessageClass
+	if s.hidden > 0 {
+		s.hidden--
+		return &tg.MessagesMessages{Messages: found}
+	}
+	for _, id := range ids {
+		if msg, ok := s.messages[id.(*tg.InputMessageID).ID]; ok {
+			found = append(found, msg)
+		}
+	}
+	return &tg.MessagesMessages{Messages: found}
+}
+
+func (s *stubAPI) MessagesGetMessages(_ context.Context, ids []tg.InputMessageClass) (tg.MessagesMessagesClass, error) {
+	return s.getMessages("MessagesGetMessages", ids), nil
+}
+
+func (s *stubAPI) ChannelsGetMessages(_ context.Context, req *tg.ChannelsGetMessagesRequest) (tg.MessagesMessagesClass, error) {
+	s.mu.Lock()
+	s.channelGets = append(s.channelGets, req)
+	s.mu.Unlock()
+	return s.getMessages("ChannelsGetMessages", req.ID), nil
+}
+
+func (s *stubAPI) MessagesSendMessage(_ context.Context, req *tg.MessagesSendMessageRequest) (tg.UpdatesClass, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("MessagesSendMessage")
+	s.sentMessages = append(s.sentMessages, req)
+	return &tg.Updates{}, nil
+}
+
+func (s *stubAPI) MessagesSendMedia(_ context.Context, req *tg.MessagesSendMediaRequest) (tg.UpdatesClass, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("MessagesSendMedia")
+	s.sentMedia = append(s.sentMedia, req)
+	return &tg.Updates{}, nil
+}
+
+// freeAddr возвращает свободный адрес на localhost.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// setVar присваивает глобальной настройке значение v до конца теста.
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// testBolt открывает базу bbolt во временном каталоге.
+func testBolt(t *testing.T) *bbolt.DB {
+	t.Helper()
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.bolt.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func (s *stubAPI) saveFilePart(fileID int64, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("UploadSaveFilePart")
+	if s.uploaded == nil {
+		s.uploaded = map[int64][]byte{}
+	}
+	s.uploaded[fileID] = append(s.uploaded[fileID], data...)
+}
+
+func (s *stubAPI) UploadSaveFilePart(_ context.Context, req *tg.UploadSaveFilePartRequest) (bool, error) {
+	s.saveFilePart(req.FileID, req.Bytes)
+	return true, nil
+}
+
+func (s *stubAPI) UploadSaveBigFilePart(_ context.Context, req *tg.UploadSaveBigFilePartRequest) (bool, error) {
+	s.saveFilePart(req.FileID, req.Bytes)
+	return true, nil
+}
+
+func (s *stubAPI) ChannelsDeleteMessages(_ context.Context, req *tg.ChannelsDeleteMessagesRequest) (*tg.MessagesAffectedMessages, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("ChannelsDeleteMessages")
+	if s.deleteErr != nil {
+		return nil, s.deleteErr
+	}
+	s.deleted = append(s.deleted, req.ID...)
+	return &tg.MessagesAffectedMessages{}, nil
+}
+
+func (s *stubAPI) MessagesDeleteMessages(_ context.Context, req *tg.MessagesDeleteMessagesRequest) (*tg.MessagesAffectedMessages, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("MessagesDeleteMessages")
+	if s.deleteErr != nil {
+		return nil, s.deleteErr
+	}
+	s.deleted = append(s.deleted, req.ID...)
+	return &tg.MessagesAffectedMessages{}, nil
+}
+
+func (s *stubAPI) MessagesSendReaction(_ context.Context, req *tg.MessagesSendReactionRequest) (tg.UpdatesClass, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.called("MessagesSendReaction")
+	var emoji string
+	for _, r := range req.Reaction {
+		if e, ok := r.(*tg.ReactionEmoji); ok {
+			emoji = e.Emoticon
+		}
+	}
+	s.reactions = append(s.reactions, emoji)
+	return &tg.Updates{}, nil
+}
+
+// handlerHarness собирает messageHandler с заглушкой telegramAPI, базами во
+// временной директории и очередью из одного воркера. Апдейты проходят через
+// настоящий tg.UpdateDispatcher, как при работе бота.
+type handlerHarness struct {
+	h          *messageHandler
+	api        *stubAPI
+	dispatcher tg.UpdateDispatcher
+	channel    *tg.Channel
+}
+
+func newHandlerHarness(t *testing.T, api *stubAPI) *handlerHarness {
+	t.Helper()
+	const channelID = 100
+	setVar(t, &workChat, channelID)
+	setVar(t, &replyToSource, true)
+	setOggCache(t)
+
+	processed, err := newProcessedStore(testBolt(t), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := newSettingsStore(testBolt(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	h := &messageHandler{
+		lg:        zap.NewNop(),
+		api:       api,
+		peers:     testPeerStorage(t),
+		files:     fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")},
+		queue:     newJobQueue(1, zap.NewNop()),
+		processed: processed,
+		settings:  settings,
+	}
+	t.Cleanup(func() { _ = h.queue.Shutdown(time.Second) })
+	dispatcher := tg.NewUpdateDispatcher()
+	h.Register(dispatcher, false, false)
+
+	channel := &tg.Channel{ID: channelID, Photo: &tg.ChatPhotoEmpty{}}
+	channel.SetAccessHash(7)
+	return &handlerHarness{h: h, api: api, dispatcher: dispatcher, channel: channel}
+}
+
+// post доставляет сообщение канала апдейтом UpdateNewChannelMessage и ждёт,
+// пока очередь выполнит поставленные задачи.
+func (hh *handlerHarness) post(t *testing.T, msg *tg.Message) {
+	t.Helper()
+	hh.deliver(t, &tg.UpdateNewChannelMessage{Message: msg}, msg)
+	hh.drain(t)
+}
+
+// edit доставляет отредактированное сообщение канала апдейтом
+// UpdateEditChannelMessage и ждёт, пока очередь выполнит задачи.
+func (hh *handlerHarness) edit(t *testing.T, msg *tg.Message) {
+	t.Helper()
+	hh.deliver(t, &tg.UpdateEditChannelMessage{Message: msg}, msg)
+	hh.drain(t)
+}
+
+// deliver передаёт апдейт диспетчеру, не дожидаясь задач очереди.
+func (hh *handlerHarness) deliver(t *testing.T, u tg.UpdateClass, msg *tg.Message) {
+	t.Helper()
+	msg.PeerID = &tg.PeerChannel{ChannelID: hh.channel.ID}
+	update := &tg.Updates{
+		Updates: []tg.UpdateClass{u},
+		Chats:   []tg.ChatClass{hh.channel},
+	}
+	if err := hh.dispatcher.Handle(context.Background(), update); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drain останавливает очередь, дождавшись поставленных задач.
+func (hh *handlerHarness) drain(t *testing.T) {
+	t.Helper()
+	if err := hh.h.queue.Shutdown(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkVoiceSent проверяет, что в канал загружено и отправлено одно голосовое.
+func (hh *handlerHarness) checkVoiceSent(t *testing.T, replyTo int) *tg.DocumentAttributeAudio {
+	t.Helper()
+	if len(hh.api.sentMedia) != 1 {
+		t.Fatalf("sent %d media, want 1; calls %q", len(hh.api.sentMedia), hh.api.calls)
+	}
+	req := hh.api.sentMedia[0]
+	if peer, ok := req.Peer.(*tg.InputPeerChannel); !ok || peer.ChannelID != hh.channel.ID || peer.AccessHash != hh.channel.AccessHash {
+		t.Errorf("sent to %v", req.Peer)
+	}
+	if reply, ok := req.ReplyTo.(*tg.InputReplyToMessage); !ok || reply.ReplyToMsgID != replyTo {
+		t.Errorf("ReplyTo = %v, want message %d", req.ReplyTo, replyTo)
+	}
+	media, ok := req.Media.(*tg.InputMediaUploadedDocument)
+	if !ok {
+		t.Fatalf("media is %T", req.Media)
+	}
+	file, ok := media.File.(*tg.InputFile)
+	if !ok {
+		t.Fatalf("file is %T", media.File)
+	}
+	if data := hh.api.uploaded[file.ID]; !bytes.HasPrefix(data, []byte("OggS")) {
+		t.Errorf("uploaded file is not OGG: %q", data[:min(len(data), 16)])
+	}
+	for _, attr := range media.Attributes {
+		if audio, ok := attr.(*tg.DocumentAttributeAudio); ok && audio.Voice {
+			return audio
+		}
+	}
+	t.Fatalf("no voice attribute in %v", media.Attributes)
+	return nil
+}
+
+// audioMessage возвращает сообщение id с MP3-документом длительностью
+// 3 секунды и отдаёт его содержимое через заглушку API. Документ получает ID
+// сообщения, поэтому в одном тесте можно отправить несколько файлов.
+func (hh *handlerHarness) audioMessage(id int, mime, name string) *tg.Message {
+	doc, content := testAudio(mime, name, &tg.DocumentAttributeAudio{Duration: 3})
+	doc.ID = int64(id)
+	hh.api.mu.Lock()
+	defer hh.api.mu.Unlock()
+	if hh.api.files == nil {
+		hh.api.files = map[int64][]byte{}
+	}
+	hh.api.files[doc.ID] = content
+	return documentMessageOf(id, doc)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	lj "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Форматы логов
+const (
+	logFormatJSON    = "json"
+	logFormatConsole = "console"
+)
+
+// LogOptions задаёт уровень, формат и вывод логов.
+type LogOptions struct {
+	Level    zapcore.Level
+	Format   string // logFormatJSON или logFormatConsole
+	ToStderr bool   // писать в stderr вместо файла
+}
+
+// newLogger создаёт логгер. По умолчанию логи пишутся в файл logFilePath
+// с ротацией, а с ToStderr — в stderr.
+func newLogger(opts LogOptions, logFilePath string) *zap.Logger {
+	var writer zapcore.WriteSyncer
+	if opts.ToStderr {
+		writer = zapcore.Lock(os.Stderr)
+	} else {
+		writer = zapcore.AddSync(&lj.Logger{
+			Filename:   logFilePath,
+			MaxBackups: 3,
+			MaxSize:    1,
+			MaxAge:     7,
+		})
+	}
+
+	var encoder zapcore.Encoder
+	if opts.Format == logFormatConsole {
+		encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	} else {
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	}
+	return zap.New(zapcore.NewCore(encoder, writer, opts.Level))
+}
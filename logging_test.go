@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name string
+		opts LogOptions
+		want string // подстрока записи "hello"; пустая — запись отброшена
+	}{
+		{name: "json", opts: LogOptions{Level: zapcore.DebugLevel, Format: logFormatJSON}, want: `"msg":"hello"`},
+		{name: "console", opts: LogOptions{Level: zapcore.DebugLevel, Format: logFormatConsole}, want: "INFO\thello"},
+		{name: "below level", opts: LogOptions{Level: zapcore.WarnLevel, Format: logFormatJSON}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.json")
+			lg := newLogger(tt.opts, path)
+			lg.Info("hello")
+			_ = lg.Sync()
+
+			data, err := os.ReadFile(path)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if len(data) != 0 {
+					t.Errorf("log = %q, want empty", data)
+				}
+				return
+			}
+			if !strings.Contains(string(data), tt.want) {
+				t.Errorf("log = %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
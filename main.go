@@ -1,19 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"github.com/gotd/td/telegram/auth/qrlogin"
-	"github.com/gotd/td/tgerr"
-	"golang.org/x/term"
+	"io"
 	"math/rand"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	pebbledb "github.com/cockroachdb/pebble"
@@ -24,169 +24,675 @@ import (
 	"github.com/gotd/contrib/pebble"
 	"github.com/gotd/contrib/storage"
 	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/dcs"
 	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/telegram/query"
 	"github.com/gotd/td/telegram/updates"
 	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
-	"github.com/jedib0t/go-pretty/v6/text"
-	"github.com/joho/godotenv"
-	"github.com/skip2/go-qrcode"
+	"github.com/gotd/td/tgerr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.etcd.io/bbolt"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 	"golang.org/x/time/rate"
-	lj "gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Расширения исходных файлов, которые конвертируются в голосовые сообщения
+var convertibleExtensions = map[string]bool{
+	".mp3":  true,
+	".wav":  true,
+	".flac": true,
+	".m4a":  true,
+	".aac":  true,
+	".opus": true,
+	// Формат не определён, но ffmpeg распознает его по содержимому файла
+	unknownAudioExtension: true,
+	// Из видео извлекается звуковая дорожка
+	videoExtension: true,
+}
+
+const (
+	unknownAudioExtension = ".audio"
+	videoExtension        = ".video"
+)
+
+// Соответствие MIME-типов документов расширениям исходных файлов
+var mimeExtensions = map[string]string{
+	"audio/mpeg":   ".mp3",
+	"audio/mp3":    ".mp3",
+	"audio/wav":    ".wav",
+	"audio/x-wav":  ".wav",
+	"audio/wave":   ".wav",
+	"audio/flac":   ".flac",
+	"audio/x-flac": ".flac",
+	"audio/mp4":    ".m4a",
+	"audio/x-m4a":  ".m4a",
+	"audio/m4a":    ".m4a",
+	"audio/aac":    ".aac",
+	"audio/ogg":    ".ogg",
+	"audio/opus":   ".opus",
+}
+
+// fileOptions задаёт каталоги для скачанных и сконвертированных файлов
+// и то, нужно ли хранить их после отправки
+type fileOptions struct {
+	DownloadDir string
+	OggDir      string
+	KeepFiles   bool
+	// Раскладывать файлы по подкаталогам с датой, например downloads/2024-06-01.
+	// Кеш OGG по хешу содержимого лежит прямо в OggDir
+	DatePartition bool
+}
+
+// dirs возвращает каталоги для файлов, обрабатываемых в момент now.
+func (f fileOptions) dirs(now time.Time) (downloadDir, oggDir string) {
+	if !f.DatePartition {
+		return f.DownloadDir, f.OggDir
+	}
+	date := now.Format(time.DateOnly)
+	return filepath.Join(f.DownloadDir, date), filepath.Join(f.OggDir, date)
+}
+
 var (
 	workChat int64
+	// Канал, куда отправляются голосовые вместо чата источника, если задан DEST_CHAT.
+	// Разрешается после подключения и читается воркерами очереди
+	destPeer    atomic.Pointer[tg.InputPeerChannel]
+	opusOptions OpusOptions
+	// Отправлять голосовое ответом на исходное сообщение
+	replyToSource bool
+	// Подписывать голосовое исполнителем и названием трека
+	captionFromMetadata bool
+	// Скачивать и конвертировать, но не отправлять результат в чат
+	dryRun bool
+	// Отправлять результат голосовым сообщением или обычным аудио
+	sendAs string
+	// Пользователи, чьи аудио конвертируются; пустой набор разрешает всех
+	allowedUsers map[int64]struct{}
+	// Обрабатывать аудио из личных сообщений
+	allowDM bool
+	// Удалять исходное сообщение с аудио после успешной отправки
+	deleteSource bool
+	// Максимальный размер скачиваемого файла, 0 — без ограничения
+	maxFileBytes int64
+	// Допустимая длительность исходника, 0 — без ограничения
+	minDuration, maxDuration time.Duration
+	// Извлекать звук из видео и отправлять его голосовым
+	extractVideoAudio bool
+	// Права создаваемых каталогов и файлов, задаются через DIR_MODE и FILE_MODE
+	dirMode  os.FileMode = 0700
+	fileMode             = defaultFileMode
 )
 
+// isAllowedSender проверяет отправителя сообщения по ALLOWED_USERS.
+func isAllowedSender(from tg.PeerClass) bool {
+	if len(allowedUsers) == 0 {
+		return true
+	}
+	user, ok := from.(*tg.PeerUser)
+	if !ok {
+		return false
+	}
+	_, ok = allowedUsers[user.UserID]
+	return ok
+}
+
+// voiceOptions задаёт необязательные параметры отправляемого голосового сообщения
+type voiceOptions struct {
+	ReplyTo int // ID сообщения, ответом на которое отправляется голосовое
+	Caption string
+	// Время отложенной отправки в unix-секундах, 0 — отправить сразу
+	ScheduleDate int
+	// RandomID запроса, одинаковый для всех повторов; 0 — случайный
+	RandomID int64
+	// Форматирование подписи
+	Entities []tg.MessageEntityClass
+}
+
+// sessionFolder возвращает имя каталога сессии для номера телефона или
+// произвольного имени. Из телефона остаются только цифры, поэтому
+// "+7 (999) 000-00-00" и "79990000000" дают один и тот же каталог.
 func sessionFolder(phone string) string {
 	var out []rune
 	for _, r := range phone {
-		if r >= '0' && r <= '9' {
+		if r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' {
 			out = append(out, r)
 		}
 	}
 	return "phone-" + string(out)
 }
 
-func messageHandler(msg *tg.Message, api *tg.Client, e tg.Entities) error {
-	// Проверка, что сообщение из рабочего чата
-	if peerID, ok := msg.PeerID.(*tg.PeerChannel); ok && peerID.ChannelID == workChat {
-		// Обработка аудиофайлов
-		if media, ok := msg.Media.(*tg.MessageMediaDocument); ok {
-			if doc, ok := media.Document.(*tg.Document); ok {
-				if isAudioFile(doc) {
-					fileName := getFileName(doc)
-					fmt.Printf("Filename: %s\n", fileName)
-					if strings.HasSuffix(strings.ToLower(fileName), ".mp3") {
-						// Обработка MP3
-						downloadPath := fmt.Sprintf("downloads/%d.mp3", doc.ID)
-						if _, err := downloadFile(api, doc, downloadPath); err != nil {
-							return errors.Wrap(err, "download mp3")
-						}
-						fmt.Printf("Download path: %s\n", downloadPath)
-						oggPath := fmt.Sprintf("ogg_files/%d.ogg", doc.ID)
-						if err := convertMp3ToOgg(downloadPath, oggPath); err != nil {
-							return errors.Wrap(err, "convert mp3 to ogg")
-						}
-						fmt.Printf("Ogg path: %s\n", oggPath)
-						if err := sendVoice(api, e, workChat, oggPath); err != nil {
-							return errors.Wrap(err, "send voice")
-						}
-					} else if strings.HasSuffix(strings.ToLower(fileName), ".ogg") {
-						// Обработка OGG
-						oggPath := fmt.Sprintf("ogg_files/%d.ogg", doc.ID)
-						if _, err := downloadFile(api, doc, oggPath); err != nil {
-							return errors.Wrap(err, "download ogg")
-						}
-						if err := sendVoice(api, e, workChat, oggPath); err != nil {
-							return errors.Wrap(err, "send voice")
-						}
-					}
-				}
-			}
+// messagePeer возвращает чат, в который нужно отвечать на сообщение: рабочий
+// чат или, с ALLOW_DM, личный диалог. Для остальных сообщений возвращает nil.
+func messagePeer(ctx context.Context, api telegramAPI, peers storage.PeerStorage, e tg.Entities, msg *tg.Message) (tg.InputPeerClass, error) {
+	switch p := msg.PeerID.(type) {
+	case *tg.PeerChannel:
+		// Проверка, что сообщение из рабочего чата
+		if p.ChannelID != workChat {
+			return nil, nil
+		}
+		channel, err := resolveChannel(ctx, api, peers, e, workChat)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve work chat")
+		}
+		return &tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash}, nil
+	case *tg.PeerUser:
+		// Собственные исходящие сообщения не обрабатываем, иначе бот ответит сам себе
+		if !allowDM || msg.Out {
+			return nil, nil
 		}
+		user, err := resolveUser(ctx, peers, e, p.UserID)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve user")
+		}
+		return user, nil
+	default:
+		return nil, nil
+	}
+}
+
+// messageSender возвращает отправителя сообщения. В личных сообщениях FromID
+// не заполняется, и отправителем считается собеседник.
+func messageSender(msg *tg.Message) tg.PeerClass {
+	if msg.FromID != nil {
+		return msg.FromID
+	}
+	return msg.PeerID
+}
 
-		// Обработка ответов на голосовые сообщения
-		if reply, ok := msg.ReplyTo.(*tg.MessageReplyHeader); ok && msg.Message != "" {
-			repliedMsg, err := getMessage(api, e, reply.ReplyToMsgID)
+// inputPeerID возвращает идентификатор чата, используемый в processedStore.
+func inputPeerID(peer tg.InputPeerClass) int64 {
+	switch p := peer.(type) {
+	case *tg.InputPeerChannel:
+		return p.ChannelID
+	case *tg.InputPeerUser:
+		return p.UserID
+	default:
+		return 0
+	}
+}
+
+// enqueueAudio ставит обработку аудиофайла в очередь, чтобы не блокировать
+// апдейты, и после успешной отправки отмечает сообщение как обработанное.
+// Если schedule не нулевое, голосовое публикуется отложенно в это время.
+func enqueueAudio(lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msgID int, doc *tg.Document, schedule time.Time, files fileOptions, queue *jobQueue, processed *processedStore) error {
+	if err := queue.Enqueue(fmt.Sprintf("%d %s", doc.ID, getFileName(doc)), func(ctx context.Context) error {
+		err := convertMessage(ctx, lg, api, peer, msgID, doc, schedule, files, processed)
+		if batches != nil {
+			batches.Add(peer, getFileName(doc), err)
+		}
+		return err
+	}); err != nil {
+		return errors.Wrap(err, "enqueue audio")
+	}
+	return nil
+}
+
+// convertMessage обрабатывает аудио из сообщения и отмечает сообщение как обработанное.
+func convertMessage(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msgID int, doc *tg.Document, schedule time.Time, files fileOptions, processed *processedStore) error {
+	err := processAudio(ctx, lg, api, peer, msgID, doc, schedule, files)
+	if statsDB != nil {
+		if err := statsDB.Flush(); err != nil {
+			lg.Warn("Save stats", zap.Error(err))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return processed.Mark(inputPeerID(peer), msgID)
+}
+
+// resultPeer возвращает чат, куда отправляется результат обработки
+// сообщения из source: DEST_CHAT, если он задан, иначе сам source.
+func resultPeer(source tg.InputPeerClass) tg.InputPeerClass {
+	if dest := destPeer.Load(); dest != nil {
+		return dest
+	}
+	return source
+}
+
+// processAudio скачивает аудиофайл, при необходимости конвертирует его в OGG
+// и отправляет в чат голосовым сообщением.
+func processAudio(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msgID int, doc *tg.Document, schedule time.Time, files fileOptions) (err error) {
+	fileName := getFileName(doc)
+	lg = lg.With(zap.Int64("doc_id", doc.ID), zap.String("filename", fileName))
+	lg.Info("Processing audio")
+	ext := sourceExtension(doc)
+	downloadDir, oggDir := files.dirs(time.Now())
+	var voice voiceOptions
+	if replyToSource {
+		voice.ReplyTo = msgID
+	}
+	if captionFromMetadata {
+		voice.Caption = metadataCaption(doc)
+	}
+	if !schedule.IsZero() {
+		voice.ScheduleDate = int(schedule.Unix())
+	}
+	voice.RandomID = nextSendRandomID(inputPeerID(peer), msgID, doc.ID)
+	// Прогресс, реакции и удаление относятся к исходному сообщению,
+	// а результат с DEST_CHAT уходит в другой канал, где ответить на него нельзя
+	target, sourceReplyTo := resultPeer(peer), voice.ReplyTo
+	if target != peer {
+		voice.ReplyTo = 0
+	}
+	status, outputSize := conversionSkipped, int64(0)
+	defer func() { stats.record(status, err) }()
+	defer func() {
+		if webhook == nil || dryRun {
+			return
+		}
+		event := conversionEvent{DocID: doc.ID, ChatID: inputPeerID(peer), MsgID: msgID, Status: status, OutputSize: outputSize}
+		if err != nil {
+			event.Status, event.Reason = conversionFailed, failureReason(err)
+		}
+		webhook.Notify(event)
+	}()
+	defer func() {
+		if shouldReportFailure(ctx, err) && !dryRun {
+			text := fmt.Sprintf("Не удалось обработать %s: %s", fileName, failureReason(err))
+			if serr := sendMessage(ctx, api, peer, text, msgID); serr != nil {
+				lg.Warn("Send failure message", zap.Error(serr))
+			}
+		}
+	}()
+	if maxFileBytes > 0 && doc.Size > maxFileBytes {
+		lg.Warn("Skip file larger than MAX_FILE_BYTES", zap.Int64("size", doc.Size), zap.Int64("max", maxFileBytes))
+		return nil
+	}
+	if d := sourceDuration(doc); d > 0 && (d < minDuration || maxDuration > 0 && d > maxDuration) {
+		lg.Info("Skip file outside MIN_DURATION and MAX_DURATION", zap.Duration("duration", d))
+		if dryRun {
+			return nil
+		}
+		text := fmt.Sprintf("Пропускаю %s: длительность %s вне допустимого диапазона", fileName, d)
+		return sendMessage(ctx, api, peer, text, msgID)
+	}
+	if !dryRun && reactToSource && (convertibleExtensions[ext] || ext == ".ogg") {
+		if err := sendReaction(ctx, api, peer, msgID, reactionProcessing); err != nil {
+			lg.Warn("Send processing reaction", zap.Error(err))
+		}
+		// Реакция ⏳ не должна остаться на сообщении, если отправить голосовое не удалось
+		defer func() {
 			if err != nil {
-				return errors.Wrap(err, "get replied message")
+				if rerr := sendReaction(ctx, api, peer, msgID, ""); rerr != nil {
+					lg.Warn("Remove processing reaction", zap.Error(rerr))
+				}
 			}
-			if repliedMedia, ok := repliedMsg.Media.(*tg.MessageMediaDocument); ok {
-				if repliedDoc, ok := repliedMedia.Document.(*tg.Document); ok {
-					if isVoiceMessage(repliedDoc) {
-						if err := sendVoiceWithCaption(api, e, workChat, repliedDoc, msg.Message, msg.Entities); err != nil {
-							return errors.Wrap(err, "send voice with caption")
-						}
-					}
+		}()
+	} else if !dryRun && doc.Size >= progressMinBytes && (convertibleExtensions[ext] || ext == ".ogg") {
+		if err := sendMessage(ctx, api, peer, fmt.Sprintf("Обрабатываю %s...", fileName), sourceReplyTo); err != nil {
+			lg.Warn("Send processing message", zap.Error(err))
+		}
+	}
+	switch {
+	case convertibleExtensions[ext]:
+		// Обработка MP3, WAV, FLAC и других форматов, которые понимает ffmpeg
+		downloadPath := filepath.Join(downloadDir, fmt.Sprintf("%d%s", doc.ID, ext))
+		sent := false
+		activeFiles.acquire(downloadPath)
+		defer func() { activeFiles.release(sent && !files.KeepFiles, downloadPath) }()
+
+		// Кеш OGG не делится по датам, чтобы файл из него находился и на следующий день
+		oggPath, err := prepareOgg(ctx, lg, api, peer, msgID, doc, downloadPath, files.OggDir)
+		if err != nil {
+			return err
+		}
+		// OGG по хешу содержимого остаётся в кеше для следующих документов с тем же звуком
+		defer func() {
+			activeFiles.release(sent && !files.KeepFiles && oggCacheBytes == 0, oggPath)
+			if sent && !files.KeepFiles && oggCacheBytes > 0 {
+				if err := evictOggCache(files.OggDir, oggCacheBytes); err != nil {
+					lg.Warn("Evict OGG cache", zap.Error(err))
 				}
 			}
+		}()
+		lg.Debug("Converted", zap.String("ogg_path", oggPath))
+		if dryRun {
+			lg.Info("Dry run, voice not sent", zap.String("ogg_path", oggPath))
+			return nil
+		}
+		if sendAs == sendAsAudio {
+			if err := sendAudio(ctx, api, target, oggPath, doc, voice); err != nil {
+				return errors.Wrap(err, "send audio")
+			}
+		} else if err := sendVoice(ctx, api, target, oggPath, voice); err != nil {
+			return errors.Wrap(err, "send voice")
+		}
+		sent = true
+		status, outputSize = conversionSent, fileSize(oggPath)
+	case ext == ".ogg" && isVoiceMessage(doc) && hasVoiceAttributes(doc):
+		// Документ уже голосовое сообщение с длительностью и waveform,
+		// отправляем его по ссылке без скачивания
+		if dryRun {
+			lg.Info("Dry run, voice not sent")
+			return nil
+		}
+		if err := sendVoiceByReference(ctx, api, target, doc, voice); err != nil {
+			return errors.Wrap(err, "send voice by reference")
+		}
+		status, outputSize = conversionSent, doc.Size
+	case ext == ".ogg":
+		// Обработка OGG: Opus отправляем как есть, остальное (например, Vorbis) конвертируем.
+		// sendVoice вычисляет длительность и waveform по локальному файлу
+		downloadPath := filepath.Join(downloadDir, fmt.Sprintf("%d.ogg", doc.ID))
+		sent := false
+		activeFiles.acquire(downloadPath)
+		defer func() { activeFiles.release(sent && !files.KeepFiles, downloadPath) }()
+
+		if err := downloadOnce(ctx, lg, api, peer, msgID, doc, downloadPath); err != nil {
+			return errors.Wrap(err, "download ogg")
+		}
+		info, err := probeAudio(ctx, downloadPath)
+		if err != nil {
+			return errors.Wrap(err, "probe ogg")
+		}
+		voicePath := downloadPath
+		if info.Codec != "opus" {
+			lg.Info("OGG is not Opus, converting", zap.String("codec", info.Codec))
+			opts := chatOpusOptions(inputPeerID(peer))
+			oggPath := filepath.Join(oggDir, fmt.Sprintf("%d-%s.ogg", doc.ID, opusCacheKey(opts)))
+			activeFiles.acquire(oggPath)
+			defer func() { activeFiles.release(sent && !files.KeepFiles, oggPath) }()
+			if err := convertAudio(ctx, downloadPath, oggPath, formatOpus, clippingOptions(ctx, lg, downloadPath, opts)); err != nil {
+				return errors.Wrap(err, "convert ogg")
+			}
+			voicePath = oggPath
+		}
+		if dryRun {
+			lg.Info("Dry run, voice not sent", zap.String("ogg_path", voicePath))
+			return nil
+		}
+		if err := sendVoice(ctx, api, target, voicePath, voice); err != nil {
+			return errors.Wrap(err, "send voice")
+		}
+		sent = true
+		status, outputSize = conversionSent, fileSize(voicePath)
+	default:
+		lg.Info("Unsupported audio format", zap.String("ext", ext))
+		return nil
+	}
+
+	if reactToSource {
+		if err := sendReaction(ctx, api, peer, msgID, reactionDone); err != nil {
+			lg.Warn("Send done reaction", zap.Error(err))
+		}
+	}
+	if deleteSource {
+		// Нехватка прав на удаление не должна считаться ошибкой обработки
+		if err := deleteMessage(ctx, api, peer, msgID); err != nil {
+			lg.Warn("Delete source message", zap.Int("msg_id", msgID), zap.Error(err))
 		}
 	}
 	return nil
 }
 
+// prepareOgg скачивает и конвертирует документ в OGG и возвращает путь к нему,
+// захваченный в activeFiles. OGG называется по хешу содержимого, поэтому
+// одинаковый звук из разных документов конвертируется только один раз, а
+// повторный вызов для того же документа возьмёт готовый файл без скачивания.
+// Новый документ с тем же звуком скачивается, чтобы узнать хеш, но не
+// конвертируется. Готовые OGG хранятся в пределах OGG_CACHE_BYTES.
+func prepareOgg(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msgID int, doc *tg.Document, downloadPath, cacheDir string) (string, error) {
+	unlock := conversionLocks.Lock(doc.ID)
+	defer unlock()
+
+	hash, err := oggCache.Hash(doc.ID)
+	if err != nil {
+		lg.Warn("Get content hash", zap.Error(err))
+	}
+	opts := chatOpusOptions(inputPeerID(peer))
+	// Для обычного аудио звук не сводится в моно, такой OGG не подходит голосовым
+	if sendAs == sendAsAudio {
+		opts.AudioDocument = true
+	}
+	// Параметры кодирования попадают в имя файла, поэтому OGG, сконвертированный
+	// с другими настройками, не отправляется вместо нового
+	key := opusCacheKey(opts)
+	if hash != "" {
+		oggPath := filepath.Join(cacheDir, hash+"-"+key+".ogg")
+		activeFiles.acquire(oggPath)
+		// Повреждённый OGG, например после прерванной конвертации, конвертируется заново
+		if validateOutput(ctx, oggPath, formatOpus) == nil {
+			touchFile(oggPath)
+			return oggPath, nil
+		}
+		activeFiles.release(false, oggPath)
+	}
+
+	if err := downloadDocument(ctx, lg, api, peer, msgID, doc, downloadPath); err != nil {
+		return "", errors.Wrap(err, "download audio")
+	}
+	lg.Debug("Downloaded", zap.String("download_path", downloadPath))
+	if hash, err = fileHash(downloadPath); err != nil {
+		return "", errors.Wrap(err, "hash audio")
+	}
+	if err := oggCache.SetHash(doc.ID, hash); err != nil {
+		lg.Warn("Save content hash", zap.Error(err))
+	}
+
+	oggPath := filepath.Join(cacheDir, hash+"-"+key+".ogg")
+	activeFiles.acquire(oggPath)
+	unlockContent := contentLocks.Lock(hashLockKey(hash))
+	defer unlockContent()
+
+	// Такое содержимое уже сконвертировано из другого документа
+	if validateOutput(ctx, oggPath, formatOpus) == nil {
+		touchFile(oggPath)
+		return oggPath, nil
+	}
+	// Проверяем файл до конвертации, чтобы не разбирать невнятную ошибку ffmpeg
+	if _, err := probeAudio(ctx, downloadPath); err != nil {
+		activeFiles.release(false, oggPath)
+		return "", errors.Wrap(err, "probe audio")
+	}
+	if err := convertAudio(ctx, downloadPath, oggPath, formatOpus, clippingOptions(ctx, lg, downloadPath, opts)); err != nil {
+		activeFiles.release(false, oggPath)
+		return "", errors.Wrap(err, "convert audio to ogg")
+	}
+	return oggPath, nil
+}
+
+// clippingOptions при PREVENT_CLIPPING измеряет пик файла и, если он выше
+// 0 dBFS, добавляет компенсирующее понижение громкости.
+func clippingOptions(ctx context.Context, lg *zap.Logger, path string, opts OpusOptions) OpusOptions {
+	if !opts.PreventClipping {
+		return opts
+	}
+	peak, err := detectPeak(ctx, path)
+	if err != nil {
+		lg.Warn("Detect peak", zap.Error(err))
+		return opts
+	}
+	lg.Info("Detected peak", zap.Float64("peak_db", peak))
+	if peak > 0 {
+		opts.Gain = -peak
+	}
+	return opts
+}
+
 func run(ctx context.Context) error {
 	var arg struct {
 		FillPeerStorage bool
+		Config          string
 	}
 	flag.BoolVar(&arg.FillPeerStorage, "fill-peer-storage", false, "fill peer storage")
+	flag.StringVar(&arg.Config, "config", "", "path to a JSON or YAML config file")
 	flag.Parse()
 
-	// Загрузка переменных окружения из .env
-	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
-		return errors.Wrap(err, "load env")
+	// Подкоманды, которым не нужно подключение к Telegram
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		return runBot(ctx, arg.FillPeerStorage, arg.Config)
+	case "convert":
+		return runConvert(ctx, flag.Args()[1:])
+	default:
+		return errors.Errorf("unknown command %q", cmd)
 	}
+}
 
-	appID, err := strconv.Atoi(os.Getenv("APP_ID"))
+// runBot подключается к Telegram и обрабатывает сообщения до остановки.
+func runBot(ctx context.Context, fillPeerStorage bool, configPath string) error {
+	configs := newConfigSource(configPath)
+	cfg, err := configs.Load()
 	if err != nil {
-		return errors.Wrap(err, "parse app id")
+		return err
 	}
-	appHash := os.Getenv("APP_HASH")
-	if appHash == "" {
-		return errors.New("no app hash")
+	workChat = cfg.WorkChat
+	allowDM = cfg.AllowDM
+	allowedUsers = make(map[int64]struct{}, len(cfg.AllowedUsers))
+	for _, id := range cfg.AllowedUsers {
+		allowedUsers[id] = struct{}{}
 	}
-	workChatStr := os.Getenv("WORK_CHAT")
-	if workChatStr == "" {
-		return errors.New("no organizer chat")
+	setOpusOptions(cfg.Opus)
+	replyToSource = cfg.ReplyToSource
+	captionFromMetadata = cfg.CaptionFromMetadata
+	captionTemplate = cfg.CaptionTemplate
+	dryRun = cfg.DryRun
+	deleteSource = cfg.DeleteSourceMessage
+	reactToSource = cfg.ReactToSource
+	sendAs = cfg.SendAs
+	progressMinBytes = cfg.ProgressMinBytes
+	maxFileBytes = cfg.MaxFileBytes
+	oggCacheBytes = cfg.OggCacheBytes
+	minDuration, maxDuration = cfg.MinDuration, cfg.MaxDuration
+	if cfg.UserQuota > 0 {
+		quota = newUserQuota(cfg.UserQuota, quotaWindow)
 	}
-	workChat, err = strconv.ParseInt(workChatStr, 10, 64)
-	if err != nil {
-		return errors.Wrap(err, "parse organizer chat")
+	retryJitter = cfg.RetryJitter
+	getMessageAttempts, getMessageDelay = cfg.GetMessageAttempts, cfg.GetMessageDelay
+	extractVideoAudio = cfg.ExtractVideoAudio
+	ffmpegTimeout = cfg.FFmpegTimeout
+	dirMode = cfg.DirMode
+	fileMode = cfg.FileMode
+	ffmpegBin = cfg.FFmpegPath
+	ffmpegThreads = cfg.FFmpegThreads
+	ffmpegNice = cfg.FFmpegNice
+	ffprobeBin = cfg.FFprobePath
+	if err := checkFFmpeg(); err != nil {
+		return err
+	}
+	files := cfg.Files
+	for _, dir := range []string{files.DownloadDir, files.OggDir} {
+		if err := ensureWritableDir(dir); err != nil {
+			return err
+		}
 	}
 
 	// Настройка сессии
-	sessionDir := filepath.Join("session", sessionFolder("111"))
-	if err := os.MkdirAll(sessionDir, 0700); err != nil {
+	sessionDir := filepath.Join("session", sessionFolder(cfg.SessionName))
+	if err := os.MkdirAll(sessionDir, dirMode); err != nil {
 		return err
 	}
 	logFilePath := filepath.Join(sessionDir, "log.jsonl")
 	fmt.Printf("Storing session in %s, logs in %s\n", sessionDir, logFilePath)
 
 	// Настройка логирования
-	logWriter := zapcore.AddSync(&lj.Logger{
-		Filename:   logFilePath,
-		MaxBackups: 3,
-		MaxSize:    1,
-		MaxAge:     7,
-	})
-	logCore := zapcore.NewCore(
-		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-		logWriter,
-		zap.DebugLevel,
-	)
-	lg := zap.New(logCore)
+	lg := newLogger(cfg.Log, logFilePath)
 	defer func() { _ = lg.Sync() }()
+	encoder, err := selectOpusEncoder(ctx)
+	if err != nil {
+		return err
+	}
+	lg.Info("Voice encoder", zap.String("encoder", encoder))
+	if cfg.WebhookURL != "" {
+		webhook = newWebhookNotifier(cfg.WebhookURL, cfg.WebhookSecret, lg.Named("webhook"))
+	}
+	if cfg.SelfTest != selfTestOff {
+		if err := selfTest(ctx); err != nil {
+			if cfg.SelfTest == selfTestFail {
+				return errors.Wrap(err, "self-test")
+			}
+			lg.Warn("Self-test failed", zap.Error(err))
+		} else {
+			lg.Info("Self-test passed")
+		}
+	}
 
-	sessionStorage := &telegram.FileSessionStorage{
+	var sessionStorage telegram.SessionStorage = &backupSessionStorage{
 		Path: filepath.Join(sessionDir, "session.json"),
 	}
+	if cfg.SessionFromEnv {
+		sessionStorage = &envSessionStorage{Data: cfg.SessionData, Out: os.Stdout}
+		lg.Info("Using session from SESSION_DATA")
+	}
 	db, err := pebbledb.Open(filepath.Join(sessionDir, "peers.pebble.db"), &pebbledb.Options{})
 	if err != nil {
 		return errors.Wrap(err, "create pebble storage")
 	}
+	// Базы закрываются последними, после остановки очереди, задачи которой их используют
+	defer func() {
+		if err := db.Close(); err != nil {
+			lg.Warn("Close pebble storage", zap.Error(err))
+		}
+	}()
 	peerDB := pebble.NewPeerStorage(db)
+	oggCache = &contentCache{db: db}
 	lg.Info("Storage", zap.String("path", sessionDir))
 
+	// HTTP-эндпоинты метрик и проверок состояния; при совпадении адресов
+	// они обслуживаются одним сервером
+	health := &healthState{}
+	muxes := map[string]*http.ServeMux{}
+	muxFor := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if addr := cfg.MetricsAddr; addr != "" {
+		muxFor(addr).Handle("/metrics", promhttp.Handler())
+	}
+	if addr := cfg.HealthAddr; addr != "" {
+		health.Register(muxFor(addr))
+	}
+	for addr, mux := range muxes {
+		if err := startHTTPServer(ctx, lg, addr, mux); err != nil {
+			return errors.Wrap(err, "start http server")
+		}
+		lg.Info("HTTP server", zap.String("addr", addr))
+	}
+
 	// Настройка клиента
 	dispatcher := tg.NewUpdateDispatcher()
 	updateHandler := storage.UpdateHook(dispatcher, peerDB)
-	boltdb, err := bbolt.Open(filepath.Join(sessionDir, "updates.bolt.db"), 0666, nil)
+	boltdb, err := bbolt.Open(filepath.Join(sessionDir, "updates.bolt.db"), fileMode, nil)
 	if err != nil {
 		return errors.Wrap(err, "create bolt storage")
 	}
-	updatesRecovery := updates.New(updates.Config{
-		Handler: updateHandler,
-		Logger:  lg.Named("updates.recovery"),
-		Storage: boltstor.NewStateStorage(boltdb),
-	})
+	defer func() {
+		if err := boltdb.Close(); err != nil {
+			lg.Warn("Close bolt storage", zap.Error(err))
+		}
+	}()
+	processed, err := newProcessedStore(boltdb, cfg.Reprocess)
+	if err != nil {
+		return err
+	}
+	settings, err := newSettingsStore(boltdb)
+	if err != nil {
+		return err
+	}
+	chats, err := settings.All()
+	if err != nil {
+		return errors.Wrap(err, "load chat settings")
+	}
+	setChatSettings(chats)
+	if err := loadMaintenance(settings); err != nil {
+		return err
+	}
+	if statsDB, err = newStatsStore(boltdb, stats); err != nil {
+		return err
+	}
+	// Сохраняем счётчики до закрытия базы, отложенные вызовы выполняются в обратном порядке
+	defer func() {
+		if err := statsDB.Flush(); err != nil {
+			lg.Warn("Save stats", zap.Error(err))
+		}
+	}()
+	stateStorage := boltstor.NewStateStorage(boltdb)
 
-	waiter := floodwait.NewWaiter().WithCallback(func(ctx context.Context, wait floodwait.FloodWait) {
+	waiter := newFloodWaiter(cfg).WithCallback(func(ctx context.Context, wait floodwait.FloodWait) {
 		lg.Warn("Flood wait", zap.Duration("wait", wait.Duration))
 		fmt.Println("Got FLOOD_WAIT. Will retry after", wait.Duration)
 	})
@@ -194,120 +700,221 @@ func run(ctx context.Context) error {
 	options := telegram.Options{
 		Logger:         lg,
 		SessionStorage: sessionStorage,
-		UpdateHandler:  updatesRecovery,
 		Middlewares: []telegram.Middleware{
 			waiter,
-			ratelimit.New(rate.Every(time.Millisecond*100), 5),
+			newRateLimiter(cfg),
+			errorLogger(lg),
 		},
 	}
-	client := telegram.NewClient(appID, appHash, options)
-	api := client.API()
-
-	dispatcher.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateNewChannelMessage) error {
-		msg, ok := u.Message.(*tg.Message)
-		if !ok {
-			return nil
-		}
-
-		err = messageHandler(msg, api, e)
+	applyDC(&options, cfg)
+	if cfg.ProxyURL != "" {
+		dial, err := proxyDial(cfg.ProxyURL)
 		if err != nil {
-			fmt.Println(err)
+			return err
 		}
-		return err
-	})
-
-	/*dispatcher.OnNewMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateNewMessage) error {
-		fmt.Println("New Message", u.Message)
-
-		msg, ok := u.Message.(*tg.Message)
-		if !ok {
-			return nil
+		options.Resolver = dcs.Plain(dcs.PlainOptions{Dial: dial})
+	}
+	// Запросы идут через текущий клиент, который пересоздаётся при переподключении
+	conn := &clientInvoker{}
+	api := tg.NewClient(conn)
+	queue := newJobQueue(cfg.MaxWorkers, lg.Named("queue"))
+	// Клиент может завершиться и без сигнала остановки, например после
+	// постоянной ошибки. Повторный Shutdown после остановки по сигналу сразу возвращается
+	defer func() {
+		if err := queue.Shutdown(cfg.ShutdownTimeout); err != nil {
+			lg.Warn("Shutdown", zap.Error(err))
 		}
+	}()
+	if cfg.BatchSummary {
+		batches = newBatchSummary(batchQuietPeriod, lg.Named("batch"), func(peer tg.InputPeerClass, text string) error {
+			return sendMessage(ctx, api, peer, text, 0)
+		})
+	}
 
-		return messageHandler(msg, api)
-	})*/
+	handler := &messageHandler{
+		lg:        lg,
+		api:       api,
+		peers:     peerDB,
+		files:     files,
+		queue:     queue,
+		processed: processed,
+		settings:  settings,
+		configs:   configs,
+	}
+	handler.albums = newAlbumBuffer(albumQuietPeriod, handler.enqueueAlbum)
+	handler.Register(dispatcher, cfg.AllowDM, cfg.OnEdit)
 
-	return waiter.Run(ctx, func(ctx context.Context) error {
-		return client.Run(ctx, func(ctx context.Context) error {
-			authStatus, err := client.Auth().Status(ctx)
+	// Клиент работает в контексте без отмены, чтобы после Ctrl+C задачи из очереди
+	// успели отправить результат. Обработка апдейтов при этом останавливается сразу.
+	shutdown := ctx
+	return waiter.Run(context.WithoutCancel(ctx), func(ctx context.Context) error {
+		return reconnect(shutdown, lg, func() error {
+			// Остановленные клиент и менеджер апдейтов нельзя запустить
+			// повторно, поэтому каждое подключение создаёт новые
+			updatesRecovery := updates.New(updates.Config{
+				Handler: updateHandler,
+				Logger:  lg.Named("updates.recovery"),
+				Storage: stateStorage,
+			})
+			opts := options
+			opts.UpdateHandler = updatesRecovery
+			client := telegram.NewClient(cfg.AppID, cfg.AppHash, opts)
+			conn.current.Store(client)
+			return client.Run(ctx, func(ctx context.Context) error {
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				defer context.AfterFunc(shutdown, cancel)()
 
-			if err != nil {
-				return errors.Wrap(err, "get auth status")
-			}
+				authStatus, err := client.Auth().Status(ctx)
 
-			if !authStatus.Authorized {
-				_, err := client.QR().Auth(ctx, qrlogin.OnLoginToken(dispatcher), func(ctx context.Context, token qrlogin.Token) error {
-					qr, err := qrcode.New(token.URL(), qrcode.Medium)
+				if err != nil {
+					return errors.Wrap(err, "get auth status")
+				}
 
-					if err != nil {
-						return err
+				if !authStatus.Authorized && cfg.BotToken != "" {
+					if _, err := client.Auth().Bot(ctx, cfg.BotToken); err != nil {
+						return errors.Wrap(err, "bot auth")
 					}
-
-					code := qr.ToSmallString(false)
-					lines := strings.Count(code, "\n")
-
-					fmt.Print(code)
-					fmt.Print(strings.Repeat(text.CursorUp.Sprint(), lines))
-					return nil
-				})
-
-				if err != nil {
-					if !tgerr.Is(err, "SESSION_PASSWORD_NEEDED") {
-						return fmt.Errorf("qr auth: %w", err)
+				} else if !authStatus.Authorized && cfg.AuthMode == authModePhone {
+					if err := phoneAuth(ctx, client, Terminal{PhoneNumber: cfg.Phone}); err != nil {
+						return errors.Wrap(err, "phone auth")
 					}
+				} else if !authStatus.Authorized {
+					_, err := client.QR().Auth(ctx, qrlogin.OnLoginToken(dispatcher), func(ctx context.Context, token qrlogin.Token) error {
+						return printLoginToken(os.Stdout, token.URL(), cfg.AuthPrintURL, isTerminal())
+					})
 
-					fmt.Print("Введите облачный пароль: ")
-					password, err := term.ReadPassword(int(os.Stdin.Fd()))
 					if err != nil {
-						return fmt.Errorf("failed to read password: %w", err)
+						if !isPasswordNeeded(err) {
+							return fmt.Errorf("qr auth: %w", err)
+						}
+						if err := promptAndSubmitPassword(ctx, client); err != nil {
+							return err
+						}
 					}
+				}
 
-					passwordStr := strings.TrimSpace(string(password))
-					fmt.Println(passwordStr)
+				self, err := client.Self(ctx)
+				if err != nil {
+					return errors.Wrap(err, "call self")
+				}
+				health.SetAuthorized(true)
+				defer health.SetAuthorized(false)
+				name := self.FirstName
+				if self.Username != "" {
+					name = fmt.Sprintf("%s (@%s)", name, self.Username)
+				}
+				fmt.Println("Current user:", name)
+				lg.Info("Login",
+					zap.String("first_name", self.FirstName),
+					zap.String("last_name", self.LastName),
+					zap.String("username", self.Username),
+					zap.Int64("id", self.ID),
+				)
 
-					if _, err = client.Auth().Password(ctx, passwordStr); err != nil {
-						return fmt.Errorf("password auth: %w", err)
+				if fillPeerStorage {
+					fmt.Println("Filling peer storage from dialogs to cache entities")
+					collector := storage.CollectPeers(peerDB)
+					if err := collector.Dialogs(ctx, query.GetDialogs(api).Iter()); err != nil {
+						return errors.Wrap(err, "collect peers")
 					}
+					fmt.Println("Filled")
 				}
-			}
 
-			self, err := client.Self(ctx)
-			if err != nil {
-				return errors.Wrap(err, "call self")
-			}
-			name := self.FirstName
-			if self.Username != "" {
-				name = fmt.Sprintf("%s (@%s)", name, self.Username)
-			}
-			fmt.Println("Current user:", name)
-			lg.Info("Login",
-				zap.String("first_name", self.FirstName),
-				zap.String("last_name", self.LastName),
-				zap.String("username", self.Username),
-				zap.Int64("id", self.ID),
-			)
-
-			if arg.FillPeerStorage {
-				fmt.Println("Filling peer storage from dialogs to cache entities")
-				collector := storage.CollectPeers(peerDB)
-				if err := collector.Dialogs(ctx, query.GetDialogs(api).Iter()); err != nil {
-					return errors.Wrap(err, "collect peers")
+				// Канал разрешается один раз, при переподключениях воркеры продолжают им пользоваться
+				if cfg.DestChat != 0 && destPeer.Load() == nil {
+					channel, err := resolveChannel(ctx, api, peerDB, tg.Entities{}, cfg.DestChat)
+					if err != nil {
+						return errors.Wrap(err, "resolve DEST_CHAT")
+					}
+					destPeer.Store(&tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash})
 				}
-				fmt.Println("Filled")
-			}
 
-			fmt.Println("Listening for updates. Interrupt (Ctrl+C) to stop.")
-			return updatesRecovery.Run(ctx, api, self.ID, updates.AuthOptions{
-				IsBot: self.Bot,
-				OnStart: func(ctx context.Context) {
-					fmt.Println("Update recovery initialized and started, listening for events")
-				},
+				fmt.Println("Listening for updates. Interrupt (Ctrl+C) to stop.")
+				err = updatesRecovery.Run(ctx, api, self.ID, updates.AuthOptions{
+					IsBot: self.Bot,
+					OnStart: func(ctx context.Context) {
+						health.SetReady(true)
+						fmt.Println("Update recovery initialized and started, listening for events")
+					},
+				})
+				health.SetReady(false)
+
+				// При обрыве соединения очередь продолжает работу до переподключения.
+				// При остановке дожидаемся задач, которые уже попали в очередь
+				if shutdown.Err() != nil {
+					if n := handler.albums.Flush(); n > 0 {
+						lg.Info("Enqueued pending albums", zap.Int("albums", n))
+					}
+					if shutdownErr := queue.Shutdown(cfg.ShutdownTimeout); shutdownErr != nil {
+						lg.Warn("Shutdown", zap.Error(shutdownErr))
+						fmt.Println(shutdownErr)
+					}
+				}
+				return err
 			})
 		})
 	})
 }
 
+func newFloodWaiter(cfg Config) *floodwait.Waiter {
+	return floodwait.NewWaiter().WithMaxRetries(cfg.FloodWaitMaxRetries)
+}
+
+// applyDC переключает клиент на тестовые серверы Telegram и закрепляет DC, если это задано.
+func applyDC(options *telegram.Options, cfg Config) {
+	if cfg.TGTest {
+		options.DCList = dcs.Test()
+	}
+	if cfg.DC != 0 {
+		options.DC = cfg.DC
+	}
+}
+
+func newRateLimiter(cfg Config) *ratelimit.RateLimiter {
+	return ratelimit.New(rate.Every(cfg.RateLimitInterval), cfg.RateLimitBurst)
+}
+
+// Права файлов по умолчанию, как у os.Create
+const defaultFileMode os.FileMode = 0666
+
 // Вспомогательные функции
+// ensureWritableDir создаёт каталог при необходимости и проверяет, что в него можно писать
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// fileSize возвращает размер файла или 0, если его не удалось узнать.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// sourceDuration возвращает длительность аудио или видео из атрибутов
+// документа, 0 — если Telegram её не передал.
+func sourceDuration(doc *tg.Document) time.Duration {
+	for _, attr := range doc.Attributes {
+		switch a := attr.(type) {
+		case *tg.DocumentAttributeAudio:
+			return time.Duration(a.Duration) * time.Second
+		case *tg.DocumentAttributeVideo:
+			return time.Duration(a.Duration * float64(time.Second))
+		}
+	}
+	return 0
+}
+
 func isAudioFile(doc *tg.Document) bool {
 	for _, attr := range doc.Attributes {
 		if _, ok := attr.(*tg.DocumentAttributeAudio); ok {
@@ -317,12 +924,22 @@ func isAudioFile(doc *tg.Document) bool {
 	return false
 }
 
-func isVoiceMessage(doc *tg.Document) bool {
+func isVideoFile(doc *tg.Document) bool {
 	for _, attr := range doc.Attributes {
-		audioAttr, ok := attr.(*tg.DocumentAttributeAudio)
-		fmt.Println(audioAttr, ok)
+		if _, ok := attr.(*tg.DocumentAttributeVideo); ok {
+			return true
+		}
 	}
+	return strings.HasPrefix(doc.MimeType, "video/")
+}
 
+// isConvertible сообщает, что из документа можно сделать голосовое: это аудио
+// или, с EXTRACT_VIDEO_AUDIO, видео, из которого извлекается звук.
+func isConvertible(doc *tg.Document) bool {
+	return isAudioFile(doc) || (extractVideoAudio && isVideoFile(doc))
+}
+
+func isVoiceMessage(doc *tg.Document) bool {
 	for _, attr := range doc.Attributes {
 		if audioAttr, ok := attr.(*tg.DocumentAttributeAudio); ok && audioAttr.Voice {
 			return true
@@ -331,6 +948,64 @@ func isVoiceMessage(doc *tg.Document) bool {
 	return false
 }
 
+// hasVoiceAttributes сообщает, что у голосового сообщения заполнены длительность
+// и waveform, и при повторной отправке оно не будет показано как 0:00.
+func hasVoiceAttributes(doc *tg.Document) bool {
+	for _, attr := range doc.Attributes {
+		if audioAttr, ok := attr.(*tg.DocumentAttributeAudio); ok && audioAttr.Voice {
+			return audioAttr.Duration > 0 && len(audioAttr.Waveform) > 0
+		}
+	}
+	return false
+}
+
+// sourceExtension определяет формат документа по MimeType, затем по
+// расширению имени файла. Если формат неизвестен, но Telegram пометил документ
+// как аудио, возвращает unknownAudioExtension.
+func sourceExtension(doc *tg.Document) string {
+	mimeType := strings.ToLower(doc.MimeType)
+	if ext, ok := mimeExtensions[mimeType]; ok {
+		return ext
+	}
+	if ext := strings.ToLower(filepath.Ext(getFileName(doc))); convertibleExtensions[ext] || ext == ".ogg" {
+		return ext
+	}
+	if isAudioFile(doc) {
+		return unknownAudioExtension
+	}
+	if isVideoFile(doc) {
+		return videoExtension
+	}
+	return ""
+}
+
+// audioMetadata возвращает исполнителя и название трека из атрибутов документа.
+func audioMetadata(doc *tg.Document) (performer, title string) {
+	for _, attr := range doc.Attributes {
+		if audioAttr, ok := attr.(*tg.DocumentAttributeAudio); ok {
+			return audioAttr.Performer, audioAttr.Title
+		}
+	}
+	return "", ""
+}
+
+// metadataCaption строит подпись по CAPTION_TEMPLATE, а если он не задан —
+// вида "Исполнитель — Название" из тех полей, которые есть в документе.
+func metadataCaption(doc *tg.Document) string {
+	if captionTemplate != "" {
+		return renderCaption(captionTemplate, doc)
+	}
+	performer, title := audioMetadata(doc)
+	switch {
+	case performer != "" && title != "":
+		return performer + " — " + title
+	case title != "":
+		return title
+	default:
+		return performer
+	}
+}
+
 func getFileName(doc *tg.Document) string {
 	for _, attr := range doc.Attributes {
 		if fnAttr, ok := attr.(*tg.DocumentAttributeFilename); ok {
@@ -340,9 +1015,45 @@ func getFileName(doc *tg.Document) string {
 	return fmt.Sprintf("%d", doc.ID)
 }
 
-func downloadFile(api *tg.Client, doc *tg.Document, path string) (tg.StorageFileTypeClass, error) {
+// downloadOnce скачивает документ, если целого файла ещё нет на диске,
+// например, он остался от предыдущей обработки с KEEP_FILES.
+func downloadOnce(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msgID int, doc *tg.Document, path string) error {
+	unlock := conversionLocks.Lock(doc.ID)
+	defer unlock()
+
+	if validateDownload(path, doc.Size) == nil {
+		return nil
+	}
+	return downloadDocument(ctx, lg, api, peer, msgID, doc, path)
+}
+
+// downloadDocument скачивает документ из сообщения msgID. Если file reference
+// успел устареть, заново получает сообщение и повторяет скачивание один раз.
+func downloadDocument(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msgID int, doc *tg.Document, path string) error {
+	_, err := downloadFile(ctx, lg, api, doc, path)
+	if !tgerr.Is(err, "FILE_REFERENCE_EXPIRED") {
+		return err
+	}
+
+	msg, err := getMessage(ctx, api, peer, msgID)
+	if err != nil {
+		return errors.Wrap(err, "refresh file reference")
+	}
+	media, ok := msg.Media.(*tg.MessageMediaDocument)
+	if !ok {
+		return errors.Errorf("message %d no longer has a document", msgID)
+	}
+	fresh, ok := media.Document.(*tg.Document)
+	if !ok || fresh.ID != doc.ID {
+		return errors.Errorf("message %d no longer has document %d", msgID, doc.ID)
+	}
+	_, err = downloadFile(ctx, lg, api, fresh, path)
+	return err
+}
+
+func downloadFile(ctx context.Context, lg *zap.Logger, api telegramAPI, doc *tg.Document, path string) (tg.StorageFileTypeClass, error) {
 	// Создаём директорию для скачиваний, если она не существует
-	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
 		return nil, fmt.Errorf("failed to create download directory: %w", err)
 	}
 
@@ -352,119 +1063,371 @@ func downloadFile(api *tg.Client, doc *tg.Document, path string) (tg.StorageFile
 		FileReference: doc.FileReference,
 	}
 	d := downloader.NewDownloader()
-	return d.Download(api, location).ToPath(context.Background(), path)
-}
+	var typ tg.StorageFileTypeClass
+	err := retry(ctx, retryAttempts, func(ctx context.Context) error {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
+		if err != nil {
+			return err
+		}
+		defer func(file *os.File) {
+			_ = file.Close()
+		}(file)
 
-func convertMp3ToOgg(inputPath, outputPath string) error {
-	// Проверяем, существует ли файл outputPath
-	if _, err := os.Stat(outputPath); err == nil {
-		// Файл существует, возвращаем nil
-		return nil
-	} else if !os.IsNotExist(err) {
-		// Если ошибка не связана с отсутствием файла, возвращаем её
-		return fmt.Errorf("failed to check output file: %w", err)
+		var output io.WriterAt = file
+		if doc.Size >= progressMinBytes {
+			output = newProgressWriter(file, doc.Size, func(percent int) {
+				lg.Info("Download progress", zap.Int64("doc_id", doc.ID), zap.Int("percent", percent))
+			})
+		}
+		if typ, err = d.Download(api, location).Parallel(ctx, output); err != nil {
+			return err
+		}
+		return validateDownload(path, doc.Size)
+	})
+	if err == nil {
+		filesDownloaded.Inc()
+		stats.downloadedBytes.Add(doc.Size)
+	}
+	// Слишком большой файл не понадобится, а место на диске он занимает
+	if errors.Is(err, errFileTooLarge) {
+		if rerr := os.Remove(path); rerr != nil && !os.IsNotExist(rerr) {
+			lg.Warn("Remove oversized download", zap.String("path", path), zap.Error(rerr))
+		}
 	}
+	return typ, err
+}
 
-	// Создаём директорию для outputPath, если она не существует
-	if err := os.MkdirAll(filepath.Dir(outputPath), 0700); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+// validateDownload проверяет, что файл скачан целиком: он не пустой и, если
+// размер документа известен, совпадает с ним по размеру.
+func validateDownload(path string, expected int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to check downloaded file: %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("downloaded file %s is empty", path)
+	}
+	if expected > 0 && info.Size() != expected {
+		return fmt.Errorf("downloaded file %s is incomplete: got %d of %d bytes", path, info.Size(), expected)
 	}
+	if maxFileBytes > 0 && info.Size() > maxFileBytes {
+		return fmt.Errorf("%w: downloaded file %s has %d bytes, limit %d", errFileTooLarge, path, info.Size(), maxFileBytes)
+	}
+	return nil
+}
 
-	// Выполняем конвертацию с помощью ffmpeg
-	cmd := exec.Command("ffmpeg", "-i", inputPath, "-c:a", "libopus", outputPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to convert mp3 to ogg: %w", err)
+// sendMessage отправляет текст в канал. Если replyTo не равен нулю,
+// сообщение отправляется ответом на сообщение с этим ID.
+func sendMessage(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, text string, replyTo int) error {
+	if err := checkPeer(peer); err != nil {
+		return err
+	}
+	req := &tg.MessagesSendMessageRequest{
+		Peer:     peer,
+		Message:  text,
+		RandomID: rand.Int63(),
 	}
+	if replyTo != 0 {
+		req.ReplyTo = &tg.InputReplyToMessage{ReplyToMsgID: replyTo}
+	}
+	_, err := api.MessagesSendMessage(ctx, req)
+	return err
+}
 
+// sendVoice загружает OGG и отправляет его голосовым сообщением.
+func sendVoice(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, oggPath string, opts voiceOptions) error {
+	if err := checkPeer(peer); err != nil {
+		return err
+	}
+	uploadedFile, err := uploadFile(ctx, api, oggPath)
+	if err != nil {
+		return err
+	}
+	waveform, err := computeWaveform(ctx, oggPath)
+	if err != nil {
+		return err
+	}
+	duration, err := audioDuration(ctx, oggPath)
+	if err != nil {
+		return err
+	}
+	attributes := []tg.DocumentAttributeClass{
+		&tg.DocumentAttributeAudio{Voice: true, Duration: duration, Waveform: waveform},
+		&tg.DocumentAttributeFilename{FileName: voiceFileName},
+	}
+	media := tg.InputMediaUploadedDocument{
+		File:       uploadedFile,
+		Attributes: attributes,
+		MimeType:   uploadMimeType(oggPath),
+	}
+	if err := sendMedia(ctx, api, peer, &media, opts); err != nil {
+		return err
+	}
+	voicesSent.Inc()
 	return nil
 }
 
-func sendVoice(api *tg.Client, e tg.Entities, chatID int64, oggPath string) error {
-	var accessHash int64
-	for _, channel := range e.Channels {
-		if channel.ID == workChat {
-			accessHash = channel.AccessHash
-		}
+// Имя файла голосового сообщения
+const voiceFileName = "voice.ogg"
+
+// uploadMimeTypes сопоставляет расширению сконвертированного файла его MIME-тип
+var uploadMimeTypes = map[string]string{
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+}
+
+// uploadMimeType возвращает MIME-тип загружаемого файла по его расширению.
+// Голосовые сообщения всегда кодируются в Opus, поэтому по умолчанию audio/ogg.
+func uploadMimeType(path string) string {
+	if mimeType, ok := uploadMimeTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		return mimeType
 	}
+	return "audio/ogg"
+}
 
-	file, err := os.Open(oggPath)
+// sendAudio отправляет сконвертированный файл обычным аудио, а не голосовым
+// сообщением, сохраняя исполнителя, название и обложку исходного документа.
+func sendAudio(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, path string, source *tg.Document, opts voiceOptions) error {
+	if err := checkPeer(peer); err != nil {
+		return err
+	}
+	uploadedFile, err := uploadFile(ctx, api, path)
 	if err != nil {
 		return err
 	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	u := uploader.NewUploader(api)
-	uploadedFile, err := u.FromFile(context.Background(), file)
+	duration, err := audioDuration(ctx, path)
 	if err != nil {
 		return err
 	}
+	performer, title := audioMetadata(source)
 	attributes := []tg.DocumentAttributeClass{
-		&tg.DocumentAttributeAudio{Voice: true},
+		&tg.DocumentAttributeAudio{Duration: duration, Performer: performer, Title: title},
+		&tg.DocumentAttributeFilename{
+			FileName: strings.TrimSuffix(getFileName(source), filepath.Ext(getFileName(source))) + filepath.Ext(path),
+		},
 	}
 	media := tg.InputMediaUploadedDocument{
 		File:       uploadedFile,
 		Attributes: attributes,
-		MimeType:   "audio/ogg",
+		MimeType:   uploadMimeType(path),
 	}
-	_, err = api.MessagesSendMedia(context.Background(), &tg.MessagesSendMediaRequest{
-		Peer:     &tg.InputPeerChannel{ChannelID: chatID, AccessHash: accessHash},
-		Media:    &media,
-		RandomID: rand.Int63(),
+
+	thumb, err := downloadThumb(ctx, api, source)
+	if err != nil {
+		return errors.Wrap(err, "download thumbnail")
+	}
+	if thumb != nil {
+		u := uploader.NewUploader(api)
+		if media.Thumb, err = u.FromBytes(ctx, "thumb.jpg", thumb); err != nil {
+			return errors.Wrap(err, "upload thumbnail")
+		}
+	}
+	return sendMedia(ctx, api, peer, &media, opts)
+}
+
+// downloadThumb скачивает самую крупную обложку документа. Если обложки нет,
+// возвращает nil.
+func downloadThumb(ctx context.Context, api telegramAPI, doc *tg.Document) ([]byte, error) {
+	var (
+		best   *tg.PhotoSize
+		cached []byte
+	)
+	for _, thumb := range doc.Thumbs {
+		switch size := thumb.(type) {
+		case *tg.PhotoCachedSize:
+			cached = size.Bytes
+		case *tg.PhotoSize:
+			if best == nil || size.Size > best.Size {
+				best = size
+			}
+		}
+	}
+	if best == nil {
+		// Маленькая обложка может прийти прямо в документе
+		return cached, nil
+	}
+
+	location := &tg.InputDocumentFileLocation{
+		ID:            doc.ID,
+		AccessHash:    doc.AccessHash,
+		FileReference: doc.FileReference,
+		ThumbSize:     best.Type,
+	}
+	var buf bytes.Buffer
+	if _, err := downloader.NewDownloader().Download(api, location).Stream(ctx, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// partRetrier повторяет загрузку отдельной части файла. Части загружаются
+// независимо, поэтому временная ошибка посреди большого файла не заставляет
+// загружать его заново с первой части.
+type partRetrier struct {
+	uploader.Client
+}
+
+func (c partRetrier) UploadSaveFilePart(ctx context.Context, request *tg.UploadSaveFilePartRequest) (ok bool, err error) {
+	err = retry(ctx, retryAttempts, func(ctx context.Context) error {
+		ok, err = c.Client.UploadSaveFilePart(ctx, request)
+		return err
 	})
-	return err
+	return ok, err
 }
 
-func getMessage(api *tg.Client, e tg.Entities, msgID int) (*tg.Message, error) {
-	var accessHash int64
-	for _, channel := range e.Channels {
-		if channel.ID == workChat {
-			accessHash = channel.AccessHash
+func (c partRetrier) UploadSaveBigFilePart(ctx context.Context, request *tg.UploadSaveBigFilePartRequest) (ok bool, err error) {
+	err = retry(ctx, retryAttempts, func(ctx context.Context) error {
+		ok, err = c.Client.UploadSaveBigFilePart(ctx, request)
+		return err
+	})
+	return ok, err
+}
+
+func uploadFile(ctx context.Context, api telegramAPI, path string) (tg.InputFileClass, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	u := uploader.NewUploader(partRetrier{api})
+	uploadStarted := time.Now()
+	uploadedFile, err := u.FromFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	uploadDuration.Observe(time.Since(uploadStarted).Seconds())
+	return uploadedFile, nil
+}
+
+func sendMedia(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, media tg.InputMediaClass, opts voiceOptions) error {
+	if err := checkPeer(peer); err != nil {
+		return err
+	}
+	req := &tg.MessagesSendMediaRequest{
+		Peer:     peer,
+		Media:    media,
+		Message:  opts.Caption,
+		Entities: opts.Entities,
+		RandomID: opts.RandomID,
+	}
+	if req.RandomID == 0 {
+		req.RandomID = rand.Int63()
+	}
+	if opts.ReplyTo != 0 {
+		req.ReplyTo = &tg.InputReplyToMessage{ReplyToMsgID: opts.ReplyTo}
+	}
+	if opts.ScheduleDate != 0 {
+		req.SetScheduleDate(opts.ScheduleDate)
+	}
+	return retry(ctx, retryAttempts, func(ctx context.Context) error {
+		_, err := api.MessagesSendMedia(ctx, req)
+		return err
+	})
+}
+
+// getMessage получает сообщение по ID. Сразу после ответа на сообщение
+// Telegram иногда ещё не отдаёт его, поэтому ненайденное сообщение
+// запрашивается повторно до GET_MESSAGE_ATTEMPTS раз с растущей паузой.
+func getMessage(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msgID int) (*tg.Message, error) {
+	delay := getMessageDelay
+	for attempt := 1; ; attempt++ {
+		msg, err := fetchMessage(ctx, api, peer, msgID)
+		if !errors.Is(err, errMessageNotFound) {
+			return msg, err
 		}
+		if attempt >= getMessageAttempts {
+			return nil, fmt.Errorf("message %d: %w after %d attempts", msgID, err, attempt)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("message %d: %w", msgID, ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
 	}
+}
 
-	resp, err := api.ChannelsGetMessages(
-		context.Background(),
-		&tg.ChannelsGetMessagesRequest{
-			Channel: &tg.InputChannel{ChannelID: workChat, AccessHash: accessHash},
-			ID:      []tg.InputMessageClass{&tg.InputMessageID{ID: msgID}},
-		},
+// fetchMessage один раз запрашивает сообщение по ID.
+func fetchMessage(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msgID int) (*tg.Message, error) {
+	ids := []tg.InputMessageClass{&tg.InputMessageID{ID: msgID}}
+	var (
+		resp tg.MessagesMessagesClass
+		err  error
 	)
+	// Сообщения каналов запрашиваются отдельным методом
+	if channel, ok := peer.(*tg.InputPeerChannel); ok {
+		resp, err = api.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash},
+			ID:      ids,
+		})
+	} else {
+		resp, err = api.MessagesGetMessages(ctx, ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+	messages, err := responseMessages(resp)
 	if err != nil {
 		return nil, err
 	}
-	messages := resp.(*tg.MessagesChannelMessages).GetMessages()
+	// Удалённое или ещё недоступное сообщение приходит как MessageEmpty
+	// либо не приходит вовсе
+	if len(messages) == 0 {
+		return nil, errMessageNotFound
+	}
 	for _, m := range messages {
 		if msg, ok := m.(*tg.Message); ok {
 			return msg, nil
 		}
 	}
-	return nil, fmt.Errorf("message not found")
+	return nil, errMessageNotFound
 }
 
-func sendVoiceWithCaption(api *tg.Client, e tg.Entities, chatID int64, doc *tg.Document, caption string, entities []tg.MessageEntityClass) error {
-	var accessHash int64
-	for _, channel := range e.Channels {
-		if channel.ID == workChat {
-			accessHash = channel.AccessHash
-		}
+// responseMessages достаёт сообщения из любого варианта ответа MessagesMessagesClass.
+func responseMessages(resp tg.MessagesMessagesClass) ([]tg.MessageClass, error) {
+	switch r := resp.(type) {
+	case *tg.MessagesMessages:
+		return r.Messages, nil
+	case *tg.MessagesMessagesSlice:
+		return r.Messages, nil
+	case *tg.MessagesChannelMessages:
+		return r.Messages, nil
+	case *tg.MessagesMessagesNotModified:
+		return nil, fmt.Errorf("messages not modified (count %d)", r.Count)
+	default:
+		return nil, fmt.Errorf("unexpected messages response %T", resp)
 	}
+}
 
-	media := &tg.InputMediaDocument{
-		ID: &tg.InputDocument{
-			ID:            doc.ID,
-			AccessHash:    doc.AccessHash,
-			FileReference: doc.FileReference,
-		},
+// sendVoiceByReference повторно отправляет уже загруженное в Telegram
+// голосовое сообщение по ссылке на документ, без скачивания и загрузки.
+func sendVoiceByReference(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, doc *tg.Document, opts voiceOptions) error {
+	if err := sendMedia(ctx, api, peer, &tg.InputMediaDocument{ID: doc.AsInput()}, opts); err != nil {
+		return err
 	}
-	_, err := api.MessagesSendMedia(context.Background(), &tg.MessagesSendMediaRequest{
-		Peer:     &tg.InputPeerChannel{ChannelID: chatID, AccessHash: accessHash},
-		Media:    media,
-		Message:  caption,
-		Entities: entities,
-		RandomID: rand.Int63(),
-	})
+	voicesSent.Inc()
+	return nil
+}
+
+// deleteMessage удаляет сообщение у всех участников чата.
+func deleteMessage(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msgID int) error {
+	ids := []int{msgID}
+	if channel, ok := peer.(*tg.InputPeerChannel); ok {
+		_, err := api.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash},
+			ID:      ids,
+		})
+		return err
+	}
+	_, err := api.MessagesDeleteMessages(ctx, &tg.MessagesDeleteMessagesRequest{Revoke: true, ID: ids})
 	return err
 }
 
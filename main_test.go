@@ -0,0 +1,1154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pebbledb "github.com/cockroachdb/pebble"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// testDocument собирает документ с MIME-типом, именем файла и атрибутами.
+func testDocument(mimeType, fileName string, attrs ...tg.DocumentAttributeClass) *tg.Document {
+	doc := &tg.Document{ID: 1, MimeType: mimeType}
+	if fileName != "" {
+		doc.Attributes = append(doc.Attributes, &tg.DocumentAttributeFilename{FileName: fileName})
+	}
+	doc.Attributes = append(doc.Attributes, attrs...)
+	return doc
+}
+
+func TestSourceExtension(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  *tg.Document
+		want string
+	}{
+		{name: "mp3 by name", doc: testDocument("", "song.mp3"), want: ".mp3"},
+		{name: "wav by name", doc: testDocument("", "take.WAV"), want: ".wav"},
+		{name: "flac by name", doc: testDocument("", "album.flac"), want: ".flac"},
+		{name: "unsupported", doc: testDocument("", "notes.txt"), want: ""},
+		{name: "audio without filename", doc: testDocument("", "", &tg.DocumentAttributeAudio{}), want: unknownAudioExtension},
+		{name: "mime wins over name", doc: testDocument("audio/mpeg", "track.bin"), want: ".mp3"},
+		{name: "mime is case insensitive", doc: testDocument("Audio/X-FLAC", ""), want: ".flac"},
+		{name: "ogg by mime", doc: testDocument("audio/ogg", "voice"), want: ".ogg"},
+		{name: "video", doc: testDocument("video/mp4", "clip.mp4", &tg.DocumentAttributeVideo{}), want: videoExtension},
+		{
+			name: "unknown audio",
+			doc:  testDocument("application/octet-stream", "track", &tg.DocumentAttributeAudio{Duration: 10}),
+			want: unknownAudioExtension,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sourceExtension(tt.doc); got != tt.want {
+				t.Errorf("sourceExtension() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadDocumentRefreshesReference(t *testing.T) {
+	const msgID = 10
+	content := testAudioContent
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	// documentMessage возвращает сообщение с документом id и file reference ref
+	documentMessage := func(id int64, ref string) *tg.Message {
+		return &tg.Message{ID: msgID, Media: &tg.MessageMediaDocument{
+			Document: &tg.Document{ID: id, FileReference: []byte(ref), Size: int64(len(content))},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		ref         string      // file reference документа из апдейта
+		message     *tg.Message // сообщение при повторном запросе
+		wantFetches int
+		wantErr     bool
+	}{
+		{name: "valid reference", ref: "fresh"},
+		{name: "expired reference", ref: "old", message: documentMessage(1, "fresh"), wantFetches: 1},
+		{name: "document replaced", ref: "old", message: documentMessage(2, "fresh"), wantFetches: 1, wantErr: true},
+		{name: "message without document", ref: "old", message: &tg.Message{ID: msgID}, wantFetches: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{
+				files:    map[int64][]byte{1: content},
+				fileRef:  []byte("fresh"),
+				messages: map[int]*tg.Message{},
+			}
+			if tt.message != nil {
+				api.messages[msgID] = tt.message
+			}
+			doc := &tg.Document{ID: 1, FileReference: []byte(tt.ref), Size: int64(len(content))}
+			path := filepath.Join(t.TempDir(), "1.mp3")
+
+			err := downloadDocument(context.Background(), zap.NewNop(), api, peer, msgID, doc, path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("downloadDocument() succeeded, want error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, content) {
+					t.Errorf("downloaded %q, want %q", got, content)
+				}
+			}
+			if n := api.count("ChannelsGetMessages"); n != tt.wantFetches {
+				t.Errorf("message fetched %d times, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestSendMediaRequest(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	media := &tg.InputMediaDocument{ID: &tg.InputDocument{ID: 3}}
+
+	tests := []struct {
+		name  string
+		opts  voiceOptions
+		check func(t *testing.T, req *tg.MessagesSendMediaRequest)
+	}{
+		{
+			name: "not a reply",
+			check: func(t *testing.T, req *tg.MessagesSendMediaRequest) {
+				if req.ReplyTo != nil {
+					t.Errorf("ReplyTo = %v, want nil", req.ReplyTo)
+				}
+			},
+		},
+		{
+			name: "reply to the source message",
+			opts: voiceOptions{ReplyTo: 10},
+			check: func(t *testing.T, req *tg.MessagesSendMediaRequest) {
+				reply, ok := req.ReplyTo.(*tg.InputReplyToMessage)
+				if !ok || reply.ReplyToMsgID != 10 {
+					t.Errorf("ReplyTo = %v, want message 10", req.ReplyTo)
+				}
+			},
+		},
+		{
+			name: "sent immediately",
+			check: func(t *testing.T, req *tg.MessagesSendMediaRequest) {
+				if _, ok := req.GetScheduleDate(); ok {
+					t.Errorf("ScheduleDate is set: %d", req.ScheduleDate)
+				}
+			},
+		},
+		{
+			name: "scheduled",
+			opts: voiceOptions{ScheduleDate: 1717264800},
+			check: func(t *testing.T, req *tg.MessagesSendMediaRequest) {
+				if date, ok := req.GetScheduleDate(); !ok || date != 1717264800 {
+					t.Errorf("ScheduleDate = %d, %t, want 1717264800", date, ok)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{}
+			if err := sendMedia(context.Background(), api, peer, media, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(api.sentMedia) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(api.sentMedia))
+			}
+			req := api.sentMedia[0]
+			if req.Peer != peer || req.Media != media {
+				t.Errorf("request peer %v, media %v", req.Peer, req.Media)
+			}
+			tt.check(t, req)
+		})
+	}
+}
+
+func TestMetadataCaption(t *testing.T) {
+	tests := []struct {
+		name      string
+		performer string
+		title     string
+		want      string
+	}{
+		{name: "performer and title", performer: "Artist", title: "Song", want: "Artist — Song"},
+		{name: "title only", title: "Song", want: "Song"},
+		{name: "performer only", performer: "Artist", want: "Artist"},
+		{name: "no metadata", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := testDocument("audio/mpeg", "track.mp3", &tg.DocumentAttributeAudio{Performer: tt.performer, Title: tt.title})
+			if got := metadataCaption(doc); got != tt.want {
+				t.Errorf("metadataCaption() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionFolder(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "111", want: "phone-111"},
+		{name: "+7 (999) 000-00-00", want: "phone-79990000000"},
+		{name: "79990000000", want: "phone-79990000000"},
+		{name: "work_bot", want: "phone-work_bot"},
+		{name: "../../etc", want: "phone-etc"},
+		{name: "", want: "phone-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionFolder(tt.name); got != tt.want {
+				t.Errorf("sessionFolder(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAudioDryRun(t *testing.T) {
+	setFakeConverter(t)
+	setOggCache(t)
+	setVar(t, &dryRun, true)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name    string
+		doc     *tg.Document
+		wantOgg bool
+	}{
+		{name: "mp3 is converted", doc: testDocument("audio/mpeg", "song.mp3"), wantOgg: true},
+		{
+			name: "voice is not resent",
+			doc:  testDocument("audio/ogg", "voice.ogg", &tg.DocumentAttributeAudio{Voice: true, Duration: 3, Waveform: []byte{1}}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{files: map[int64][]byte{tt.doc.ID: testAudioContent}}
+			tt.doc.Size = int64(len(testAudioContent))
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			if err := processAudio(context.Background(), zap.NewNop(), api, peer, 10, tt.doc, time.Time{}, files); err != nil {
+				t.Fatal(err)
+			}
+			if n := api.count("MessagesSendMedia"); n != 0 {
+				t.Errorf("sent %d media in dry run", n)
+			}
+			oggs, _ := filepath.Glob(filepath.Join(files.OggDir, "*.ogg"))
+			if got := len(oggs) > 0; got != tt.wantOgg {
+				t.Errorf("converted OGG exists = %t, want %t", got, tt.wantOgg)
+			}
+		})
+	}
+}
+
+func TestDownloadThumb(t *testing.T) {
+	thumbs := map[string][]byte{"m": []byte("medium jpeg"), "x": []byte("large jpeg")}
+
+	tests := []struct {
+		name   string
+		thumbs []tg.PhotoSizeClass
+		want   []byte
+	}{
+		{name: "no thumbnail"},
+		{name: "cached in document", thumbs: []tg.PhotoSizeClass{&tg.PhotoCachedSize{Type: "s", Bytes: []byte("tiny jpeg")}}, want: []byte("tiny jpeg")},
+		{
+			name: "largest size is downloaded",
+			thumbs: []tg.PhotoSizeClass{
+				&tg.PhotoCachedSize{Type: "s", Bytes: []byte("tiny jpeg")},
+				&tg.PhotoSize{Type: "x", Size: 500},
+				&tg.PhotoSize{Type: "m", Size: 100},
+			},
+			want: []byte("large jpeg"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{thumbs: thumbs}
+			doc := testDocument("audio/mpeg", "song.mp3")
+			doc.Thumbs = tt.thumbs
+
+			got, err := downloadThumb(context.Background(), api, doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("downloadThumb() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsVoiceMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  *tg.Document
+		want bool
+	}{
+		{name: "voice", doc: testDocument("audio/ogg", "", &tg.DocumentAttributeAudio{Voice: true}), want: true},
+		{name: "music", doc: testDocument("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{Title: "Song"})},
+		{name: "ogg file without voice flag", doc: testDocument("audio/ogg", "voice.ogg")},
+		{name: "no attributes", doc: &tg.Document{ID: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isVoiceMessage(tt.doc); got != tt.want {
+				t.Errorf("isVoiceMessage() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAllowedSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed map[int64]struct{}
+		from    tg.PeerClass
+		want    bool
+	}{
+		{name: "everyone when list is empty", from: &tg.PeerUser{UserID: 1}, want: true},
+		{name: "channel when list is empty", from: &tg.PeerChannel{ChannelID: 1}, want: true},
+		{name: "listed user", allowed: map[int64]struct{}{1: {}}, from: &tg.PeerUser{UserID: 1}, want: true},
+		{name: "other user", allowed: map[int64]struct{}{1: {}}, from: &tg.PeerUser{UserID: 2}},
+		{name: "anonymous channel post", allowed: map[int64]struct{}{1: {}}, from: &tg.PeerChannel{ChannelID: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &allowedUsers, tt.allowed)
+			if got := isAllowedSender(tt.from); got != tt.want {
+				t.Errorf("isAllowedSender(%v) = %t, want %t", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasVoiceAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		attr *tg.DocumentAttributeAudio
+		want bool
+	}{
+		{name: "duration and waveform", attr: &tg.DocumentAttributeAudio{Voice: true, Duration: 3, Waveform: []byte{1, 2}}, want: true},
+		{name: "no waveform", attr: &tg.DocumentAttributeAudio{Voice: true, Duration: 3}},
+		{name: "zero duration", attr: &tg.DocumentAttributeAudio{Voice: true, Waveform: []byte{1}}},
+		{name: "not a voice", attr: &tg.DocumentAttributeAudio{Duration: 3, Waveform: []byte{1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasVoiceAttributes(testDocument("audio/ogg", "", tt.attr)); got != tt.want {
+				t.Errorf("hasVoiceAttributes() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAudioOgg(t *testing.T) {
+	setFakeConverter(t)
+	content := []byte("OggS voice")
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name         string
+		attr         *tg.DocumentAttributeAudio
+		wantDownload bool
+		wantMedia    string // тип отправленного media
+	}{
+		{
+			name:      "complete voice is sent by reference",
+			attr:      &tg.DocumentAttributeAudio{Voice: true, Duration: 3, Waveform: []byte{1}},
+			wantMedia: "*tg.InputMediaDocument",
+		},
+		{
+			name:         "voice without waveform is uploaded again",
+			attr:         &tg.DocumentAttributeAudio{Voice: true},
+			wantDownload: true,
+			wantMedia:    "*tg.InputMediaUploadedDocument",
+		},
+		{
+			name:         "ogg file is sent as voice",
+			attr:         &tg.DocumentAttributeAudio{Title: "Recording"},
+			wantDownload: true,
+			wantMedia:    "*tg.InputMediaUploadedDocument",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := testDocument("audio/ogg", "voice.ogg", tt.attr)
+			doc.Size = int64(len(content))
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			if err := processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files); err != nil {
+				t.Fatal(err)
+			}
+			if got := api.count("UploadGetFile") > 0; got != tt.wantDownload {
+				t.Errorf("downloaded = %t, want %t", got, tt.wantDownload)
+			}
+			if len(api.sentMedia) != 1 {
+				t.Fatalf("sent %d media, want 1", len(api.sentMedia))
+			}
+			if got := fmt.Sprintf("%T", api.sentMedia[0].Media); got != tt.wantMedia {
+				t.Errorf("sent %s, want %s", got, tt.wantMedia)
+			}
+			// Повторно загруженное голосовое получает длительность и waveform
+			if uploaded, ok := api.sentMedia[0].Media.(*tg.InputMediaUploadedDocument); ok {
+				var audio *tg.DocumentAttributeAudio
+				for _, attr := range uploaded.Attributes {
+					if a, ok := attr.(*tg.DocumentAttributeAudio); ok {
+						audio = a
+					}
+				}
+				if audio == nil || !audio.Voice || audio.Duration != 3 || len(audio.Waveform) == 0 {
+					t.Errorf("audio attribute = %+v", audio)
+				}
+			}
+		})
+	}
+}
+
+func TestMessagePeer(t *testing.T) {
+	const chatID, userID = 100, 5
+	setVar(t, &workChat, chatID)
+	channel := &tg.Channel{ID: chatID}
+	channel.SetAccessHash(7)
+	user := &tg.User{ID: userID}
+	user.SetAccessHash(9)
+	entities := tg.Entities{
+		Channels: map[int64]*tg.Channel{chatID: channel},
+		Users:    map[int64]*tg.User{userID: user},
+	}
+
+	tests := []struct {
+		name    string
+		allowDM bool
+		msg     *tg.Message
+		want    tg.InputPeerClass
+	}{
+		{name: "work chat", msg: &tg.Message{PeerID: &tg.PeerChannel{ChannelID: chatID}}, want: &tg.InputPeerChannel{ChannelID: chatID, AccessHash: 7}},
+		{name: "other channel", msg: &tg.Message{PeerID: &tg.PeerChannel{ChannelID: chatID + 1}}},
+		{name: "private chat without ALLOW_DM", msg: &tg.Message{PeerID: &tg.PeerUser{UserID: userID}}},
+		{name: "private chat", allowDM: true, msg: &tg.Message{PeerID: &tg.PeerUser{UserID: userID}}, want: &tg.InputPeerUser{UserID: userID, AccessHash: 9}},
+		{name: "own outgoing message", allowDM: true, msg: &tg.Message{Out: true, PeerID: &tg.PeerUser{UserID: userID}}},
+		{name: "basic group", allowDM: true, msg: &tg.Message{PeerID: &tg.PeerChat{ChatID: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &allowDM, tt.allowDM)
+			got, err := messagePeer(context.Background(), &stubAPI{}, testPeerStorage(t), entities, tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("messagePeer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseMessages(t *testing.T) {
+	msgs := []tg.MessageClass{&tg.Message{ID: 1}}
+
+	tests := []struct {
+		name    string
+		resp    tg.MessagesMessagesClass
+		want    int
+		wantErr bool
+	}{
+		{name: "messages", resp: &tg.MessagesMessages{Messages: msgs}, want: 1},
+		{name: "slice", resp: &tg.MessagesMessagesSlice{Messages: msgs}, want: 1},
+		{name: "channel messages", resp: &tg.MessagesChannelMessages{Messages: msgs}, want: 1},
+		{name: "not modified", resp: &tg.MessagesMessagesNotModified{Count: 1}, wantErr: true},
+		{name: "nil", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := responseMessages(tt.resp)
+			if (err != nil) != tt.wantErr || len(got) != tt.want {
+				t.Errorf("responseMessages() = %d messages, %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestValidateDownload(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected int64
+		wantErr  string
+	}{
+		{name: "complete", content: "audio", expected: 5},
+		{name: "size unknown", content: "audio"},
+		{name: "empty", wantErr: "is empty"},
+		{name: "incomplete", content: "aud", expected: 5, wantErr: "got 3 of 5 bytes"},
+		{name: "missing", expected: -1, wantErr: "failed to check downloaded file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "1.mp3")
+			if tt.expected >= 0 {
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := validateDownload(path, tt.expected)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateDownload() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateDownload() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  *tg.Document
+		want string
+	}{
+		{name: "filename attribute", doc: testDocument("audio/mpeg", "song.mp3"), want: "song.mp3"},
+		{name: "no filename", doc: testDocument("audio/mpeg", "", &tg.DocumentAttributeAudio{}), want: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getFileName(tt.doc); got != tt.want {
+				t.Errorf("getFileName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDC(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		wantTest bool
+		wantDC   int
+	}{
+		{name: "production defaults"},
+		{name: "test servers", cfg: Config{TGTest: true}, wantTest: true},
+		{name: "pinned DC", cfg: Config{DC: 4}, wantDC: 4},
+		{name: "test servers with pinned DC", cfg: Config{TGTest: true, DC: 2}, wantTest: true, wantDC: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options telegram.Options
+			applyDC(&options, tt.cfg)
+			if options.DCList.Test != tt.wantTest {
+				t.Errorf("DCList.Test = %t, want %t", options.DCList.Test, tt.wantTest)
+			}
+			if tt.wantTest && options.DCList.Zero() {
+				t.Error("test DC list is empty")
+			}
+			if !tt.wantTest && !options.DCList.Zero() {
+				t.Error("production client must use the default DC list")
+			}
+			if options.DC != tt.wantDC {
+				t.Errorf("DC = %d, want %d", options.DC, tt.wantDC)
+			}
+		})
+	}
+}
+
+// blockingAPI зависает в запросах до отмены контекста, как запрос к
+// Telegram, на который не пришёл ответ.
+type blockingAPI struct {
+	*stubAPI
+	started chan struct{}
+}
+
+func (b *blockingAPI) block(ctx context.Context) error {
+	close(b.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (b *blockingAPI) UploadGetFile(ctx context.Context, _ *tg.UploadGetFileRequest) (tg.UploadFileClass, error) {
+	return nil, b.block(ctx)
+}
+
+func (b *blockingAPI) MessagesGetMessages(ctx context.Context, _ []tg.InputMessageClass) (tg.MessagesMessagesClass, error) {
+	return nil, b.block(ctx)
+}
+
+func (b *blockingAPI) UploadSaveFilePart(ctx context.Context, _ *tg.UploadSaveFilePartRequest) (bool, error) {
+	return false, b.block(ctx)
+}
+
+func TestHelpersStopOnCancel(t *testing.T) {
+	setFFmpeg(t, "exec sleep 5")
+	peer := &tg.InputPeerUser{UserID: 1, AccessHash: 2}
+	dir := t.TempDir()
+	oggPath := filepath.Join(dir, "voice.ogg")
+	if err := os.WriteFile(oggPath, []byte("OggS"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, api telegramAPI) error
+	}{
+		{
+			name: "downloadFile",
+			call: func(ctx context.Context, api telegramAPI) error {
+				_, err := downloadFile(ctx, zap.NewNop(), api, testDocument("audio/mpeg", "song.mp3"), filepath.Join(dir, "song.mp3"))
+				return err
+			},
+		},
+		{
+			name: "getMessage",
+			call: func(ctx context.Context, api telegramAPI) error {
+				_, err := getMessage(ctx, api, peer, 10)
+				return err
+			},
+		},
+		{
+			name: "sendVoice",
+			call: func(ctx context.Context, api telegramAPI) error {
+				return sendVoice(ctx, api, peer, oggPath, voiceOptions{})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &blockingAPI{stubAPI: &stubAPI{}, started: make(chan struct{})}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- tt.call(ctx, api) }()
+
+			<-api.started
+			cancel()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("%s() = %v, want context.Canceled", tt.name, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s() did not stop after cancel", tt.name)
+			}
+		})
+	}
+}
+
+func TestConvertAudioStopsOnCancel(t *testing.T) {
+	setFFmpeg(t, "exec sleep 5")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	started := time.Now()
+	err := convertAudio(ctx, "in.mp3", filepath.Join(t.TempDir(), "out.ogg"), formatOpus, OpusOptions{})
+	if err == nil {
+		t.Fatal("convertAudio() succeeded after cancel")
+	}
+	if d := time.Since(started); d > 3*time.Second {
+		t.Errorf("convertAudio() stopped after %s", d)
+	}
+}
+
+func TestFileOptionsDirs(t *testing.T) {
+	now := time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		files        fileOptions
+		wantDownload string
+		wantOgg      string
+	}{
+		{
+			name:         "flat",
+			files:        fileOptions{DownloadDir: "downloads", OggDir: "ogg"},
+			wantDownload: "downloads",
+			wantOgg:      "ogg",
+		},
+		{
+			name:         "date partition",
+			files:        fileOptions{DownloadDir: "downloads", OggDir: "ogg", DatePartition: true},
+			wantDownload: filepath.Join("downloads", "2024-06-01"),
+			wantOgg:      filepath.Join("ogg", "2024-06-01"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloadDir, oggDir := tt.files.dirs(now)
+			if downloadDir != tt.wantDownload || oggDir != tt.wantOgg {
+				t.Errorf("dirs() = %q, %q, want %q, %q", downloadDir, oggDir, tt.wantDownload, tt.wantOgg)
+			}
+		})
+	}
+}
+
+func TestProcessAudioDatePartition(t *testing.T) {
+	setFakeConverter(t)
+	setOggCache(t)
+	setVar(t, &dryRun, true)
+	doc, content := testAudio("audio/mpeg", "song.mp3")
+	api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+	dir := t.TempDir()
+	files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg"), DatePartition: true}
+
+	if err := processAudio(context.Background(), zap.NewNop(), api, &tg.InputPeerUser{UserID: 1}, 10, doc, time.Time{}, files); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Now().Format(time.DateOnly)
+	// Кеш OGG не делится по датам, чтобы готовый файл находился и на следующий день
+	for _, pattern := range []string{
+		filepath.Join(files.DownloadDir, date, "1.mp3"),
+		filepath.Join(files.OggDir, "*.ogg"),
+	} {
+		if found, _ := filepath.Glob(pattern); len(found) == 0 {
+			t.Errorf("no file matches %s", pattern)
+		}
+	}
+	if found, _ := filepath.Glob(filepath.Join(files.OggDir, date, "*.ogg")); len(found) != 0 {
+		t.Errorf("cached OGG is in the date partition: %q", found)
+	}
+}
+
+func TestProcessAudioDeleteSource(t *testing.T) {
+	setFakeConverter(t)
+	setOggCache(t)
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		peer       tg.InputPeerClass
+		ffmpeg     string
+		deleteErr  error
+		wantDelete string // метод удаления или пустая строка
+		wantErr    bool
+	}{
+		{name: "disabled", peer: &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}},
+		{name: "channel", enabled: true, peer: &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}, wantDelete: "ChannelsDeleteMessages"},
+		{name: "private chat", enabled: true, peer: &tg.InputPeerUser{UserID: 1, AccessHash: 2}, wantDelete: "MessagesDeleteMessages"},
+		{
+			name:      "no permission is not an error",
+			enabled:   true,
+			peer:      &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2},
+			deleteErr: tgerr.New(403, "MESSAGE_DELETE_FORBIDDEN"),
+		},
+		{
+			name:    "conversion failed",
+			enabled: true,
+			peer:    &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2},
+			ffmpeg:  "exit 1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &deleteSource, tt.enabled)
+			if tt.ffmpeg != "" {
+				setFFmpeg(t, tt.ffmpeg)
+			}
+			doc, content := testAudio("audio/mpeg", "song.mp3")
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}, deleteErr: tt.deleteErr}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			err := processAudio(context.Background(), zap.NewNop(), api, tt.peer, 10, doc, time.Time{}, files)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processAudio() = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantDelete == "" {
+				if len(api.deleted) != 0 {
+					t.Errorf("deleted messages %v", api.deleted)
+				}
+				return
+			}
+			if api.count(tt.wantDelete) != 1 || len(api.deleted) != 1 || api.deleted[0] != 10 {
+				t.Errorf("calls %q, deleted %v, want %s of message 10", api.calls, api.deleted, tt.wantDelete)
+			}
+		})
+	}
+}
+
+func TestMaxFileBytes(t *testing.T) {
+	setFakeConverter(t)
+	setOggCache(t)
+	setVar(t, &maxFileBytes, 10)
+	peer := &tg.InputPeerUser{UserID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name      string
+		content   string
+		size      int64 // размер, который сообщил Telegram
+		downloads int   // число запросов UploadGetFile
+		wantErr   bool
+	}{
+		{name: "within limit", content: "ID3 small", size: 9, downloads: 1},
+		{name: "skipped before download", content: "ID3 large content", size: 17},
+		{name: "rejected after download", content: "ID3 large content", downloads: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := testDocument("audio/mpeg", "song.mp3")
+			doc.Size = tt.size
+			api := &stubAPI{files: map[int64][]byte{doc.ID: []byte(tt.content)}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			err := processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processAudio() = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errFileTooLarge) {
+				t.Errorf("processAudio() = %v, want errFileTooLarge", err)
+			}
+			// Слишком большой файл не скачивается повторно и не остаётся на диске
+			if n := api.count("UploadGetFile"); n != tt.downloads {
+				t.Errorf("UploadGetFile called %d times, want %d", n, tt.downloads)
+			}
+			if tt.wantErr {
+				if _, err := os.Stat(filepath.Join(files.DownloadDir, "1.mp3")); !os.IsNotExist(err) {
+					t.Errorf("oversized download is kept: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadOnce(t *testing.T) {
+	content := []byte("OggS voice")
+	tests := []struct {
+		name      string
+		local     []byte // файл, оставшийся от прошлой обработки
+		downloads int
+	}{
+		{name: "not downloaded yet", downloads: 1},
+		{name: "complete local file", local: content},
+		{name: "incomplete local file", local: content[:4], downloads: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := testDocument("audio/ogg", "voice.ogg")
+			doc.Size = int64(len(content))
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			path := filepath.Join(t.TempDir(), "1.ogg")
+			if tt.local != nil {
+				if err := os.WriteFile(path, tt.local, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := downloadOnce(context.Background(), zap.NewNop(), api, &tg.InputPeerUser{UserID: 1}, 10, doc, path); err != nil {
+				t.Fatal(err)
+			}
+			if n := api.count("UploadGetFile"); n != tt.downloads {
+				t.Errorf("UploadGetFile called %d times, want %d", n, tt.downloads)
+			}
+			if data, _ := os.ReadFile(path); !bytes.Equal(data, content) {
+				t.Errorf("file = %q, want %q", data, content)
+			}
+		})
+	}
+}
+
+func TestIsConvertible(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     *tg.Document
+		extract bool
+		want    bool
+	}{
+		{name: "audio", doc: testDocument("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{}), want: true},
+		{name: "video is skipped by default", doc: testDocument("video/mp4", "clip.mp4", &tg.DocumentAttributeVideo{})},
+		{name: "video with EXTRACT_VIDEO_AUDIO", doc: testDocument("video/mp4", "clip.mp4", &tg.DocumentAttributeVideo{}), extract: true, want: true},
+		{name: "video by mime type", doc: testDocument("video/quicktime", "clip.mov"), extract: true, want: true},
+		{name: "other document", doc: testDocument("application/pdf", "doc.pdf"), extract: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &extractVideoAudio, tt.extract)
+			if got := isConvertible(tt.doc); got != tt.want {
+				t.Errorf("isConvertible() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertVideoAudio(t *testing.T) {
+	requireFFmpeg(t)
+	input := generateMedia(t, "clip.mp4",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration=1",
+		"-f", "lavfi", "-i", "color=size=64x64:duration=1",
+		"-c:v", "mpeg4", "-c:a", "aac", "-shortest")
+	output := filepath.Join(t.TempDir(), "voice.ogg")
+
+	if err := convertAudio(context.Background(), input, output, formatOpus, OpusOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := probeAudio(context.Background(), output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Codec != "opus" {
+		t.Errorf("codec = %q, want opus", info.Codec)
+	}
+}
+
+// saveBotGlobals восстанавливает после теста глобальные настройки, которые
+// runBot заполняет из конфигурации.
+func saveBotGlobals(t *testing.T) {
+	t.Helper()
+	setVar(t, &workChat, workChat)
+	setVar(t, &allowDM, allowDM)
+	setVar(t, &allowedUsers, allowedUsers)
+	setVar(t, &replyToSource, replyToSource)
+	setVar(t, &captionFromMetadata, captionFromMetadata)
+	setVar(t, &captionTemplate, captionTemplate)
+	setVar(t, &dryRun, dryRun)
+	setVar(t, &deleteSource, deleteSource)
+	setVar(t, &reactToSource, reactToSource)
+	setVar(t, &sendAs, sendAs)
+	setVar(t, &progressMinBytes, progressMinBytes)
+	setVar(t, &maxFileBytes, maxFileBytes)
+	setVar(t, &oggCacheBytes, oggCacheBytes)
+	setVar(t, &minDuration, minDuration)
+	setVar(t, &maxDuration, maxDuration)
+	setVar(t, &quota, quota)
+	setVar(t, &retryJitter, retryJitter)
+	setVar(t, &getMessageAttempts, getMessageAttempts)
+	setVar(t, &getMessageDelay, getMessageDelay)
+	setVar(t, &extractVideoAudio, extractVideoAudio)
+	setVar(t, &ffmpegTimeout, ffmpegTimeout)
+	setVar(t, &dirMode, dirMode)
+	setVar(t, &fileMode, fileMode)
+	setVar(t, &ffmpegBin, ffmpegBin)
+	setVar(t, &ffmpegThreads, ffmpegThreads)
+	setVar(t, &ffmpegNice, ffmpegNice)
+	setVar(t, &ffprobeBin, ffprobeBin)
+	setVar(t, &audioCodecs, maps.Clone(audioCodecs))
+	setVar(t, &oggCache, oggCache)
+	setVar(t, &statsDB, statsDB)
+	setVar(t, &webhook, webhook)
+	resetOpusSettings(t, OpusOptions{})
+	resetMaintenance(t)
+}
+
+func TestRunBotClosesStorage(t *testing.T) {
+	setVar(t, &reconnectBaseDelay, time.Hour)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		session string // содержимое файла сессии
+		wantErr string
+	}{
+		// Адрес не слушается, бот останавливается до открытия bbolt
+		{name: "http server fails", env: map[string]string{"METRICS_ADDR": "256.0.0.1:0"}, wantErr: "start http server"},
+		// Клиент не запускается, и бот останавливают во время паузы перед
+		// переподключением, когда открыты обе базы
+		{name: "stopped while reconnecting", session: "{", wantErr: "corrupted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			saveBotGlobals(t)
+			setRequiredEnv(t)
+			t.Setenv("SESSION_NAME", "test")
+			t.Setenv("LOG_LEVEL", "warn")
+			t.Setenv("FFMPEG_PATH", fakeBinary(t, "ffmpeg", `echo ' A....D libopus              libopus Opus'`))
+			t.Setenv("FFPROBE_PATH", fakeBinary(t, "ffprobe", fakeFFprobeScript))
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			sessionDir := filepath.Join("session", sessionFolder("test"))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.session != "" {
+				if err := os.MkdirAll(sessionDir, 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(sessionDir, "session.json"), []byte(tt.session), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				// Останавливаем бот, когда в логе появится неудачное подключение
+				go func() {
+					for ctx.Err() == nil {
+						data, _ := os.ReadFile(filepath.Join(sessionDir, "log.jsonl"))
+						if bytes.Contains(data, []byte("Connection lost")) {
+							cancel()
+							return
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+			}
+
+			err := runBot(ctx, false, "")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("runBot() error = %v, want %q", err, tt.wantErr)
+			}
+
+			// Открытая база держит блокировку файла, поэтому повторное
+			// открытие удаётся, только если runBot закрыл её
+			db, err := pebbledb.Open(filepath.Join(sessionDir, "peers.pebble.db"), &pebbledb.Options{})
+			if err != nil {
+				t.Fatalf("pebble storage is not closed: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			boltdb, err := bbolt.Open(filepath.Join(sessionDir, "updates.bolt.db"), 0o600, &bbolt.Options{Timeout: 100 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("bolt storage is not closed: %v", err)
+			}
+			if err := boltdb.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProcessAudioSendAs(t *testing.T) {
+	setFFprobe(t, fakeFFprobeScript)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name      string
+		sendAs    string
+		wantMono  bool
+		wantVoice bool
+	}{
+		{name: "voice is mono", sendAs: sendAsVoice, wantMono: true, wantVoice: true},
+		{name: "audio document keeps channels", sendAs: sendAsAudio},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &sendAs, tt.sendAs)
+			resetOpusSettings(t, OpusOptions{})
+			setOggCache(t)
+			// Скрипт записывает аргументы конвертации, вызовы для waveform пропускаются
+			argsFile := filepath.Join(t.TempDir(), "args")
+			setFFmpeg(t, `for last; do :; done
+if [ "$last" != "-" ]; then echo "$*" >> `+argsFile+`; fi
+`+fakeFFmpegScript)
+			doc, content := testAudio("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{Duration: 3})
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			if err := processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files); err != nil {
+				t.Fatal(err)
+			}
+			args, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := containsSeq(strings.Fields(string(args)), []string{"-ac", "1"}); got != tt.wantMono {
+				t.Errorf("ffmpeg args %q, mono = %t, want %t", args, got, tt.wantMono)
+			}
+			if len(api.sentMedia) != 1 {
+				t.Fatalf("sent %d media, want 1", len(api.sentMedia))
+			}
+			media, ok := api.sentMedia[0].Media.(*tg.InputMediaUploadedDocument)
+			if !ok {
+				t.Fatalf("media is %T", api.sentMedia[0].Media)
+			}
+			voice := false
+			for _, attr := range media.Attributes {
+				if audio, ok := attr.(*tg.DocumentAttributeAudio); ok {
+					voice = audio.Voice
+				}
+			}
+			if voice != tt.wantVoice {
+				t.Errorf("sent as voice = %t, want %t", voice, tt.wantVoice)
+			}
+		})
+	}
+}
+
+func TestSourceDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  *tg.Document
+		want time.Duration
+	}{
+		{name: "audio", doc: testDocument("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{Duration: 90}), want: 90 * time.Second},
+		{name: "video", doc: testDocument("video/mp4", "clip.mp4", &tg.DocumentAttributeVideo{Duration: 2.5}), want: 2500 * time.Millisecond},
+		{name: "unknown", doc: testDocument("audio/mpeg", "song.mp3")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sourceDuration(tt.doc); got != tt.want {
+				t.Errorf("sourceDuration() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAudioDurationFilter(t *testing.T) {
+	setFakeConverter(t)
+	setOggCache(t)
+	setVar(t, &minDuration, 5*time.Second)
+	setVar(t, &maxDuration, time.Hour)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name     string
+		duration int // секунды, 0 — длительность неизвестна
+		wantSent bool
+	}{
+		{name: "below min", duration: 3},
+		{name: "in range", duration: 60, wantSent: true},
+		{name: "above max", duration: 2 * 60 * 60},
+		{name: "unknown duration", wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, content := testAudio("audio/mpeg", "podcast.mp3", &tg.DocumentAttributeAudio{Duration: tt.duration})
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			if err := processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantSent {
+				if len(api.sentMedia) != 1 || len(api.sentMessages) != 0 {
+					t.Errorf("sent %d media and %d messages, want voice only", len(api.sentMedia), len(api.sentMessages))
+				}
+				return
+			}
+			// Пропущенный файл не скачивается, а в чат приходит объяснение
+			if api.count("UploadGetFile") != 0 || len(api.sentMedia) != 0 {
+				t.Errorf("skipped file processed; calls %q", api.calls)
+			}
+			if len(api.sentMessages) != 1 || !strings.Contains(api.sentMessages[0].Message, "вне допустимого диапазона") {
+				t.Fatalf("replies = %v, want skip notice", api.sentMessages)
+			}
+			if reply, ok := api.sentMessages[0].ReplyTo.(*tg.InputReplyToMessage); !ok || reply.ReplyToMsgID != 10 {
+				t.Errorf("ReplyTo = %v, want message 10", api.sentMessages[0].ReplyTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+)
+
+// Настройки, общие для всех чатов, хранятся под чатом 0
+const (
+	globalSettingsChat    int64 = 0
+	maintenanceSettingKey       = "maintenance"
+)
+
+const maintenanceReply = "Обработка временно приостановлена"
+
+// maintenance приостанавливает приём новых конвертаций, бот при этом остаётся
+// в сети и отвечает на команды. Задачи, уже стоящие в очереди, выполняются.
+var maintenance atomic.Bool
+
+// loadMaintenance восстанавливает режим обслуживания после перезапуска.
+func loadMaintenance(settings *settingsStore) error {
+	v, err := settings.Get(globalSettingsChat, maintenanceSettingKey)
+	if err != nil {
+		return errors.Wrap(err, "load maintenance")
+	}
+	maintenance.Store(v == "on")
+	return nil
+}
+
+// handleMaintenance показывает или переключает режим обслуживания.
+func handleMaintenance(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, args string, settings *settingsStore) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	switch args {
+	case "":
+		state := "off"
+		if maintenance.Load() {
+			state = "on"
+		}
+		return sendMessage(ctx, api, peer, "Maintenance: "+state, msg.ID)
+	case "on", "off":
+	default:
+		return sendMessage(ctx, api, peer, "Usage: /maintenance on|off", msg.ID)
+	}
+	// Пустое значение удаляет ключ, поэтому "off" не занимает место в базе
+	value := args
+	if value == "off" {
+		value = ""
+	}
+	if err := settings.Set(globalSettingsChat, maintenanceSettingKey, value); err != nil {
+		return errors.Wrap(err, "save maintenance")
+	}
+	maintenance.Store(args == "on")
+	return sendMessage(ctx, api, peer, "Maintenance "+args, msg.ID)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+// resetMaintenance выключает режим обслуживания на время теста и после него.
+func resetMaintenance(t *testing.T) {
+	t.Helper()
+	maintenance.Store(false)
+	t.Cleanup(func() { maintenance.Store(false) })
+}
+
+func TestHandleMaintenance(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	const admin = 10
+
+	tests := []struct {
+		name      string
+		from      int64
+		args      []string
+		wantReply string
+		wantOn    bool
+	}{
+		{name: "show", from: admin, args: []string{""}, wantReply: "Maintenance: off"},
+		{name: "on", from: admin, args: []string{"on"}, wantReply: "Maintenance on", wantOn: true},
+		{name: "show enabled", from: admin, args: []string{"on", ""}, wantReply: "Maintenance: on", wantOn: true},
+		{name: "off", from: admin, args: []string{"on", "off"}, wantReply: "Maintenance off"},
+		{name: "invalid", from: admin, args: []string{"pause"}, wantReply: "Usage: /maintenance on|off"},
+		{name: "not an admin", from: admin + 1, args: []string{"on"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetMaintenance(t)
+			setVar(t, &allowedUsers, map[int64]struct{}{admin: {}})
+			db := testBolt(t)
+			settings, err := newSettingsStore(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &stubAPI{}
+			msg := &tg.Message{ID: 5, FromID: &tg.PeerUser{UserID: tt.from}}
+
+			for _, args := range tt.args {
+				if err := handleMaintenance(context.Background(), api, peer, msg, args, settings); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var reply string
+			if n := len(api.sentMessages); n > 0 {
+				reply = api.sentMessages[n-1].Message
+			}
+			if reply != tt.wantReply {
+				t.Errorf("reply = %q, want %q", reply, tt.wantReply)
+			}
+			if got := maintenance.Load(); got != tt.wantOn {
+				t.Errorf("maintenance = %t, want %t", got, tt.wantOn)
+			}
+
+			// Режим восстанавливается из базы после перезапуска
+			maintenance.Store(!tt.wantOn)
+			if err := loadMaintenance(settings); err != nil {
+				t.Fatal(err)
+			}
+			if got := maintenance.Load(); got != tt.wantOn {
+				t.Errorf("maintenance after restart = %t, want %t", got, tt.wantOn)
+			}
+		})
+	}
+}
+
+func TestHandlerMaintenance(t *testing.T) {
+	tests := []struct {
+		name        string
+		maintenance bool
+		wantSent    bool
+	}{
+		{name: "processing", wantSent: true},
+		{name: "paused", maintenance: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetMaintenance(t)
+			maintenance.Store(tt.maintenance)
+			setFakeConverter(t)
+			hh := newHandlerHarness(t, &stubAPI{})
+
+			hh.post(t, hh.audioMessage(10, "audio/mpeg", "song.mp3"))
+
+			if tt.wantSent {
+				hh.checkVoiceSent(t, 10)
+				return
+			}
+			if len(hh.api.sentMedia) != 0 || hh.api.count("UploadGetFile") != 0 {
+				t.Errorf("file processed in maintenance mode; calls %q", hh.api.calls)
+			}
+			if len(hh.api.sentMessages) != 1 || hh.api.sentMessages[0].Message != maintenanceReply {
+				t.Errorf("replies = %v, want %q", hh.api.sentMessages, maintenanceReply)
+			}
+			// Файл не помечается обработанным и конвертируется после выключения режима
+			if seen, err := hh.h.processed.Seen(hh.channel.ID, 10); err != nil || seen {
+				t.Errorf("message marked processed: %t, %v", seen, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace = "mp3_to_voice"
+
+var (
+	filesDownloaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_downloaded_total",
+		Help:      "Number of audio files downloaded from Telegram.",
+	})
+	conversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversions_total",
+		Help:      "Number of ffmpeg conversions by result.",
+	}, []string{"result"})
+	voicesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "voice_messages_sent_total",
+		Help:      "Number of voice messages sent.",
+	})
+	conversionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Duration of ffmpeg conversions.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Duration of voice file uploads.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+)
+
+func recordConversion(started time.Time, err error) {
+	elapsed := time.Since(started)
+	conversionDuration.Observe(elapsed.Seconds())
+	stats.conversionTime.Add(int64(elapsed))
+	if err != nil {
+		conversions.WithLabelValues("failed").Inc()
+		return
+	}
+	conversions.WithLabelValues("succeeded").Inc()
+}
+
+// startHTTPServer начинает слушать addr и обслуживает запросы в фоне до отмены ctx.
+// Ошибка возвращается, только если не удалось занять адрес.
+func startHTTPServer(ctx context.Context, lg *zap.Logger, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listen %s", addr)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			lg.Error("HTTP server", zap.String("addr", addr), zap.Error(err))
+		}
+	}()
+	return nil
+}
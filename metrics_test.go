@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// metricValue возвращает текущее значение счётчика Prometheus.
+func metricValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestRecordConversion(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		result string
+	}{
+		{name: "succeeded", result: "succeeded"},
+		{name: "failed", err: errors.New("exit status 1"), result: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := conversions.WithLabelValues(tt.result)
+			before := metricValue(t, counter)
+			recordConversion(time.Now(), tt.err)
+			if got := metricValue(t, counter) - before; got != 1 {
+				t.Errorf("conversions_total{result=%q} grew by %g, want 1", tt.result, got)
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	// startHTTPServer не возвращает адрес слушателя, поэтому порт выбирается заранее
+	addr := freeAddr(t)
+	if err := startHTTPServer(ctx, zap.NewNop(), addr, mux); err != nil {
+		t.Fatal(err)
+	}
+	recordConversion(time.Now(), nil)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mp3_to_voice_conversions_total", "mp3_to_voice_conversion_duration_seconds"} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("metrics have no %s", name)
+		}
+	}
+}
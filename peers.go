@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/contrib/storage"
+	"github.com/gotd/td/tg"
+)
+
+// resolveChannel находит access hash канала: сначала в сущностях апдейта,
+// затем в хранилище пиров, и в последнюю очередь запрашивает канал у Telegram.
+func resolveChannel(ctx context.Context, api telegramAPI, peers storage.PeerStorage, e tg.Entities, channelID int64) (*tg.InputChannel, error) {
+	// У min-каналов из апдейтов access hash может отсутствовать
+	if channel, ok := e.Channels[channelID]; ok && channel.AccessHash != 0 {
+		return channel.AsInput(), nil
+	}
+
+	peer, err := storage.FindPeer(ctx, peers, &tg.PeerChannel{ChannelID: channelID})
+	if err == nil {
+		if channel, ok := peer.AsInputChannel(); ok {
+			return channel, nil
+		}
+	} else if !errors.Is(err, storage.ErrPeerNotFound) {
+		return nil, errors.Wrap(err, "find peer")
+	}
+
+	resp, err := api.ChannelsGetChannels(ctx, []tg.InputChannelClass{
+		&tg.InputChannel{ChannelID: channelID},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get channel")
+	}
+	for _, chat := range resp.GetChats() {
+		channel, ok := chat.(*tg.Channel)
+		if !ok || channel.ID != channelID {
+			continue
+		}
+		var p storage.Peer
+		if p.FromChat(channel) {
+			if err := peers.Add(ctx, p); err != nil {
+				return nil, errors.Wrap(err, "save peer")
+			}
+		}
+		return channel.AsInput(), nil
+	}
+	return nil, errors.Errorf("channel %d not found", channelID)
+}
+
+// resolveUser находит access hash пользователя в сущностях апдейта или в хранилище пиров.
+func resolveUser(ctx context.Context, peers storage.PeerStorage, e tg.Entities, userID int64) (*tg.InputPeerUser, error) {
+	if user, ok := e.Users[userID]; ok && user.AccessHash != 0 {
+		return user.AsInputPeer(), nil
+	}
+
+	peer, err := storage.FindPeer(ctx, peers, &tg.PeerUser{UserID: userID})
+	if err != nil {
+		return nil, errors.Wrap(err, "find peer")
+	}
+	user, ok := peer.AsInputUser()
+	if !ok {
+		return nil, errors.Errorf("user %d not found", userID)
+	}
+	return &tg.InputPeerUser{UserID: user.UserID, AccessHash: user.AccessHash}, nil
+}
+
+// checkPeer проверяет, что у чата есть access hash. Без него Telegram отвечает
+// невнятной ошибкой о неверном пире, поэтому отправку не начинаем.
+func checkPeer(peer tg.InputPeerClass) error {
+	switch p := peer.(type) {
+	case *tg.InputPeerChannel:
+		if p.AccessHash == 0 {
+			return errors.Errorf("channel %d is not resolved: access hash is unknown", p.ChannelID)
+		}
+	case *tg.InputPeerUser:
+		if p.AccessHash == 0 {
+			return errors.Errorf("user %d is not resolved: access hash is unknown", p.UserID)
+		}
+	}
+	return nil
+}
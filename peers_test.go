@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gotd/contrib/storage"
+	"github.com/gotd/td/tg"
+)
+
+func TestResolveChannel(t *testing.T) {
+	const channelID = 42
+	channel := &tg.Channel{ID: channelID, Photo: &tg.ChatPhotoEmpty{}}
+	channel.SetAccessHash(7)
+
+	tests := []struct {
+		name      string
+		entities  tg.Entities
+		stored    bool
+		api       []tg.ChatClass
+		wantHash  int64
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:     "from update entities",
+			entities: tg.Entities{Channels: map[int64]*tg.Channel{channelID: channel}},
+			wantHash: 7,
+		},
+		{
+			name:     "min channel falls back to storage",
+			entities: tg.Entities{Channels: map[int64]*tg.Channel{channelID: {ID: channelID}}},
+			stored:   true,
+			wantHash: 7,
+		},
+		{
+			name:      "requested and saved",
+			api:       []tg.ChatClass{channel},
+			wantHash:  7,
+			wantCalls: 1,
+		},
+		{
+			name:      "not found",
+			api:       []tg.ChatClass{&tg.Channel{ID: channelID + 1, Photo: &tg.ChatPhotoEmpty{}}},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			peers := testPeerStorage(t)
+			if tt.stored {
+				var p storage.Peer
+				if !p.FromChat(channel) {
+					t.Fatal("FromChat failed")
+				}
+				if err := peers.Add(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			api := &stubAPI{channels: tt.api}
+
+			got, err := resolveChannel(ctx, api, peers, tt.entities, channelID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveChannel() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.AccessHash != tt.wantHash {
+				t.Errorf("AccessHash = %d, want %d", got.AccessHash, tt.wantHash)
+			}
+			if n := api.count("ChannelsGetChannels"); n != tt.wantCalls {
+				t.Errorf("ChannelsGetChannels called %d times, want %d", n, tt.wantCalls)
+			}
+
+			if tt.wantCalls == 0 {
+				return
+			}
+			// Второй раз hash берётся из хранилища без запроса
+			if _, err := resolveChannel(ctx, api, peers, tg.Entities{}, channelID); err != nil {
+				t.Fatal(err)
+			}
+			if n := api.count("ChannelsGetChannels"); n > 1 {
+				t.Errorf("ChannelsGetChannels called %d times after save", n)
+			}
+		})
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	const userID = 5
+	user := &tg.User{ID: userID}
+	user.SetAccessHash(9)
+
+	tests := []struct {
+		name     string
+		entities tg.Entities
+		stored   bool
+		wantHash int64
+		wantErr  bool
+	}{
+		{
+			name:     "from update entities",
+			entities: tg.Entities{Users: map[int64]*tg.User{userID: user}},
+			wantHash: 9,
+		},
+		{name: "from storage", stored: true, wantHash: 9},
+		{name: "unknown user", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			peers := testPeerStorage(t)
+			if tt.stored {
+				var p storage.Peer
+				if !p.FromUser(user) {
+					t.Fatal("FromUser failed")
+				}
+				if err := peers.Add(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := resolveUser(ctx, peers, tt.entities, userID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveUser() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.AccessHash != tt.wantHash {
+				t.Errorf("AccessHash = %d, want %d", got.AccessHash, tt.wantHash)
+			}
+		})
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	tests := []struct {
+		name    string
+		peer    tg.InputPeerClass
+		wantErr string
+	}{
+		{name: "channel", peer: &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}},
+		{name: "user", peer: &tg.InputPeerUser{UserID: 1, AccessHash: 2}},
+		{name: "basic group has no hash", peer: &tg.InputPeerChat{ChatID: 1}},
+		{name: "self", peer: &tg.InputPeerSelf{}},
+		{name: "unresolved channel", peer: &tg.InputPeerChannel{ChannelID: 1}, wantErr: "channel 1 is not resolved"},
+		{name: "unresolved user", peer: &tg.InputPeerUser{UserID: 5}, wantErr: "user 5 is not resolved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPeer(tt.peer)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkPeer() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkPeer() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestSendToUnresolvedPeer проверяет, что без access hash запрос не отправляется.
+func TestSendToUnresolvedPeer(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1}
+	tests := []struct {
+		name string
+		send func(api telegramAPI) error
+	}{
+		{name: "sendMessage", send: func(api telegramAPI) error { return sendMessage(context.Background(), api, peer, "text", 0) }},
+		{name: "sendVoice", send: func(api telegramAPI) error {
+			return sendVoice(context.Background(), api, peer, "voice.ogg", voiceOptions{})
+		}},
+		{name: "sendMedia", send: func(api telegramAPI) error {
+			return sendMedia(context.Background(), api, peer, &tg.InputMediaDocument{ID: &tg.InputDocument{ID: 3}}, voiceOptions{})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{}
+			if err := tt.send(api); err == nil || !strings.Contains(err.Error(), "access hash is unknown") {
+				t.Errorf("%s() = %v, want unresolved peer error", tt.name, err)
+			}
+			if len(api.calls) != 0 {
+				t.Errorf("requests sent: %q", api.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	processedBucket = []byte("processed")
+	// versionsBucket хранит версии сообщений для ON_EDIT
+	versionsBucket = []byte("versions")
+)
+
+// processedStore запоминает уже обработанные сообщения, чтобы после
+// перезапуска и повторного получения апдейтов не отправлять голосовые дважды.
+type processedStore struct {
+	db *bbolt.DB
+	// Обрабатывать сообщения повторно, даже если они уже отмечены
+	reprocess bool
+}
+
+func newProcessedStore(db *bbolt.DB, reprocess bool) (*processedStore, error) {
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(processedBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(versionsBucket)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "create processed bucket")
+	}
+	return &processedStore{db: db, reprocess: reprocess}, nil
+}
+
+func processedKey(chatID int64, msgID int) []byte {
+	return []byte(strconv.FormatInt(chatID, 10) + ":" + strconv.Itoa(msgID))
+}
+
+// Seen сообщает, было ли сообщение уже обработано.
+func (s *processedStore) Seen(chatID int64, msgID int) (bool, error) {
+	if s.reprocess {
+		return false, nil
+	}
+	var seen bool
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		seen = tx.Bucket(processedBucket).Get(processedKey(chatID, msgID)) != nil
+		return nil
+	})
+	return seen, err
+}
+
+// Mark отмечает сообщение как обработанное.
+func (s *processedStore) Mark(chatID int64, msgID int) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		value := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+		return tx.Bucket(processedBucket).Put(processedKey(chatID, msgID), value)
+	})
+}
+
+// messageVersion описывает содержимое сообщения, от которого зависит обработка:
+// время последнего редактирования, документ и текст.
+type messageVersion struct {
+	EditDate int
+	DocID    int64
+	Text     string
+}
+
+// messageVersionOf возвращает версию сообщения msg.
+func messageVersionOf(msg *tg.Message) messageVersion {
+	v := messageVersion{EditDate: msg.EditDate, Text: msg.Message}
+	if media, ok := msg.Media.(*tg.MessageMediaDocument); ok {
+		if doc, ok := media.Document.(*tg.Document); ok {
+			v.DocID = doc.ID
+		}
+	}
+	return v
+}
+
+// encode упаковывает версию: дата редактирования, документ и хэш текста.
+func (v messageVersion) encode() []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(v.EditDate))
+	b = binary.BigEndian.AppendUint64(b, uint64(v.DocID))
+	sum := sha256.Sum256([]byte(v.Text))
+	return append(b, sum[:8]...)
+}
+
+// UpdateVersion сохраняет версию сообщения и сообщает, изменилось ли оно.
+// Изменением считается более позднее редактирование с другим документом или
+// текстом: апдейты редактирования приходят и при реакциях, и тогда ни дата,
+// ни содержимое не меняются. Для неизвестного сообщения changed равен true.
+func (s *processedStore) UpdateVersion(chatID int64, msgID int, v messageVersion) (changed bool, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(versionsBucket)
+		key := processedKey(chatID, msgID)
+		encoded := v.encode()
+		old := b.Get(key)
+		if len(old) != len(encoded) {
+			changed = true
+			return b.Put(key, encoded)
+		}
+		oldDate := int(binary.BigEndian.Uint64(old[:8]))
+		if v.EditDate <= oldDate {
+			return nil
+		}
+		changed = string(old[8:]) != string(encoded[8:])
+		return b.Put(key, encoded)
+	})
+	return changed, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestProcessedStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		reprocess bool
+		mark      [][2]int64 // отмеченные сообщения: чат и ID
+		chatID    int64
+		msgID     int
+		want      bool
+	}{
+		{name: "new message", chatID: 1, msgID: 10},
+		{name: "marked message", mark: [][2]int64{{1, 10}}, chatID: 1, msgID: 10, want: true},
+		{name: "same ID in another chat", mark: [][2]int64{{1, 10}}, chatID: 2, msgID: 10},
+		{name: "REPROCESS ignores marks", reprocess: true, mark: [][2]int64{{1, 10}}, chatID: 1, msgID: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newProcessedStore(testBolt(t), tt.reprocess)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range tt.mark {
+				if err := store.Mark(m[0], int(m[1])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			seen, err := store.Seen(tt.chatID, tt.msgID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen != tt.want {
+				t.Errorf("Seen(%d, %d) = %t, want %t", tt.chatID, tt.msgID, seen, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// Файлы не меньше этого размера скачиваются с выводом прогресса,
+// а в чат отправляется сообщение о начале обработки. Задаётся через PROGRESS_MIN_BYTES.
+var progressMinBytes int64 = 10 << 20
+
+const progressStepPercent = 10
+
+// progressWriter считает записанные байты и вызывает report каждые
+// progressStepPercent процентов от total.
+type progressWriter struct {
+	w      io.WriterAt
+	total  int64
+	report func(percent int)
+
+	mu       sync.Mutex
+	written  int64
+	reported int
+}
+
+func newProgressWriter(w io.WriterAt, total int64, report func(percent int)) *progressWriter {
+	return &progressWriter{w: w, total: total, report: report}
+}
+
+func (p *progressWriter) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.w.WriteAt(b, off)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written += int64(n)
+	if p.total > 0 {
+		percent := int(min(p.written*100/p.total, 100))
+		if step := percent - percent%progressStepPercent; step > p.reported {
+			p.reported = step
+			p.report(step)
+		}
+	}
+	return n, err
+}
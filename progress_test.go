@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// discardWriterAt принимает запись по смещению и ничего не хранит.
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(b []byte, _ int64) (int, error) { return len(b), nil }
+
+func TestProgressWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		total  int64
+		writes []int
+		want   []int
+	}{
+		{name: "every ten percent", total: 100, writes: []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 10}, want: []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}},
+		{name: "small writes are grouped", total: 100, writes: []int{3, 3, 3, 3, 3}, want: []int{10}},
+		{name: "large write skips steps", total: 100, writes: []int{55, 45}, want: []int{50, 100}},
+		{name: "overrun is capped", total: 10, writes: []int{20}, want: []int{100}},
+		{name: "unknown size", total: 0, writes: []int{10, 10}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			w := newProgressWriter(discardWriterAt{}, tt.total, func(percent int) {
+				got = append(got, percent)
+			})
+			var off int64
+			for _, n := range tt.writes {
+				if _, err := w.WriteAt(make([]byte, n), off); err != nil {
+					t.Fatal(err)
+				}
+				off += int64(n)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("reported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
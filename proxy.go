@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/telegram/dcs"
+	"golang.org/x/net/proxy"
+)
+
+// proxyDial возвращает функцию подключения к DC через прокси из PROXY_URL.
+// Поддерживаются socks5://, socks5h:// и http:// (через CONNECT).
+func proxyDial(rawURL string) (dcs.DialFunc, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse proxy url")
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("proxy url %q has no host", rawURL)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, errors.Wrap(err, "create socks5 dialer")
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, errors.Errorf("socks5 dialer does not support context")
+		}
+		return cd.DialContext, nil
+	case "http":
+		return httpConnectDialer{proxy: u}.DialContext, nil
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme %q: use socks5 or http", u.Scheme)
+	}
+}
+
+// httpConnectDialer устанавливает TCP-туннель через HTTP-прокси методом CONNECT.
+type httpConnectDialer struct {
+	proxy *url.URL
+}
+
+func (d httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, d.proxy.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial proxy")
+	}
+	// Ограничиваем рукопожатие с прокси контекстом
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "write connect request")
+	}
+
+	// Прокси ничего не отправляет после ответа, пока клиент не начнёт
+	// обмен MTProto, поэтому буферизированное чтение ничего не потеряет
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "read connect response")
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.Errorf("proxy connect failed: %s", resp.Status)
+	}
+	return conn, nil
+}
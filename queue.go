@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxWorkers      = 2
+	defaultShutdownTimeout = 30 * time.Second
+	jobQueueSize           = 100
+)
+
+var (
+	errQueueClosed = errors.New("job queue is closed")
+	errQueueFull   = errors.New("job queue is full")
+)
+
+// job выполняется воркером очереди. Контекст задачи не отменяется при
+// остановке приёма апдейтов, чтобы начатая обработка могла завершиться.
+type job func(ctx context.Context) error
+
+// Состояния задачи для команды /queue
+type jobState string
+
+const (
+	jobQueued  jobState = "queued"
+	jobRunning jobState = "running"
+)
+
+// queuedJob — задача в очереди с номером, по которому её можно отменить.
+type queuedJob struct {
+	id        int64
+	name      string
+	run       job
+	state     jobState
+	cancelled bool
+}
+
+// jobInfo описывает задачу для команды /queue.
+type jobInfo struct {
+	ID    int64
+	Name  string
+	State jobState
+}
+
+// jobQueue выполняет задачи в порядке поступления не более чем
+// в workers горутинах одновременно.
+type jobQueue struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	lg     *zap.Logger
+	mu     sync.Mutex
+	closed bool
+	jobs   chan *queuedJob
+	wg     sync.WaitGroup
+
+	// registry хранит ожидающие и выполняемые задачи в порядке поступления
+	registryMu sync.Mutex
+	nextID     int64
+	registry   []*queuedJob
+
+	// workers — нужное число воркеров, задаётся через SetWorkers; running —
+	// число запущенных. Лишние воркеры завершаются сами, когда освобождаются.
+	// resized закрывается при каждом изменении, чтобы разбудить свободных воркеров
+	resizeMu sync.Mutex
+	workers  int
+	running  int
+	resized  chan struct{}
+}
+
+func newJobQueue(workers int, lg *zap.Logger) *jobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &jobQueue{
+		ctx:     ctx,
+		cancel:  cancel,
+		lg:      lg,
+		jobs:    make(chan *queuedJob, jobQueueSize),
+		resized: make(chan struct{}),
+	}
+	q.SetWorkers(workers)
+	return q
+}
+
+// SetWorkers меняет число воркеров. Лишние воркеры завершаются после
+// текущей задачи, начатые задачи не прерываются.
+func (q *jobQueue) SetWorkers(n int) {
+	q.resizeMu.Lock()
+	defer q.resizeMu.Unlock()
+	q.workers = n
+	// Воркеры, которые ещё не успели завершиться после уменьшения, продолжают работу
+	for ; q.running < n; q.running++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	close(q.resized)
+	q.resized = make(chan struct{})
+}
+
+// idle вызывается свободным воркером. Возвращает false, если воркер лишний
+// и должен завершиться, иначе канал, который закроется при следующем изменении
+// числа воркеров.
+func (q *jobQueue) idle() (<-chan struct{}, bool) {
+	q.resizeMu.Lock()
+	defer q.resizeMu.Unlock()
+	if q.running > q.workers {
+		q.running--
+		return nil, false
+	}
+	return q.resized, true
+}
+
+// Workers возвращает текущее число воркеров.
+func (q *jobQueue) Workers() int {
+	q.resizeMu.Lock()
+	defer q.resizeMu.Unlock()
+	return q.workers
+}
+
+func (q *jobQueue) worker() {
+	defer q.wg.Done()
+	for {
+		resized, ok := q.idle()
+		if !ok {
+			return
+		}
+		select {
+		case <-resized:
+		case j, ok := <-q.jobs:
+			if !ok {
+				q.resizeMu.Lock()
+				q.running--
+				q.resizeMu.Unlock()
+				return
+			}
+			if !q.start(j) {
+				continue
+			}
+			if err := j.run(q.ctx); err != nil {
+				q.lg.Error("Job failed", zap.Int64("job_id", j.id), zap.Error(err))
+			}
+			q.remove(j.id)
+		}
+	}
+}
+
+// Enqueue ставит задачу в очередь под именем name, которое показывает /queue.
+// Если очередь заполнена, сразу возвращает errQueueFull: Enqueue вызывается
+// из обработчика апдейтов, и ожидание места остановило бы приём остальных.
+func (q *jobQueue) Enqueue(name string, j job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errQueueClosed
+	}
+
+	q.registryMu.Lock()
+	q.nextID++
+	qj := &queuedJob{id: q.nextID, name: name, run: j, state: jobQueued}
+	q.registry = append(q.registry, qj)
+	q.registryMu.Unlock()
+
+	select {
+	case q.jobs <- qj:
+		return nil
+	default:
+		q.remove(qj.id)
+		return errQueueFull
+	}
+}
+
+// start отмечает задачу выполняемой. Возвращает false, если задачу отменили,
+// пока она ждала в очереди.
+func (q *jobQueue) start(j *queuedJob) bool {
+	q.registryMu.Lock()
+	defer q.registryMu.Unlock()
+	if j.cancelled {
+		return false
+	}
+	j.state = jobRunning
+	return true
+}
+
+func (q *jobQueue) remove(id int64) {
+	q.registryMu.Lock()
+	defer q.registryMu.Unlock()
+	q.registry = slices.DeleteFunc(q.registry, func(j *queuedJob) bool { return j.id == id })
+}
+
+// Cancel убирает из очереди ожидающую задачу. Выполняемую задачу отменить
+// нельзя, для неё и для неизвестного id возвращается false.
+func (q *jobQueue) Cancel(id int64) bool {
+	q.registryMu.Lock()
+	defer q.registryMu.Unlock()
+	i := slices.IndexFunc(q.registry, func(j *queuedJob) bool { return j.id == id })
+	if i < 0 || q.registry[i].state != jobQueued {
+		return false
+	}
+	q.registry[i].cancelled = true
+	q.registry = slices.Delete(q.registry, i, i+1)
+	return true
+}
+
+// Jobs возвращает ожидающие и выполняемые задачи в порядке поступления.
+func (q *jobQueue) Jobs() []jobInfo {
+	q.registryMu.Lock()
+	defer q.registryMu.Unlock()
+	jobs := make([]jobInfo, 0, len(q.registry))
+	for _, j := range q.registry {
+		jobs = append(jobs, jobInfo{ID: j.id, Name: j.name, State: j.state})
+	}
+	return jobs
+}
+
+// Len возвращает число задач в очереди вместе с выполняемыми.
+func (q *jobQueue) Len() int {
+	q.registryMu.Lock()
+	defer q.registryMu.Unlock()
+	return len(q.registry)
+}
+
+// Shutdown перестаёт принимать новые задачи и ждёт выполнения уже принятых
+// не дольше timeout. По истечении времени отменяет контекст задач и ждёт,
+// пока они завершатся.
+func (q *jobQueue) Shutdown(timeout time.Duration) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-timer.C:
+		// Задачи прерываются по отмене контекста, дожидаемся их, чтобы после
+		// возврата никто не обращался к закрываемым базам
+		n := q.Len()
+		q.cancel()
+		<-done
+		return errors.Errorf("%d jobs did not finish within %s", n, timeout)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// concurrencyProbe считает одновременно выполняемые задачи.
+type concurrencyProbe struct {
+	running atomic.Int32
+	max     atomic.Int32
+	done    sync.WaitGroup
+}
+
+func (p *concurrencyProbe) job(ctx context.Context) error {
+	defer p.done.Done()
+	n := p.running.Add(1)
+	defer p.running.Add(-1)
+	for {
+		m := p.max.Load()
+		if n <= m || p.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func TestJobQueueLimitsWorkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		jobs    int
+	}{
+		{name: "single worker", workers: 1, jobs: 5},
+		{name: "two workers", workers: 2, jobs: 6},
+		{name: "more workers than jobs", workers: 4, jobs: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newJobQueue(tt.workers, zap.NewNop())
+			var p concurrencyProbe
+			p.done.Add(tt.jobs)
+			for range tt.jobs {
+				if err := q.Enqueue("job", p.job); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p.done.Wait()
+			if err := q.Shutdown(time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if got := int(p.max.Load()); got > tt.workers || got > tt.jobs {
+				t.Errorf("%d jobs ran concurrently, limit %d", got, tt.workers)
+			}
+			if err := q.Enqueue("late", p.job); err != errQueueClosed {
+				t.Errorf("Enqueue after Shutdown = %v, want %v", err, errQueueClosed)
+			}
+		})
+	}
+}
+
+func TestJobQueueShutdown(t *testing.T) {
+	tests := []struct {
+		name      string
+		jobTime   time.Duration
+		timeout   time.Duration
+		wantErr   bool
+		wantCtxOK bool // задача доработала, не получив отмену контекста
+	}{
+		{name: "waits for in-flight jobs", jobTime: 20 * time.Millisecond, timeout: time.Second, wantCtxOK: true},
+		{name: "cancels jobs after timeout", jobTime: time.Minute, timeout: 20 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newJobQueue(1, zap.NewNop())
+			started := make(chan struct{})
+			var finished atomic.Bool
+			var ctxOK atomic.Bool
+			err := q.Enqueue("slow", func(ctx context.Context) error {
+				close(started)
+				select {
+				case <-time.After(tt.jobTime):
+					ctxOK.Store(true)
+				case <-ctx.Done():
+				}
+				finished.Store(true)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-started
+
+			err = q.Shutdown(tt.timeout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Shutdown() = %v, want error %t", err, tt.wantErr)
+			}
+			// Shutdown возвращается только после завершения задач
+			if !finished.Load() {
+				t.Error("Shutdown returned before the job finished")
+			}
+			if ctxOK.Load() != tt.wantCtxOK {
+				t.Errorf("job completed without cancel = %t, want %t", ctxOK.Load(), tt.wantCtxOK)
+			}
+		})
+	}
+}
+
+func TestJobQueueLogsFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantLog bool
+	}{
+		{name: "failed job is logged", err: errors.New("convert: exit status 1"), wantLog: true},
+		{name: "successful job is not logged"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			q := newJobQueue(1, zap.New(core))
+			if err := q.Enqueue("job", func(context.Context) error { return tt.err }); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Shutdown(time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := logs.FilterMessage("Job failed").All()
+			if got := len(entries) > 0; got != tt.wantLog {
+				t.Fatalf("logged %d failures, want logged %t", len(entries), tt.wantLog)
+			}
+			if !tt.wantLog {
+				return
+			}
+			fields := entries[0].ContextMap()
+			if fields["job_id"] != int64(1) || fields["error"] != tt.err.Error() {
+				t.Errorf("log fields = %v", fields)
+			}
+		})
+	}
+}
+
+func TestJobQueueFull(t *testing.T) {
+	tests := []struct {
+		name    string
+		jobs    int
+		wantErr error
+	}{
+		{name: "fits into the buffer", jobs: jobQueueSize},
+		{name: "buffer is full", jobs: jobQueueSize + 1, wantErr: errQueueFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newJobQueue(1, zap.NewNop())
+			// Единственный воркер занят, остальные задачи ждут в буфере
+			started, release := make(chan struct{}), make(chan struct{})
+			if err := q.Enqueue("busy", func(context.Context) error {
+				close(started)
+				<-release
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+
+			var err error
+			for i := 0; i < tt.jobs && err == nil; i++ {
+				err = q.Enqueue("job", func(context.Context) error { return nil })
+			}
+			if err != tt.wantErr {
+				t.Errorf("Enqueue() = %v, want %v", err, tt.wantErr)
+			}
+			// Отклонённая задача не остаётся в /queue
+			if got := q.Len(); got != jobQueueSize+1 {
+				t.Errorf("Len() = %d, want %d", got, jobQueueSize+1)
+			}
+
+			close(release)
+			if err := q.Shutdown(time.Second); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
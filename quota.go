@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const quotaWindow = time.Hour
+
+const quotaExceededReply = "Превышен лимит конвертаций, попробуйте позже"
+
+// userQuota ограничивает число конвертаций одного пользователя за скользящее
+// окно window. Счётчики хранятся в памяти и сбрасываются при перезапуске.
+type userQuota struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	now    func() time.Time
+	hits   map[int64][]time.Time
+}
+
+// quota задаётся через USER_QUOTA, nil — без ограничения
+var quota *userQuota
+
+func newUserQuota(limit int, window time.Duration) *userQuota {
+	return &userQuota{
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+		hits:   map[int64][]time.Time{},
+	}
+}
+
+// Allow учитывает конвертацию пользователя userID. Возвращает false, если
+// за последнее окно лимит уже исчерпан; такая попытка не засчитывается.
+func (q *userQuota) Allow(userID int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	hits := q.hits[userID]
+	// Отметки идут по возрастанию, отбрасываем вышедшие из окна
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= q.window {
+		i++
+	}
+	hits = hits[i:]
+	if len(hits) >= q.limit {
+		q.hits[userID] = hits
+		return false
+	}
+	q.hits[userID] = append(hits, now)
+	return true
+}
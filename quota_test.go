@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestUserQuota(t *testing.T) {
+	const alice, bob = 1, 2
+	type step struct {
+		user    int64
+		advance time.Duration // сдвиг часов перед вызовом
+		want    bool
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		steps []step
+	}{
+		{name: "under quota", limit: 2, steps: []step{{user: alice, want: true}, {user: alice, want: true}}},
+		{name: "over quota", limit: 2, steps: []step{{user: alice, want: true}, {user: alice, want: true}, {user: alice}}},
+		{name: "users are counted separately", limit: 1, steps: []step{{user: alice, want: true}, {user: bob, want: true}, {user: alice}}},
+		{
+			name:  "rolling window",
+			limit: 2,
+			steps: []step{
+				{user: alice, want: true},
+				{user: alice, advance: 30 * time.Minute, want: true},
+				{user: alice, advance: 20 * time.Minute},
+				// Первая отметка вышла из окна, вторая ещё нет
+				{user: alice, advance: 10 * time.Minute, want: true},
+				{user: alice},
+			},
+		},
+		{
+			// Отказ не засчитывается и не продлевает ограничение
+			name:  "rejected attempts are not counted",
+			limit: 1,
+			steps: []step{
+				{user: alice, want: true},
+				{user: alice, advance: 59 * time.Minute},
+				{user: alice, advance: time.Minute, want: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			q := newUserQuota(tt.limit, time.Hour)
+			q.now = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				if got := q.Allow(s.user); got != s.want {
+					t.Errorf("step %d: Allow(%d) = %t, want %t", i+1, s.user, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		used     int // конвертаций пользователя в текущем окне
+		wantSent bool
+	}{
+		{name: "under quota", used: 1, wantSent: true},
+		{name: "over quota", used: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const user = 5
+			q := newUserQuota(2, time.Hour)
+			for range tt.used {
+				q.Allow(user)
+			}
+			setVar(t, &quota, q)
+			setFakeConverter(t)
+			hh := newHandlerHarness(t, &stubAPI{})
+			msg := hh.audioMessage(10, "audio/mpeg", "song.mp3")
+			msg.FromID = &tg.PeerUser{UserID: user}
+
+			hh.post(t, msg)
+
+			if tt.wantSent {
+				hh.checkVoiceSent(t, 10)
+				return
+			}
+			if len(hh.api.sentMedia) != 0 {
+				t.Errorf("sent %d media, want none", len(hh.api.sentMedia))
+			}
+			if len(hh.api.sentMessages) != 1 || hh.api.sentMessages[0].Message != quotaExceededReply {
+				t.Errorf("replies = %v, want %q", hh.api.sentMessages, quotaExceededReply)
+			}
+		})
+	}
+}
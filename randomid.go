@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// sendSalt отличает RandomID разных запусков бота, а sendSeq — разных
+// отправок в одном запуске. Поэтому после перезапуска, /reprocess и ON_EDIT
+// голосовое отправляется заново, а повторы одной отправки Telegram
+// отбрасывает как дубликаты.
+var (
+	sendSalt = newSendSalt()
+	sendSeq  atomic.Int64
+)
+
+func newSendSalt() (salt [16]byte) {
+	// rand.Read не возвращает ошибок
+	_, _ = rand.Read(salt[:])
+	return salt
+}
+
+// nextSendRandomID возвращает RandomID для новой отправки результата
+// документа docID из сообщения msgID чата chatID.
+func nextSendRandomID(chatID int64, msgID int, docID int64) int64 {
+	return sendRandomID(sendSalt, chatID, msgID, docID, sendSeq.Add(1))
+}
+
+// sendRandomID выводит RandomID из соли запуска, источника и номера отправки.
+// Telegram не публикует второе сообщение с тем же RandomID, поэтому повтор
+// после неоднозначной ошибки, например обрыва связи после отправки, не создаст дубль.
+func sendRandomID(salt [16]byte, chatID int64, msgID int, docID, seq int64) int64 {
+	var b [48]byte
+	copy(b[:16], salt[:])
+	binary.BigEndian.PutUint64(b[16:24], uint64(chatID))
+	binary.BigEndian.PutUint64(b[24:32], uint64(msgID))
+	binary.BigEndian.PutUint64(b[32:40], uint64(docID))
+	binary.BigEndian.PutUint64(b[40:48], uint64(seq))
+	sum := sha256.Sum256(b[:])
+	// RandomID не должен быть нулём, иначе sendMedia сгенерирует случайный
+	id := int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
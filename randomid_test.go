@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+func TestSendRandomID(t *testing.T) {
+	salt := [16]byte{1, 2, 3}
+	base := sendRandomID(salt, 100, 5, 7, 1)
+
+	tests := []struct {
+		name     string
+		salt     [16]byte
+		chatID   int64
+		msgID    int
+		docID    int64
+		seq      int64
+		wantSame bool
+	}{
+		{name: "same send", salt: salt, chatID: 100, msgID: 5, docID: 7, seq: 1, wantSame: true},
+		{name: "next send", salt: salt, chatID: 100, msgID: 5, docID: 7, seq: 2},
+		{name: "other run", salt: [16]byte{4}, chatID: 100, msgID: 5, docID: 7, seq: 1},
+		{name: "other chat", salt: salt, chatID: 101, msgID: 5, docID: 7, seq: 1},
+		{name: "other message", salt: salt, chatID: 100, msgID: 6, docID: 7, seq: 1},
+		{name: "other document", salt: salt, chatID: 100, msgID: 5, docID: 8, seq: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sendRandomID(tt.salt, tt.chatID, tt.msgID, tt.docID, tt.seq)
+			if got <= 0 {
+				t.Errorf("sendRandomID() = %d, want positive", got)
+			}
+			if (got == base) != tt.wantSame {
+				t.Errorf("sendRandomID() = %d, base %d, want same %t", got, base, tt.wantSame)
+			}
+		})
+	}
+}
+
+// flakySendAPI отвечает временной ошибкой на первые failures отправок и
+// запоминает RandomID каждой попытки.
+type flakySendAPI struct {
+	*stubAPI
+	failures  int
+	randomIDs []int64
+}
+
+func (f *flakySendAPI) MessagesSendMedia(ctx context.Context, req *tg.MessagesSendMediaRequest) (tg.UpdatesClass, error) {
+	f.randomIDs = append(f.randomIDs, req.RandomID)
+	if len(f.randomIDs) <= f.failures {
+		return nil, tgerr.New(500, "INTERNAL")
+	}
+	return f.stubAPI.MessagesSendMedia(ctx, req)
+}
+
+func TestSendMediaReusesRandomID(t *testing.T) {
+	setRetryDelay(t, time.Millisecond)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name     string
+		randomID int64
+		failures int
+	}{
+		{name: "derived id", randomID: nextSendRandomID(1, 5, 7), failures: 2},
+		// Без заданного RandomID случайный выбирается один раз на отправку
+		{name: "random id", failures: 1},
+		{name: "first attempt succeeds", randomID: 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &flakySendAPI{stubAPI: &stubAPI{}, failures: tt.failures}
+			media := &tg.InputMediaDocument{ID: &tg.InputDocument{ID: 7}}
+
+			if err := sendMedia(context.Background(), api, peer, media, voiceOptions{RandomID: tt.randomID}); err != nil {
+				t.Fatal(err)
+			}
+			if len(api.randomIDs) != tt.failures+1 {
+				t.Fatalf("sent %d times, want %d", len(api.randomIDs), tt.failures+1)
+			}
+			for i, id := range api.randomIDs {
+				if id != api.randomIDs[0] {
+					t.Errorf("attempt %d RandomID = %d, first %d", i+1, id, api.randomIDs[0])
+				}
+			}
+			if tt.randomID != 0 && api.randomIDs[0] != tt.randomID {
+				t.Errorf("RandomID = %d, want %d", api.randomIDs[0], tt.randomID)
+			}
+		})
+	}
+}
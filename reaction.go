@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+)
+
+// Реакции на исходное сообщение вместо текстовых ответов о ходе обработки
+const (
+	reactionProcessing = "⏳"
+	reactionDone       = "👍"
+)
+
+// reactToSource включается через REACT_TO_SOURCE
+var reactToSource bool
+
+// sendReaction ставит реакцию emoji на сообщение msgID. Пустой emoji снимает реакцию.
+func sendReaction(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msgID int, emoji string) error {
+	req := &tg.MessagesSendReactionRequest{
+		Peer:  peer,
+		MsgID: msgID,
+	}
+	if emoji != "" {
+		req.Reaction = []tg.ReactionClass{&tg.ReactionEmoji{Emoticon: emoji}}
+	}
+	if _, err := api.MessagesSendReaction(ctx, req); err != nil {
+		return errors.Wrap(err, "send reaction")
+	}
+	return nil
+}
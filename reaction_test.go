@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestProcessAudioReactions(t *testing.T) {
+	setFakeConverter(t)
+	setOggCache(t)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		ffmpeg  string
+		want    []string
+	}{
+		{name: "disabled"},
+		{name: "success", enabled: true, want: []string{reactionProcessing, reactionDone}},
+		// При ошибке ⏳ снимается, чтобы не висеть на сообщении
+		{name: "failure", enabled: true, ffmpeg: "exit 1", want: []string{reactionProcessing, ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &reactToSource, tt.enabled)
+			if tt.ffmpeg != "" {
+				setFFmpeg(t, tt.ffmpeg)
+			}
+			doc, content := testAudio("audio/mpeg", "song.mp3")
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			_ = processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files)
+			if !slices.Equal(api.reactions, tt.want) {
+				t.Errorf("reactions = %q, want %q", api.reactions, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendReaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		emoji string
+	}{
+		{name: "set", emoji: reactionDone},
+		{name: "remove", emoji: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{}
+			if err := sendReaction(context.Background(), api, &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}, 10, tt.emoji); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(api.reactions, []string{tt.emoji}) {
+				t.Errorf("reactions = %q, want %q", api.reactions, tt.emoji)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tgerr"
+	"go.uber.org/zap"
+)
+
+const reconnectMaxDelay = 5 * time.Minute
+
+// reconnectBaseDelay — пауза перед первым переподключением
+var reconnectBaseDelay = time.Second
+
+// reconnect перезапускает run, пока он завершается ошибкой соединения, с
+// экспоненциально растущей паузой. Цикл останавливается при отмене ctx,
+// успешном завершении run или постоянной ошибке, например неверной авторизации.
+// FLOOD_WAIT не считается постоянной ошибкой: перед переподключением бот
+// выжидает указанное Telegram время.
+func reconnect(ctx context.Context, lg *zap.Logger, run func() error) error {
+	delay := reconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		err := run()
+		wait, floodWait := tgerr.AsFloodWait(err)
+		if err == nil || ctx.Err() != nil || (isPermanentError(err) && !floodWait) {
+			return err
+		}
+
+		// Соединение долго работало, значит следующая попытка снова начинается с короткой паузы
+		if time.Since(started) > reconnectMaxDelay {
+			delay = reconnectBaseDelay
+		}
+		if !floodWait {
+			wait = delay
+			delay = min(delay*2, reconnectMaxDelay)
+		}
+		lg.Warn("Connection lost, reconnecting",
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", wait),
+			zap.Bool("flood_wait", floodWait),
+			zap.Error(err),
+		)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// errNotConnected возвращается на запросы, отправленные до первого подключения.
+var errNotConnected = errors.New("client is not connected")
+
+// clientInvoker передаёт запросы клиенту текущего подключения. API, которым
+// пользуются обработчик и задачи очереди, создаётся один раз, а клиент
+// при каждом переподключении новый.
+type clientInvoker struct {
+	current atomic.Pointer[telegram.Client]
+}
+
+func (c *clientInvoker) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	client := c.current.Load()
+	if client == nil {
+		return errNotConnected
+	}
+	return client.Invoke(ctx, input, output)
+}
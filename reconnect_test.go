@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestReconnect(t *testing.T) {
+	setVar(t, &reconnectBaseDelay, time.Millisecond)
+	dropped := errors.Wrap(io.EOF, "read")
+	authErr := tgerr.New(401, "AUTH_KEY_UNREGISTERED")
+
+	tests := []struct {
+		name      string
+		errs      []error // результаты run по попыткам, дальше nil
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "clean exit", wantCalls: 1},
+		{name: "reconnects after dropped connection", errs: []error{dropped, dropped}, wantCalls: 3},
+		{name: "permanent error stops the loop", errs: []error{dropped, authErr}, wantCalls: 2, wantErr: authErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := reconnect(context.Background(), zap.NewNop(), func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("reconnect() = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("run called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReconnectStopsOnCancel(t *testing.T) {
+	setVar(t, &reconnectBaseDelay, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	dropped := errors.Wrap(io.EOF, "read")
+	calls := 0
+	err := reconnect(ctx, zap.NewNop(), func() error {
+		calls++
+		cancel()
+		return dropped
+	})
+	if err != dropped || calls != 1 {
+		t.Errorf("reconnect() = %v after %d calls, want %v after 1", err, calls, dropped)
+	}
+}
+
+func TestReconnectFloodWait(t *testing.T) {
+	// С обычной паузой тест ждал бы час, FLOOD_WAIT_0 позволяет переподключиться сразу
+	setVar(t, &reconnectBaseDelay, time.Hour)
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{name: "flood wait", err: tgerr.New(420, "FLOOD_WAIT_0"), wantCalls: 2},
+		{name: "premium flood wait", err: tgerr.New(420, "FLOOD_PREMIUM_WAIT_0"), wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			calls := 0
+			err := reconnect(context.Background(), zap.New(core), func() error {
+				calls++
+				if calls == 1 {
+					return tt.err
+				}
+				return nil
+			})
+			if err != nil || calls != tt.wantCalls {
+				t.Fatalf("reconnect() = %v after %d calls, want nil after %d", err, calls, tt.wantCalls)
+			}
+			entries := logs.FilterMessage("Connection lost, reconnecting").All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d reconnects, want 1", len(entries))
+			}
+			if fields := entries[0].ContextMap(); fields["delay"] != time.Duration(0) || fields["flood_wait"] != true {
+				t.Errorf("log fields = %v", fields)
+			}
+		})
+	}
+}
+
+func TestClientInvokerNotConnected(t *testing.T) {
+	api := tg.NewClient(&clientInvoker{})
+	if _, err := api.UpdatesGetState(context.Background()); !errors.Is(err, errNotConnected) {
+		t.Errorf("UpdatesGetState() error = %v, want %v", err, errNotConnected)
+	}
+}
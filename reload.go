@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gotd/td/tg"
+)
+
+// isAdmin сообщает, что отправитель может выполнять административные команды.
+// Такие команды доступны только при заданном ALLOWED_USERS.
+func isAdmin(msg *tg.Message) bool {
+	return len(allowedUsers) > 0 && isAllowedSender(messageSender(msg))
+}
+
+// handleReload заново читает настройки из тех же источников, что и при запуске,
+// и применяет изменяемые на лету: параметры кодирования и число воркеров.
+// Остальные настройки требуют перезапуска.
+func handleReload(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, queue *jobQueue, configs *configSource) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	cfg, err := configs.Load()
+	if err != nil {
+		return sendMessage(ctx, api, peer, "Reload failed:\n"+err.Error(), msg.ID)
+	}
+
+	setOpusOptions(cfg.Opus)
+	queue.SetWorkers(cfg.MaxWorkers)
+
+	opts := currentOpusOptions()
+	bitrate := opts.Bitrate
+	if bitrate == "" {
+		bitrate = "default"
+	}
+	return sendMessage(ctx, api, peer, fmt.Sprintf("Reloaded\nBitrate: %s\nNormalize: %t\nWorkers: %d",
+		bitrate, opts.Normalize, queue.Workers()), msg.ID)
+}
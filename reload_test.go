@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestHandleReload(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	const admin = 10
+
+	tests := []struct {
+		name          string
+		from          int64
+		env           map[string]string
+		startupDotenv string // содержимое .env при запуске
+		dotenv        string // содержимое .env к моменту /reload
+		configFile    string // содержимое файла из -config
+		wantReply     string
+		wantBitrate   string
+		wantWorkers   int
+	}{
+		{
+			name:        "apply env",
+			from:        admin,
+			env:         map[string]string{"OPUS_BITRATE": "32k", "NORMALIZE_AUDIO": "true", "MAX_WORKERS": "2"},
+			wantReply:   "Reloaded\nBitrate: 32k\nNormalize: true\nWorkers: 2",
+			wantBitrate: "32k",
+			wantWorkers: 2,
+		},
+		{
+			name:        "env overrides .env",
+			from:        admin,
+			env:         map[string]string{"OPUS_BITRATE": "32k"},
+			dotenv:      "OPUS_BITRATE=48k\nMAX_WORKERS=3\n",
+			wantReply:   "Reloaded\nBitrate: 32k\nNormalize: false\nWorkers: 3",
+			wantBitrate: "32k",
+			wantWorkers: 3,
+		},
+		{
+			name:          "changed .env is applied",
+			from:          admin,
+			startupDotenv: "OPUS_BITRATE=48k\nMAX_WORKERS=3\n",
+			dotenv:        "MAX_WORKERS=2\n",
+			wantReply:     "Reloaded\nBitrate: default\nNormalize: false\nWorkers: 2",
+			wantWorkers:   2,
+		},
+		{
+			name:        ".env overrides config file",
+			from:        admin,
+			dotenv:      "MAX_WORKERS=3\n",
+			configFile:  "OPUS_BITRATE: 64k\nMAX_WORKERS: 2\n",
+			wantReply:   "Reloaded\nBitrate: 64k\nNormalize: false\nWorkers: 3",
+			wantBitrate: "64k",
+			wantWorkers: 3,
+		},
+		{
+			name:        "invalid config keeps settings",
+			from:        admin,
+			dotenv:      "MAX_WORKERS=0\n",
+			wantReply:   "Reload failed:\ninvalid config:\n  - MAX_WORKERS must be positive, got 0",
+			wantBitrate: "24k",
+			wantWorkers: 4,
+		},
+		{
+			name:        "not an admin",
+			from:        admin + 1,
+			env:         map[string]string{"OPUS_BITRATE": "32k", "MAX_WORKERS": "2"},
+			wantBitrate: "24k",
+			wantWorkers: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOpusSettings(t, OpusOptions{Bitrate: "24k"})
+			setVar(t, &allowedUsers, map[int64]struct{}{admin: {}})
+			setRequiredEnv(t)
+			// Значения из .env и файла попадают в окружение, t.Setenv восстановит его после теста
+			for _, key := range []string{"OPUS_BITRATE", "NORMALIZE_AUDIO", "MAX_WORKERS"} {
+				t.Setenv(key, "")
+				if v, ok := tt.env[key]; ok {
+					t.Setenv(key, v)
+				} else {
+					_ = os.Unsetenv(key)
+				}
+			}
+			dir := t.TempDir()
+			t.Chdir(dir)
+			writeFile := func(name, content string) {
+				if content == "" {
+					_ = os.Remove(filepath.Join(dir, name))
+					return
+				}
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var configPath string
+			if tt.configFile != "" {
+				configPath = filepath.Join(dir, "config.yaml")
+				writeFile("config.yaml", tt.configFile)
+			}
+			// Запуск бота читает настройки до изменения .env
+			writeFile(".env", tt.startupDotenv)
+			configs := newConfigSource(configPath)
+			if _, err := configs.Load(); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(".env", tt.dotenv)
+
+			queue := newJobQueue(4, zap.NewNop())
+			t.Cleanup(func() { _ = queue.Shutdown(time.Second) })
+			api := &stubAPI{}
+			msg := &tg.Message{ID: 5, FromID: &tg.PeerUser{UserID: tt.from}}
+
+			if err := handleReload(context.Background(), api, peer, msg, queue, configs); err != nil {
+				t.Fatal(err)
+			}
+			var reply string
+			if len(api.sentMessages) > 0 {
+				reply = api.sentMessages[0].Message
+			}
+			if reply != tt.wantReply {
+				t.Errorf("reply = %q, want %q", reply, tt.wantReply)
+			}
+			if got := currentOpusOptions().Bitrate; got != tt.wantBitrate {
+				t.Errorf("bitrate = %q, want %q", got, tt.wantBitrate)
+			}
+			if got := queue.Workers(); got != tt.wantWorkers {
+				t.Errorf("workers = %d, want %d", got, tt.wantWorkers)
+			}
+		})
+	}
+}
+
+// TestJobQueueSetWorkers проверяет, что после изменения числа воркеров
+// одновременно выполняется ровно столько задач, сколько задано.
+func TestJobQueueSetWorkers(t *testing.T) {
+	q := newJobQueue(4, zap.NewNop())
+	defer func() { _ = q.Shutdown(time.Second) }()
+
+	for _, workers := range []int{2, 4, 1} {
+		q.SetWorkers(workers)
+		waitRunning(t, q, workers)
+		started := make(chan struct{}, workers+1)
+		release := make(chan struct{})
+		job := func(context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}
+		// Одна задача сверх лимита должна ждать в очереди
+		for range workers + 1 {
+			if err := q.Enqueue("job", job); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range workers {
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("workers = %d: only %d jobs started", workers, i)
+			}
+		}
+		select {
+		case <-started:
+			t.Fatalf("workers = %d: more jobs started than workers", workers)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		<-started
+	}
+}
+
+// waitRunning ждёт, пока лишние воркеры завершатся и их останется n.
+func waitRunning(t *testing.T, q *jobQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.resizeMu.Lock()
+		running := q.running
+		q.resizeMu.Unlock()
+		if running == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers running, want %d", running, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
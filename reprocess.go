@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+const (
+	// Максимальное число файлов для /reprocess за один раз
+	reprocessMaxCount = 20
+	// Сколько последних сообщений просматривать в поисках аудио
+	reprocessScanLimit = 500
+	historyPageSize    = 100
+)
+
+// parseReprocessCount разбирает аргумент команды /reprocess N.
+func parseReprocessCount(args string) (int, error) {
+	if args == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 1 {
+		return 0, errors.Errorf("N must be a positive integer, got %q", args)
+	}
+	if n > reprocessMaxCount {
+		return 0, errors.Errorf("N must not exceed %d, got %d", reprocessMaxCount, n)
+	}
+	return n, nil
+}
+
+// audioMessage — сообщение с аудиофайлом, найденное в истории чата.
+type audioMessage struct {
+	msgID int
+	doc   *tg.Document
+}
+
+// recentAudio листает историю рабочего чата от новых сообщений к старым
+// и возвращает до n последних аудиофайлов. Сообщение before не учитывается.
+func recentAudio(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, before, n int) ([]audioMessage, error) {
+	var (
+		found    []audioMessage
+		offsetID = before
+		scanned  int
+	)
+	for len(found) < n && scanned < reprocessScanLimit {
+		resp, err := api.MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+			Peer:     peer,
+			OffsetID: offsetID,
+			Limit:    historyPageSize,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "get history")
+		}
+		messages, err := responseMessages(resp)
+		if err != nil {
+			return nil, errors.Wrap(err, "get history")
+		}
+		if len(messages) == 0 {
+			break
+		}
+
+		found = appendAudio(found, messages, n)
+		scanned += len(messages)
+		offsetID = messages[len(messages)-1].GetID()
+	}
+	return found, nil
+}
+
+// appendAudio добавляет к found аудиофайлы из страницы истории, пока их меньше n.
+func appendAudio(found []audioMessage, messages []tg.MessageClass, n int) []audioMessage {
+	for _, m := range messages {
+		if len(found) >= n {
+			break
+		}
+		msg, ok := m.(*tg.Message)
+		if !ok {
+			continue
+		}
+		media, ok := msg.Media.(*tg.MessageMediaDocument)
+		if !ok {
+			continue
+		}
+		if doc, ok := media.Document.(*tg.Document); ok && isConvertible(doc) {
+			found = append(found, audioMessage{msgID: msg.ID, doc: doc})
+		}
+	}
+	return found
+}
+
+// handleReprocess ставит в очередь повторную обработку последних N аудиофайлов.
+// Команда доступна только администраторам: она ставит в очередь до
+// reprocessMaxCount файлов в обход квоты.
+func handleReprocess(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, args string, files fileOptions, queue *jobQueue, processed *processedStore) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	n, err := parseReprocessCount(args)
+	if err != nil {
+		return sendMessage(ctx, api, peer, "Usage: /reprocess N\n"+err.Error(), msg.ID)
+	}
+	found, err := recentAudio(ctx, api, peer, msg.ID, n)
+	if err != nil {
+		return errors.Wrap(err, "find recent audio")
+	}
+	for _, a := range found {
+		if err := enqueueAudio(lg, api, peer, a.msgID, a.doc, time.Time{}, files, queue, processed); err != nil {
+			return err
+		}
+	}
+	return sendMessage(ctx, api, peer, fmt.Sprintf("Повторно обрабатываю файлов: %d", len(found)), msg.ID)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestParseReprocessCount(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    int
+		wantErr bool
+	}{
+		{args: "", want: 1},
+		{args: "5", want: 5},
+		{args: "20", want: 20},
+		{args: "21", wantErr: true},
+		{args: "0", wantErr: true},
+		{args: "-3", wantErr: true},
+		{args: "all", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseReprocessCount(tt.args)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseReprocessCount(%q) = %d, %v, want %d, error %t", tt.args, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// documentMessageOf возвращает сообщение id с документом doc.
+func documentMessageOf(id int, doc *tg.Document) *tg.Message {
+	return &tg.Message{ID: id, Media: &tg.MessageMediaDocument{Document: doc}}
+}
+
+func TestAppendAudio(t *testing.T) {
+	mp3 := testDocument("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{Duration: 180})
+	page := []tg.MessageClass{
+		documentMessageOf(5, mp3),
+		&tg.Message{ID: 4, Message: "text"},
+		documentMessageOf(3, testDocument("application/pdf", "doc.pdf")),
+		&tg.MessageService{ID: 2},
+		documentMessageOf(1, mp3),
+	}
+
+	tests := []struct {
+		name  string
+		found []audioMessage
+		n     int
+		want  []int
+	}{
+		{name: "all audio from page", n: 10, want: []int{5, 1}},
+		{name: "stops at n", n: 1, want: []int{5}},
+		{name: "continues previous page", found: []audioMessage{{msgID: 9}}, n: 2, want: []int{9, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appendAudio(tt.found, page, tt.n)
+			var ids []int
+			for _, a := range got {
+				ids = append(ids, a.msgID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("appendAudio() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleReprocessRequiresAdmin(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name      string
+		allowed   map[int64]struct{}
+		from      int64
+		args      string
+		wantReply string
+	}{
+		{name: "no admins configured", from: 1, args: "5"},
+		{name: "not an admin", allowed: map[int64]struct{}{1: {}}, from: 2, args: "5"},
+		{name: "admin with invalid N", allowed: map[int64]struct{}{1: {}}, from: 1, args: "all", wantReply: "Usage: /reprocess N"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &allowedUsers, tt.allowed)
+			api := &stubAPI{}
+			msg := &tg.Message{ID: 10, FromID: &tg.PeerUser{UserID: tt.from}}
+
+			err := handleReprocess(context.Background(), zap.NewNop(), api, peer, msg, tt.args, fileOptions{}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantReply == "" {
+				if len(api.calls) != 0 {
+					t.Errorf("non-admin command made requests %v", api.calls)
+				}
+				return
+			}
+			if len(api.sentMessages) != 1 || !strings.HasPrefix(api.sentMessages[0].Message, tt.wantReply) {
+				t.Errorf("replies %v, want %q", api.sentMessages, tt.wantReply)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"go.uber.org/zap"
+)
+
+const retryAttempts = 3
+
+// retryBaseDelay — пауза перед вторым вызовом, дальше она удваивается
+var retryBaseDelay = time.Second
+
+// retryJitter — доля случайного разброса паузы между попытками, задаётся через
+// RETRY_JITTER. При 0.5 пауза в 2s превращается в случайную от 1s до 3s, чтобы
+// задачи, упавшие во время flood wait, не повторялись одновременно.
+var retryJitter = 0.5
+
+// Повторы запроса сообщения, на которое ответили, задаются через
+// GET_MESSAGE_ATTEMPTS и GET_MESSAGE_DELAY
+var (
+	getMessageAttempts = 3
+	getMessageDelay    = 500 * time.Millisecond
+)
+
+// errMessageNotFound означает, что Telegram не вернул запрошенное сообщение.
+var errMessageNotFound = errors.New("message not found")
+
+// retry вызывает fn до n раз с экспоненциально растущей паузой между попытками.
+// Постоянные ошибки не повторяются.
+func retry(ctx context.Context, n int, fn func(ctx context.Context) error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= n || !classifyError(err).retryable() {
+			return err
+		}
+
+		timer := time.NewTimer(jitterDelay(delay, retryJitter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrap(ctx.Err(), err.Error())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// jitterDelay случайно сдвигает d в пределах ±jitter·d.
+func jitterDelay(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 - jitter + 2*jitter*rand.Float64()))
+}
+
+// errorAction описывает, как поступить с ошибкой запроса.
+type errorAction int
+
+const (
+	// actionRetry — временная ошибка сервера или сети, запрос можно повторить
+	actionRetry errorAction = iota
+	// actionFail — повтор не поможет, например FILE_REFERENCE_EXPIRED
+	// требует заново получить документ
+	actionFail
+	// actionFloodWait — FLOOD_WAIT или FLOOD_PREMIUM_WAIT. Паузу выдерживает
+	// middleware floodwait, и до retry такая ошибка доходит, только когда
+	// лимит ожидания исчерпан
+	actionFloodWait
+	// actionMigrate — запрос нужно выполнить в другом DC. Клиент переключается
+	// сам, поэтому после такой ошибки запрос повторяется
+	actionMigrate
+)
+
+// retryable сообщает, что retry стоит повторить запрос.
+func (a errorAction) retryable() bool {
+	return a == actionRetry || a == actionMigrate
+}
+
+// classifyError выбирает действие для ошибки: отмена контекста и ответы
+// Telegram с кодом ниже 500 постоянны, кроме миграции между DC.
+func classifyError(err error) errorAction {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return actionFail
+	}
+	// Повторное скачивание не уменьшит файл
+	if errors.Is(err, errFileTooLarge) {
+		return actionFail
+	}
+	if tgerr.Is(err, tgerr.FloodWaitErrors...) {
+		return actionFloodWait
+	}
+	if rpcErr, ok := tgerr.As(err); ok {
+		if strings.HasSuffix(rpcErr.Type, "_MIGRATE") {
+			return actionMigrate
+		}
+		if rpcErr.Code < 500 {
+			return actionFail
+		}
+	}
+	return actionRetry
+}
+
+// isPermanentError сообщает, что повтор запроса не поможет.
+func isPermanentError(err error) bool {
+	return !classifyError(err).retryable()
+}
+
+// errorLogger пишет в лог ошибки, которые требуют отдельного внимания:
+// FLOOD_PREMIUM_WAIT, которым Telegram ограничивает скорость файлов для
+// аккаунтов без Premium, и миграцию DC, которую клиент не смог выполнить сам.
+// Стоит после floodwait, поэтому видит каждую ошибку до повторов.
+func errorLogger(lg *zap.Logger) telegram.Middleware {
+	return telegram.MiddlewareFunc(func(next tg.Invoker) telegram.InvokeFunc {
+		return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+			err := next.Invoke(ctx, input, output)
+			if err == nil {
+				return nil
+			}
+			switch {
+			case tgerr.Is(err, tgerr.ErrPremiumFloodWait):
+				d, _ := tgerr.AsFloodWait(err)
+				lg.Warn("Premium flood wait, file transfer is throttled", zap.Duration("wait", d))
+			case classifyError(err) == actionMigrate:
+				lg.Warn("DC migration", zap.Error(err))
+			}
+			return err
+		}
+	})
+}
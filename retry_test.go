@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tgerr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// setRetryDelay сокращает паузы retry до конца теста.
+func setRetryDelay(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := retryBaseDelay
+	retryBaseDelay = d
+	t.Cleanup(func() { retryBaseDelay = old })
+}
+
+func TestRetry(t *testing.T) {
+	setRetryDelay(t, time.Millisecond)
+	transient := tgerr.New(500, "INTERNAL")
+	permanent := tgerr.New(400, "PEER_ID_INVALID")
+
+	tests := []struct {
+		name      string
+		errs      []error // ответы по попыткам, дальше nil
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "transient then success", errs: []error{transient}, wantCalls: 2},
+		{name: "transient exhausts attempts", errs: []error{transient, transient, transient}, wantCalls: 3, wantErr: transient},
+		{name: "permanent is not retried", errs: []error{permanent}, wantCalls: 1, wantErr: permanent},
+		{name: "network error is retried", errs: []error{errors.New("connection reset")}, wantCalls: 2},
+		{name: "migration is retried", errs: []error{tgerr.New(303, "FILE_MIGRATE_4")}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry(context.Background(), retryAttempts, func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("retry() = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	setRetryDelay(t, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := retry(ctx, retryAttempts, func(context.Context) error {
+		calls++
+		cancel()
+		return tgerr.New(500, "INTERNAL")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("retry() = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+}
+
+func TestJitterDelay(t *testing.T) {
+	const d = 2 * time.Second
+	tests := []struct {
+		name     string
+		jitter   float64
+		min, max time.Duration
+	}{
+		{name: "disabled", jitter: 0, min: d, max: d},
+		{name: "negative is disabled", jitter: -1, min: d, max: d},
+		{name: "half", jitter: 0.5, min: time.Second, max: 3 * time.Second},
+		{name: "tenth", jitter: 0.1, min: 1800 * time.Millisecond, max: 2200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spread := map[time.Duration]bool{}
+			for range 1000 {
+				got := jitterDelay(d, tt.jitter)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("jitterDelay(%s, %g) = %s, want within [%s, %s]", d, tt.jitter, got, tt.min, tt.max)
+				}
+				spread[got] = true
+			}
+			// С разбросом паузы не должны совпадать
+			if tt.min != tt.max && len(spread) < 100 {
+				t.Errorf("only %d distinct delays out of 1000", len(spread))
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorAction
+	}{
+		{name: "flood wait", err: tgerr.New(420, "FLOOD_WAIT_30"), want: actionFloodWait},
+		{name: "premium flood wait", err: tgerr.New(420, "FLOOD_PREMIUM_WAIT_5"), want: actionFloodWait},
+		{name: "file migrate", err: tgerr.New(303, "FILE_MIGRATE_4"), want: actionMigrate},
+		{name: "network migrate", err: tgerr.New(303, "NETWORK_MIGRATE_2"), want: actionMigrate},
+		{name: "wrapped migrate", err: errors.Wrap(tgerr.New(303, "USER_MIGRATE_2"), "send"), want: actionMigrate},
+		{name: "file reference expired", err: tgerr.New(400, "FILE_REFERENCE_EXPIRED"), want: actionFail},
+		{name: "forbidden", err: tgerr.New(403, "CHAT_WRITE_FORBIDDEN"), want: actionFail},
+		{name: "server error", err: tgerr.New(500, "INTERNAL"), want: actionRetry},
+		{name: "network error", err: errors.New("connection reset"), want: actionRetry},
+		{name: "canceled", err: errors.Wrap(context.Canceled, "download"), want: actionFail},
+		{name: "deadline", err: context.DeadlineExceeded, want: actionFail},
+		{name: "file too large", err: errors.Wrap(errFileTooLarge, "download"), want: actionFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(tt.err)
+			if got != tt.want {
+				t.Errorf("classifyError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+			// Повторяются только временные ошибки и миграция DC
+			wantRetry := tt.want == actionRetry || tt.want == actionMigrate
+			if got.retryable() != wantRetry || isPermanentError(tt.err) == wantRetry {
+				t.Errorf("retryable = %t, want %t", got.retryable(), wantRetry)
+			}
+		})
+	}
+}
+
+func TestErrorLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantLog string
+	}{
+		{name: "success"},
+		{name: "premium flood wait", err: tgerr.New(420, "FLOOD_PREMIUM_WAIT_5"), wantLog: "Premium flood wait, file transfer is throttled"},
+		{name: "migration", err: tgerr.New(303, "FILE_MIGRATE_4"), wantLog: "DC migration"},
+		{name: "plain flood wait is handled by floodwait", err: tgerr.New(420, "FLOOD_WAIT_5")},
+		{name: "other error", err: tgerr.New(400, "PEER_ID_INVALID")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			next := telegram.InvokeFunc(func(context.Context, bin.Encoder, bin.Decoder) error { return tt.err })
+
+			err := errorLogger(zap.New(core)).Handle(next).Invoke(context.Background(), nil, nil)
+			if err != tt.err {
+				t.Errorf("Invoke() = %v, want %v", err, tt.err)
+			}
+			var got []string
+			for _, e := range logs.All() {
+				got = append(got, e.Message)
+			}
+			if tt.wantLog == "" && len(got) != 0 || tt.wantLog != "" && (len(got) != 1 || got[0] != tt.wantLog) {
+				t.Errorf("logged %q, want %q", got, tt.wantLog)
+			}
+		})
+	}
+}
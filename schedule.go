@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// parseScheduleTime разбирает время вида "18:00" как ближайшее сегодняшнее
+// время в часовом поясе now и проверяет, что оно ещё не наступило.
+func parseScheduleTime(args string, now time.Time) (time.Time, error) {
+	t, err := time.Parse("15:04", args)
+	if err != nil {
+		return time.Time{}, errors.Errorf("time must look like 18:00, got %q", args)
+	}
+	at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !at.After(now) {
+		return time.Time{}, errors.Errorf("time %s has already passed", args)
+	}
+	return at, nil
+}
+
+// handleSchedule обрабатывает /schedule 18:00, отправленную ответом на аудио:
+// голосовое из него будет опубликовано отложенно в указанное время.
+func handleSchedule(ctx context.Context, lg *zap.Logger, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, args string, files fileOptions, queue *jobQueue, processed *processedStore) error {
+	const usage = "Usage: reply to an audio with /schedule 18:00"
+
+	// Те же ограничения, что и для аудио, присланного напрямую
+	if !isAllowedSender(messageSender(msg)) {
+		lg.Info("Skip schedule from not allowed sender", zap.Int("msg_id", msg.ID))
+		return nil
+	}
+
+	reply, ok := msg.ReplyTo.(*tg.MessageReplyHeader)
+	if !ok {
+		return sendMessage(ctx, api, peer, usage, msg.ID)
+	}
+	at, err := parseScheduleTime(args, time.Now())
+	if err != nil {
+		return sendMessage(ctx, api, peer, usage+"\n"+err.Error(), msg.ID)
+	}
+
+	source, err := getMessage(ctx, api, peer, reply.ReplyToMsgID)
+	if err != nil {
+		return errors.Wrap(err, "get replied message")
+	}
+	media, ok := source.Media.(*tg.MessageMediaDocument)
+	if !ok {
+		return sendMessage(ctx, api, peer, usage, msg.ID)
+	}
+	doc, ok := media.Document.(*tg.Document)
+	if !ok || !isConvertible(doc) {
+		return sendMessage(ctx, api, peer, usage, msg.ID)
+	}
+
+	if user, ok := messageSender(msg).(*tg.PeerUser); ok && quota != nil && !quota.Allow(user.UserID) {
+		lg.Info("Skip schedule over user quota", zap.Int64("user_id", user.UserID), zap.Int("msg_id", msg.ID))
+		return sendMessage(ctx, api, peer, quotaExceededReply, msg.ID)
+	}
+
+	if err := enqueueAudio(lg, api, peer, source.ID, doc, at, files, queue, processed); err != nil {
+		return err
+	}
+	return sendMessage(ctx, api, peer, "Scheduled for "+at.Format("15:04"), msg.ID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	now := time.Date(2024, 6, 1, 12, 30, 0, 0, loc)
+
+	tests := []struct {
+		args    string
+		want    time.Time
+		wantErr string
+	}{
+		{args: "18:00", want: time.Date(2024, 6, 1, 18, 0, 0, 0, loc)},
+		{args: "12:31", want: time.Date(2024, 6, 1, 12, 31, 0, 0, loc)},
+		{args: "12:30", wantErr: "has already passed"},
+		{args: "09:00", wantErr: "has already passed"},
+		{args: "6pm", wantErr: "time must look like 18:00"},
+		{args: "", wantErr: "time must look like 18:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseScheduleTime(tt.args, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseScheduleTime(%q) = %v, want %q", tt.args, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseScheduleTime(%q) = %s, want %s", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleScheduleUsage(t *testing.T) {
+	peer := &tg.InputPeerUser{UserID: 1, AccessHash: 2}
+	tests := []struct {
+		name string
+		msg  *tg.Message
+		args string
+		want string
+	}{
+		{name: "not a reply", msg: &tg.Message{ID: 5}, args: "23:59", want: "Usage: reply to an audio with /schedule 18:00"},
+		{
+			name: "invalid time",
+			msg:  &tg.Message{ID: 5, ReplyTo: &tg.MessageReplyHeader{ReplyToMsgID: 4}},
+			args: "soon",
+			want: "time must look like 18:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &stubAPI{}
+			if err := handleSchedule(context.Background(), zap.NewNop(), api, peer, tt.msg, tt.args, fileOptions{}, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(api.sentMessages) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(api.sentMessages))
+			}
+			if got := api.sentMessages[0].Message; !strings.Contains(got, tt.want) {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
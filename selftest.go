@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"os"
+	"path/filepath"
+
+	"github.com/go-faster/errors"
+)
+
+// Режимы самопроверки при запуске
+const (
+	selfTestOff  = "off"
+	selfTestWarn = "warn" // при ошибке только предупредить в логе
+	selfTestFail = "fail" // при ошибке не запускаться
+)
+
+// selfTestSample — полсекунды тишины в MP3, 32 кбит/с моно
+//
+//go:embed assets/selftest.mp3
+var selfTestSample []byte
+
+// selfTest конвертирует встроенный MP3 в OGG и проверяет результат, чтобы
+// ошибки в сборке ffmpeg и кодеках обнаружились до первого файла из чата.
+func selfTest(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "mp3_to_voice-selftest-*")
+	if err != nil {
+		return errors.Wrap(err, "create temp dir")
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	input := filepath.Join(dir, "sample.mp3")
+	output := filepath.Join(dir, "sample.ogg")
+	if err := os.WriteFile(input, selfTestSample, 0600); err != nil {
+		return errors.Wrap(err, "write sample")
+	}
+	// Образец целиком из тишины, обрезка оставила бы пустой файл
+	opts := currentOpusOptions()
+	opts.TrimSilence = false
+	if err := convertAudio(ctx, input, output, formatOpus, opts); err != nil {
+		return errors.Wrap(err, "convert sample")
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		return errors.Wrap(err, "stat output")
+	}
+	if info.Size() == 0 {
+		return errors.New("output is empty")
+	}
+	if _, err := probeAudio(ctx, output); err != nil {
+		return errors.Wrap(err, "probe output")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		ffmpeg  string
+		ffprobe string
+		wantErr string
+	}{
+		{name: "working converter", ffmpeg: fakeFFmpegScript, ffprobe: fakeFFprobeScript},
+		{name: "ffmpeg fails", ffmpeg: "echo 'Unknown encoder' >&2; exit 1", ffprobe: fakeFFprobeScript, wantErr: "convert sample"},
+		{name: "empty output", ffmpeg: `for last; do :; done; : > "$last"`, ffprobe: fakeFFprobeScript, wantErr: "convert sample"},
+		{name: "unreadable output", ffmpeg: fakeFFmpegScript, ffprobe: "echo 'Invalid data' >&2; exit 1", wantErr: "convert sample"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFmpeg(t, tt.ffmpeg)
+			setFFprobe(t, tt.ffprobe)
+
+			err := selfTest(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("selfTest() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("selfTest() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestSelfTestFFmpeg конвертирует встроенный образец настоящим ffmpeg. Без
+// ffmpeg в PATH тест пропускается.
+func TestSelfTestFFmpeg(t *testing.T) {
+	requireFFmpeg(t)
+	resetOpusSettings(t, OpusOptions{})
+	if err := selfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/session"
+)
+
+// backupSessionStorage хранит сессию в файле Path как FileSessionStorage, но
+// записывает её атомарно через временный файл и хранит предыдущую версию
+// в Path.bak. Если основной файл повреждён или отсутствует, сессия читается
+// из резервной копии, и повторный вход не нужен.
+type backupSessionStorage struct {
+	Path string
+	mux  sync.Mutex
+}
+
+func (s *backupSessionStorage) backupPath() string {
+	return s.Path + ".bak"
+}
+
+func (s *backupSessionStorage) LoadSession(_ context.Context) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	data, err := readSessionFile(s.Path)
+	if err == nil {
+		return data, nil
+	}
+	backup, backupErr := readSessionFile(s.backupPath())
+	if backupErr == nil {
+		return backup, nil
+	}
+	if os.IsNotExist(err) && os.IsNotExist(backupErr) {
+		return nil, session.ErrNotFound
+	}
+	return nil, errors.Wrap(err, "read session")
+}
+
+// readSessionFile читает файл сессии и проверяет, что он не повреждён.
+func readSessionFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, errors.Errorf("session file %s is corrupted", path)
+	}
+	return data, nil
+}
+
+func (s *backupSessionStorage) StoreSession(_ context.Context, data []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "create temp session file")
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "write session")
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "sync session")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close session")
+	}
+
+	// Исправная текущая сессия становится резервной копией
+	if _, err := readSessionFile(s.Path); err == nil {
+		if err := os.Rename(s.Path, s.backupPath()); err != nil {
+			return errors.Wrap(err, "backup session")
+		}
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return errors.Wrap(err, "replace session")
+	}
+	return nil
+}
+
+// envSessionStorage хранит сессию в памяти, начальное значение берётся из
+// SESSION_DATA в base64. Каталог сессии может не переживать пересборку
+// контейнера, поэтому при каждом изменении сессии новая строка печатается
+// в Out, чтобы её можно было сохранить во внешнем хранилище.
+type envSessionStorage struct {
+	Data []byte
+	Out  io.Writer
+	mux  sync.Mutex
+}
+
+// decodeSessionData разбирает значение SESSION_DATA.
+func decodeSessionData(s string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "decode base64")
+	}
+	if !json.Valid(data) {
+		return nil, errors.New("session data is not valid JSON")
+	}
+	return data, nil
+}
+
+func (s *envSessionStorage) LoadSession(_ context.Context) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.Data) == 0 {
+		return nil, session.ErrNotFound
+	}
+	return bytes.Clone(s.Data), nil
+}
+
+func (s *envSessionStorage) StoreSession(_ context.Context, data []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if bytes.Equal(s.Data, data) {
+		return nil
+	}
+	s.Data = bytes.Clone(data)
+	if _, err := fmt.Fprintf(s.Out, "Session changed, new SESSION_DATA:\n%s\n", base64.StdEncoding.EncodeToString(data)); err != nil {
+		return errors.Wrap(err, "print session")
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gotd/td/session"
+)
+
+func TestBackupSessionStorageLoad(t *testing.T) {
+	const (
+		current = `{"Version":1,"Data":{"DC":2}}`
+		old     = `{"Version":1,"Data":{"DC":1}}`
+	)
+	tests := []struct {
+		name    string
+		primary string // пустая строка — файла нет
+		backup  string
+		want    string
+		wantErr error
+	}{
+		{name: "primary", primary: current, backup: old, want: current},
+		{name: "corrupt primary recovers from backup", primary: `{"Version":1,"Da`, backup: old, want: old},
+		{name: "missing primary recovers from backup", backup: old, want: old},
+		{name: "no session", wantErr: session.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &backupSessionStorage{Path: filepath.Join(t.TempDir(), "session.json")}
+			for path, content := range map[string]string{s.Path: tt.primary, s.backupPath(): tt.backup} {
+				if content == "" {
+					continue
+				}
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := s.LoadSession(context.Background())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("LoadSession() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("LoadSession() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupSessionStorageLoadCorrupt(t *testing.T) {
+	s := &backupSessionStorage{Path: filepath.Join(t.TempDir(), "session.json")}
+	if err := os.WriteFile(s.Path, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadSession(context.Background()); err == nil || errors.Is(err, session.ErrNotFound) {
+		t.Errorf("LoadSession() = %v, want corrupted session error", err)
+	}
+}
+
+func TestBackupSessionStorageStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		primary    string
+		wantBackup string
+	}{
+		{name: "first session"},
+		{name: "previous session becomes backup", primary: `{"n":1}`, wantBackup: `{"n":1}`},
+		{name: "corrupt session is not backed up", primary: `{"n":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := &backupSessionStorage{Path: filepath.Join(dir, "session.json")}
+			if tt.primary != "" {
+				if err := os.WriteFile(s.Path, []byte(tt.primary), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := s.StoreSession(context.Background(), []byte(`{"n":2}`)); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(s.Path); string(data) != `{"n":2}` {
+				t.Errorf("session = %s", data)
+			}
+			backup, err := os.ReadFile(s.backupPath())
+			if tt.wantBackup == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("backup = %s, %v, want none", backup, err)
+				}
+			} else if string(backup) != tt.wantBackup {
+				t.Errorf("backup = %s, want %s", backup, tt.wantBackup)
+			}
+			// Временные файлы не остаются
+			if tmp, _ := filepath.Glob(filepath.Join(dir, "session.json.tmp-*")); len(tmp) != 0 {
+				t.Errorf("temp files left: %v", tmp)
+			}
+		})
+	}
+}
+
+func TestDecodeSessionData(t *testing.T) {
+	const session = `{"Version":1,"Data":{"DC":2}}`
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", value: base64.StdEncoding.EncodeToString([]byte(session)), want: session},
+		{name: "surrounding whitespace", value: " " + base64.StdEncoding.EncodeToString([]byte(session)) + "\n", want: session},
+		{name: "not base64", value: "not base64!", wantErr: true},
+		{name: "not json", value: base64.StdEncoding.EncodeToString([]byte("garbage")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSessionData(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSessionData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decodeSessionData() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvSessionStorage(t *testing.T) {
+	const (
+		initial = `{"Version":1,"Data":{"DC":2}}`
+		updated = `{"Version":1,"Data":{"DC":4}}`
+	)
+
+	tests := []struct {
+		name      string
+		data      string // начальное значение из SESSION_DATA
+		store     string // пустая строка — сессия не сохраняется
+		wantPrint bool
+	}{
+		{name: "empty", data: ""},
+		{name: "initial session", data: initial},
+		{name: "new session is printed", store: updated, wantPrint: true},
+		{name: "changed session is printed", data: initial, store: updated, wantPrint: true},
+		{name: "unchanged session is not printed", data: initial, store: initial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			s := &envSessionStorage{Data: []byte(tt.data), Out: &out}
+			ctx := context.Background()
+			if tt.store != "" {
+				if err := s.StoreSession(ctx, []byte(tt.store)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := tt.data
+			if tt.store != "" {
+				want = tt.store
+			}
+			got, err := s.LoadSession(ctx)
+			if want == "" {
+				if !errors.Is(err, session.ErrNotFound) {
+					t.Errorf("LoadSession() = %q, %v, want ErrNotFound", got, err)
+				}
+				return
+			}
+			if err != nil || string(got) != want {
+				t.Fatalf("LoadSession() = %q, %v, want %q", got, err, want)
+			}
+
+			if !tt.wantPrint {
+				if out.Len() != 0 {
+					t.Errorf("printed %q, want nothing", out.String())
+				}
+				return
+			}
+			// Напечатанная строка восстанавливает ту же сессию после перезапуска
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			restored, err := decodeSessionData(lines[len(lines)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			reloaded := &envSessionStorage{Data: restored, Out: io.Discard}
+			if got, err := reloaded.LoadSession(ctx); err != nil || string(got) != tt.store {
+				t.Errorf("restored session = %q, %v, want %q", got, err, tt.store)
+			}
+		})
+	}
+}
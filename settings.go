@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"go.etcd.io/bbolt"
+)
+
+var settingsBucket = []byte("settings")
+
+// Имена настроек чата, ключ в бакете — "<chat>:<имя>"
+const (
+	bitrateSettingKey   = "bitrate"
+	normalizeSettingKey = "normalize"
+)
+
+// Значения, которые можно задать командой /bitrate
+var allowedBitrates = []string{"16k", "24k", "32k", "48k", "64k", "96k", "128k"}
+
+// chatSettings переопределяет параметры кодирования для одного чата.
+// Пустые поля означают глобальные значения из окружения.
+type chatSettings struct {
+	Bitrate   string
+	Normalize string // "on", "off" или пусто
+}
+
+// apply накладывает настройки чата на глобальные параметры кодирования.
+func (c chatSettings) apply(opts OpusOptions) OpusOptions {
+	if c.Bitrate != "" {
+		opts.Bitrate = c.Bitrate
+	}
+	if c.Normalize != "" {
+		opts.Normalize = c.Normalize == "on"
+	}
+	return opts
+}
+
+// set меняет настройку по имени. ok равен false для неизвестного имени.
+func (c *chatSettings) set(name, value string) (ok bool) {
+	switch name {
+	case bitrateSettingKey:
+		c.Bitrate = value
+	case normalizeSettingKey:
+		c.Normalize = value
+	default:
+		return false
+	}
+	return true
+}
+
+// settingsStore хранит настройки чатов, изменённые командами, между перезапусками.
+type settingsStore struct {
+	db *bbolt.DB
+}
+
+func newSettingsStore(db *bbolt.DB) (*settingsStore, error) {
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(settingsBucket)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "create settings bucket")
+	}
+	return &settingsStore{db: db}, nil
+}
+
+func settingKey(chatID int64, name string) []byte {
+	return fmt.Appendf(nil, "%d:%s", chatID, name)
+}
+
+// Get возвращает сохранённое значение настройки чата или пустую строку.
+func (s *settingsStore) Get(chatID int64, name string) (string, error) {
+	var value string
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value = string(tx.Bucket(settingsBucket).Get(settingKey(chatID, name)))
+		return nil
+	})
+	return value, err
+}
+
+// Set сохраняет настройку чата; пустое значение возвращает глобальное.
+func (s *settingsStore) Set(chatID int64, name, value string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(settingsBucket)
+		if value == "" {
+			return b.Delete(settingKey(chatID, name))
+		}
+		return b.Put(settingKey(chatID, name), []byte(value))
+	})
+}
+
+// All возвращает настройки всех чатов. Ключи в другом формате пропускаются.
+func (s *settingsStore) All() (map[int64]chatSettings, error) {
+	chats := map[int64]chatSettings{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(settingsBucket).ForEach(func(k, v []byte) error {
+			chat, name, ok := strings.Cut(string(k), ":")
+			if !ok {
+				return nil
+			}
+			chatID, err := strconv.ParseInt(chat, 10, 64)
+			if err != nil {
+				return nil
+			}
+			c := chats[chatID]
+			if c.set(name, string(v)) {
+				chats[chatID] = c
+			}
+			return nil
+		})
+	})
+	return chats, err
+}
+
+// opusSettings защищает opusOptions, которые меняются командой /reload,
+// и настройки чатов, заданные командами /bitrate и /normalize
+var opusSettings struct {
+	sync.RWMutex
+	chats map[int64]chatSettings
+}
+
+func setChatSettings(chats map[int64]chatSettings) {
+	opusSettings.Lock()
+	defer opusSettings.Unlock()
+	opusSettings.chats = chats
+}
+
+func setChatSetting(chatID int64, name, value string) {
+	opusSettings.Lock()
+	defer opusSettings.Unlock()
+	if opusSettings.chats == nil {
+		opusSettings.chats = map[int64]chatSettings{}
+	}
+	c := opusSettings.chats[chatID]
+	c.set(name, value)
+	opusSettings.chats[chatID] = c
+}
+
+func setOpusOptions(opts OpusOptions) {
+	opusSettings.Lock()
+	defer opusSettings.Unlock()
+	opusOptions = opts
+}
+
+// currentOpusOptions возвращает глобальные параметры кодирования.
+func currentOpusOptions() OpusOptions {
+	opusSettings.RLock()
+	defer opusSettings.RUnlock()
+	return opusOptions
+}
+
+// chatOpusOptions возвращает параметры кодирования для чата с учётом его настроек.
+func chatOpusOptions(chatID int64) OpusOptions {
+	opusSettings.RLock()
+	defer opusSettings.RUnlock()
+	return opusSettings.chats[chatID].apply(opusOptions)
+}
+
+// parseBitrate проверяет аргумент команды /bitrate.
+func parseBitrate(args string) (string, error) {
+	if !slices.Contains(allowedBitrates, args) {
+		return "", errors.Errorf("bitrate must be one of %v, got %q", allowedBitrates, args)
+	}
+	return args, nil
+}
+
+// handleBitrate показывает или меняет битрейт для следующих конвертаций в этом
+// чате. "/bitrate default" возвращает глобальный битрейт.
+func handleBitrate(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, args string, settings *settingsStore) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	chatID := inputPeerID(peer)
+	if args == "" {
+		opts := chatOpusOptions(chatID)
+		bitrate := opts.Bitrate
+		if bitrate == "" {
+			bitrate = "default"
+		}
+		return sendMessage(ctx, api, peer, "Bitrate: "+bitrate, msg.ID)
+	}
+	var bitrate string
+	if args != "default" {
+		var err error
+		if bitrate, err = parseBitrate(args); err != nil {
+			return sendMessage(ctx, api, peer, "Usage: /bitrate 32k\n"+err.Error(), msg.ID)
+		}
+	}
+	if err := settings.Set(chatID, bitrateSettingKey, bitrate); err != nil {
+		return errors.Wrap(err, "save bitrate")
+	}
+	setChatSetting(chatID, bitrateSettingKey, bitrate)
+	return sendMessage(ctx, api, peer, fmt.Sprintf("Bitrate set to %s", args), msg.ID)
+}
+
+// handleNormalize показывает или меняет выравнивание громкости в этом чате.
+func handleNormalize(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message, args string, settings *settingsStore) error {
+	if !isAdmin(msg) {
+		return nil
+	}
+	chatID := inputPeerID(peer)
+	if args == "" {
+		opts := chatOpusOptions(chatID)
+		return sendMessage(ctx, api, peer, fmt.Sprintf("Normalize: %t", opts.Normalize), msg.ID)
+	}
+	var value string
+	switch args {
+	case "on", "off":
+		value = args
+	case "default":
+	default:
+		return sendMessage(ctx, api, peer, "Usage: /normalize on|off|default", msg.ID)
+	}
+	if err := settings.Set(chatID, normalizeSettingKey, value); err != nil {
+		return errors.Wrap(err, "save normalize")
+	}
+	setChatSetting(chatID, normalizeSettingKey, value)
+	return sendMessage(ctx, api, peer, "Normalize set to "+args, msg.ID)
+}
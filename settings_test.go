@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"go.etcd.io/bbolt"
+)
+
+// resetOpusSettings восстанавливает глобальные параметры кодирования после теста.
+func resetOpusSettings(t *testing.T, opts OpusOptions) {
+	t.Helper()
+	setOpusOptions(opts)
+	setChatSettings(nil)
+	t.Cleanup(func() {
+		setOpusOptions(OpusOptions{})
+		setChatSettings(nil)
+	})
+}
+
+func TestHandleBitrate(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	const admin = 10
+
+	tests := []struct {
+		name        string
+		from        int64
+		args        []string // команды по порядку
+		wantReply   string   // ответ на последнюю команду
+		wantBitrate string   // битрейт чата после команд
+	}{
+		{name: "show global", from: admin, args: []string{""}, wantReply: "Bitrate: 24k", wantBitrate: "24k"},
+		{name: "set", from: admin, args: []string{"32k"}, wantReply: "Bitrate set to 32k", wantBitrate: "32k"},
+		{name: "show chat bitrate", from: admin, args: []string{"48k", ""}, wantReply: "Bitrate: 48k", wantBitrate: "48k"},
+		{name: "reset to default", from: admin, args: []string{"32k", "default"}, wantReply: "Bitrate set to default", wantBitrate: "24k"},
+		{name: "unsupported value", from: admin, args: []string{"33k"}, wantReply: "Usage: /bitrate 32k\nbitrate must be one of [16k 24k 32k 48k 64k 96k 128k], got \"33k\"", wantBitrate: "24k"},
+		{name: "not an admin", from: admin + 1, args: []string{"32k"}, wantBitrate: "24k"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOpusSettings(t, OpusOptions{Bitrate: "24k"})
+			setVar(t, &allowedUsers, map[int64]struct{}{admin: {}})
+			settings, err := newSettingsStore(testBolt(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &stubAPI{}
+			msg := &tg.Message{ID: 5, FromID: &tg.PeerUser{UserID: tt.from}}
+
+			for _, args := range tt.args {
+				if err := handleBitrate(context.Background(), api, peer, msg, args, settings); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var reply string
+			if n := len(api.sentMessages); n > 0 {
+				reply = api.sentMessages[n-1].Message
+			}
+			if reply != tt.wantReply {
+				t.Errorf("reply = %q, want %q", reply, tt.wantReply)
+			}
+			if opts := chatOpusOptions(inputPeerID(peer)); opts.Bitrate != tt.wantBitrate {
+				t.Errorf("chat bitrate = %q, want %q", opts.Bitrate, tt.wantBitrate)
+			}
+		})
+	}
+}
+
+func TestChatOpusOptions(t *testing.T) {
+	global := OpusOptions{Bitrate: "24k", Normalize: true, Application: "voip"}
+	tests := []struct {
+		name string
+		chat chatSettings
+		want OpusOptions
+	}{
+		{name: "global", want: global},
+		{name: "bitrate override", chat: chatSettings{Bitrate: "64k"}, want: OpusOptions{Bitrate: "64k", Normalize: true, Application: "voip"}},
+		{name: "normalize off", chat: chatSettings{Normalize: "off"}, want: OpusOptions{Bitrate: "24k", Application: "voip"}},
+		{name: "both", chat: chatSettings{Bitrate: "32k", Normalize: "on"}, want: OpusOptions{Bitrate: "32k", Normalize: true, Application: "voip"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOpusSettings(t, global)
+			setChatSettings(map[int64]chatSettings{1: tt.chat})
+
+			if opts := chatOpusOptions(1); opts != tt.want {
+				t.Errorf("chatOpusOptions(1) = %+v, want %+v", opts, tt.want)
+			}
+			// Другие чаты используют глобальные настройки
+			if opts := chatOpusOptions(2); opts != global {
+				t.Errorf("chatOpusOptions(2) = %+v", opts)
+			}
+		})
+	}
+}
+
+func TestSettingsStore(t *testing.T) {
+	db := testBolt(t)
+	s, err := newSettingsStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []struct {
+		chat        int64
+		name, value string
+	}{
+		{1, bitrateSettingKey, "32k"},
+		{1, normalizeSettingKey, "on"},
+		{-1002, bitrateSettingKey, "64k"},
+		{-1002, normalizeSettingKey, "off"},
+		// Пустое значение возвращает глобальное
+		{-1002, normalizeSettingKey, ""},
+		{3, "unknown", "value"},
+	} {
+		if err := s.Set(set.chat, set.name, set.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Чужие ключи в бакете не мешают чтению
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(settingsBucket).Put([]byte("garbage"), []byte("x"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := s.Get(1, bitrateSettingKey); err != nil || got != "32k" {
+		t.Errorf("Get(1, bitrate) = %q, %v", got, err)
+	}
+	if got, err := s.Get(-1002, normalizeSettingKey); err != nil || got != "" {
+		t.Errorf("Get(-1002, normalize) = %q, %v, want empty", got, err)
+	}
+	got, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]chatSettings{
+		1:     {Bitrate: "32k", Normalize: "on"},
+		-1002: {Bitrate: "64k"},
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("All() = %v, want %v", got, want)
+	}
+}
+
+func TestHandleNormalize(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	const admin = 10
+
+	tests := []struct {
+		name          string
+		from          int64
+		args          []string
+		wantReply     string
+		wantNormalize bool
+	}{
+		{name: "show global", from: admin, args: []string{""}, wantReply: "Normalize: false"},
+		{name: "on", from: admin, args: []string{"on"}, wantReply: "Normalize set to on", wantNormalize: true},
+		{name: "show chat setting", from: admin, args: []string{"on", ""}, wantReply: "Normalize: true", wantNormalize: true},
+		{name: "reset to default", from: admin, args: []string{"on", "default"}, wantReply: "Normalize set to default"},
+		{name: "invalid", from: admin, args: []string{"yes"}, wantReply: "Usage: /normalize on|off|default"},
+		{name: "not an admin", from: admin + 1, args: []string{"on"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOpusSettings(t, OpusOptions{})
+			setVar(t, &allowedUsers, map[int64]struct{}{admin: {}})
+			settings, err := newSettingsStore(testBolt(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &stubAPI{}
+			msg := &tg.Message{ID: 5, FromID: &tg.PeerUser{UserID: tt.from}}
+
+			for _, args := range tt.args {
+				if err := handleNormalize(context.Background(), api, peer, msg, args, settings); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var reply string
+			if n := len(api.sentMessages); n > 0 {
+				reply = api.sentMessages[n-1].Message
+			}
+			if reply != tt.wantReply {
+				t.Errorf("reply = %q, want %q", reply, tt.wantReply)
+			}
+			if opts := chatOpusOptions(inputPeerID(peer)); opts.Normalize != tt.wantNormalize {
+				t.Errorf("chat normalize = %t, want %t", opts.Normalize, tt.wantNormalize)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-faster/errors"
+	"github.com/gotd/td/tg"
+	"go.etcd.io/bbolt"
+)
+
+var statsBucket = []byte("stats")
+
+// Ключи счётчиков в бакете stats
+var (
+	statsProcessedKey       = []byte("processed")
+	statsFailedKey          = []byte("failed")
+	statsSkippedKey         = []byte("skipped")
+	statsDownloadedBytesKey = []byte("downloaded_bytes")
+	statsConversionTimeKey  = []byte("conversion_ns")
+)
+
+// statsCounters — накопленные счётчики обработки.
+type statsCounters struct {
+	Processed       int64
+	Failed          int64
+	Skipped         int64
+	DownloadedBytes int64
+	ConversionTime  time.Duration
+}
+
+func (c statsCounters) add(o statsCounters) statsCounters {
+	return statsCounters{
+		Processed:       c.Processed + o.Processed,
+		Failed:          c.Failed + o.Failed,
+		Skipped:         c.Skipped + o.Skipped,
+		DownloadedBytes: c.DownloadedBytes + o.DownloadedBytes,
+		ConversionTime:  c.ConversionTime + o.ConversionTime,
+	}
+}
+
+func (c statsCounters) sub(o statsCounters) statsCounters {
+	return c.add(statsCounters{
+		Processed:       -o.Processed,
+		Failed:          -o.Failed,
+		Skipped:         -o.Skipped,
+		DownloadedBytes: -o.DownloadedBytes,
+		ConversionTime:  -o.ConversionTime,
+	})
+}
+
+// statsStore хранит счётчики за всё время работы бота. Счётчики текущего
+// запуска досчитываются в source и сохраняются в Flush.
+type statsStore struct {
+	db     *bbolt.DB
+	source *processingStats
+
+	mux     sync.Mutex
+	flushed statsCounters // часть счётчиков текущего запуска, уже сохранённая в базе
+}
+
+// statsDB равен nil, пока хранилище не открыто
+var statsDB *statsStore
+
+func newStatsStore(db *bbolt.DB, source *processingStats) (*statsStore, error) {
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(statsBucket)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "create stats bucket")
+	}
+	return &statsStore{db: db, source: source}, nil
+}
+
+// Flush добавляет к сохранённым счётчикам то, что накопилось с прошлого вызова.
+// Снимок берётся под блокировкой, иначе параллельные вызовы могли бы сохранить
+// более старый снимок после нового.
+func (s *statsStore) Flush() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	current := s.source.snapshot()
+	delta := current.sub(s.flushed)
+	if delta == (statsCounters{}) {
+		return nil
+	}
+	if err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(statsBucket)
+		for _, v := range []struct {
+			key   []byte
+			delta int64
+		}{
+			{statsProcessedKey, delta.Processed},
+			{statsFailedKey, delta.Failed},
+			{statsSkippedKey, delta.Skipped},
+			{statsDownloadedBytesKey, delta.DownloadedBytes},
+			{statsConversionTimeKey, int64(delta.ConversionTime)},
+		} {
+			if err := b.Put(v.key, []byte(strconv.FormatInt(counterValue(b, v.key)+v.delta, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "save stats")
+	}
+	s.flushed = current
+	return nil
+}
+
+// AllTime возвращает счётчики за всё время с учётом ещё не сохранённых.
+func (s *statsStore) AllTime() (statsCounters, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	current := s.source.snapshot()
+	var saved statsCounters
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(statsBucket)
+		saved = statsCounters{
+			Processed:       counterValue(b, statsProcessedKey),
+			Failed:          counterValue(b, statsFailedKey),
+			Skipped:         counterValue(b, statsSkippedKey),
+			DownloadedBytes: counterValue(b, statsDownloadedBytesKey),
+			ConversionTime:  time.Duration(counterValue(b, statsConversionTimeKey)),
+		}
+		return nil
+	}); err != nil {
+		return statsCounters{}, errors.Wrap(err, "load stats")
+	}
+	return saved.add(current.sub(s.flushed)), nil
+}
+
+// counterValue читает счётчик из бакета. Отсутствующий или повреждённый счётчик равен нулю.
+func counterValue(b *bbolt.Bucket, key []byte) int64 {
+	v, err := strconv.ParseInt(string(b.Get(key)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// formatBytes печатает размер в двоичных единицах, например "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// statsReply форматирует ответ на /stats.
+func statsReply(session, allTime statsCounters) string {
+	section := func(title string, c statsCounters) string {
+		return fmt.Sprintf("%s:\nFiles: %d (succeeded %d, failed %d, skipped %d)\nDownloaded: %s\nConversion time: %s",
+			title,
+			c.Processed+c.Failed+c.Skipped, c.Processed, c.Failed, c.Skipped,
+			formatBytes(c.DownloadedBytes),
+			c.ConversionTime.Truncate(time.Second),
+		)
+	}
+	return section("Since start", session) + "\n\n" + section("All time", allTime)
+}
+
+// handleStats отвечает на /stats счётчиками с момента запуска и за всё время.
+func handleStats(ctx context.Context, api telegramAPI, peer tg.InputPeerClass, msg *tg.Message) error {
+	session := stats.snapshot()
+	allTime := session
+	if statsDB != nil {
+		var err error
+		if allTime, err = statsDB.AllTime(); err != nil {
+			return err
+		}
+	}
+	return sendMessage(ctx, api, peer, statsReply(session, allTime), msg.ID)
+}
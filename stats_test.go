@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0 B"},
+		{n: 1023, want: "1023 B"},
+		{n: 1024, want: "1.0 KiB"},
+		{n: 1536 * 1024, want: "1.5 MiB"},
+		{n: 3 << 30, want: "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatBytes(tt.n); got != tt.want {
+				t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsReply(t *testing.T) {
+	session := statsCounters{Processed: 2, Failed: 1, DownloadedBytes: 2048, ConversionTime: 1500 * time.Millisecond}
+	allTime := statsCounters{Processed: 10, Failed: 2, Skipped: 3, DownloadedBytes: 5 << 20, ConversionTime: 90 * time.Second}
+
+	want := "Since start:\n" +
+		"Files: 3 (succeeded 2, failed 1, skipped 0)\n" +
+		"Downloaded: 2.0 KiB\n" +
+		"Conversion time: 1s\n" +
+		"\n" +
+		"All time:\n" +
+		"Files: 15 (succeeded 10, failed 2, skipped 3)\n" +
+		"Downloaded: 5.0 MiB\n" +
+		"Conversion time: 1m30s"
+	if got := statsReply(session, allTime); got != want {
+		t.Errorf("statsReply() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// statsRun описывает один запуск бота: результаты файлов и сохранение
+// счётчиков при остановке.
+type statsRun struct {
+	sent, failed int
+	bytes        int64
+	flush        bool
+}
+
+func (r statsRun) apply(s *processingStats) {
+	for range r.sent {
+		s.record(conversionSent, nil)
+	}
+	for range r.failed {
+		s.record(conversionFailed, errors.New("convert"))
+	}
+	s.downloadedBytes.Add(r.bytes)
+}
+
+func TestStatsStore(t *testing.T) {
+	tests := []struct {
+		name string
+		runs []statsRun
+		want statsCounters // за всё время после последнего запуска
+	}{
+		{name: "unsaved counters are included", runs: []statsRun{{sent: 2, bytes: 100}}, want: statsCounters{Processed: 2, DownloadedBytes: 100}},
+		{
+			name: "saved counters survive restart",
+			runs: []statsRun{{sent: 2, failed: 1, bytes: 100, flush: true}, {sent: 1, bytes: 50}},
+			want: statsCounters{Processed: 3, Failed: 1, DownloadedBytes: 150},
+		},
+		{
+			// Без Flush счётчики запуска теряются
+			name: "unsaved counters are lost on restart",
+			runs: []statsRun{{sent: 2}, {sent: 1, flush: true}},
+			want: statsCounters{Processed: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testBolt(t)
+			var store *statsStore
+			for _, run := range tt.runs {
+				source := &processingStats{started: time.Now()}
+				var err error
+				if store, err = newStatsStore(db, source); err != nil {
+					t.Fatal(err)
+				}
+				run.apply(source)
+				if run.flush {
+					// Повторный Flush не учитывает счётчики второй раз
+					for range 2 {
+						if err := store.Flush(); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+			got, err := store.AllTime()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("AllTime() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+	source := &processingStats{started: time.Now()}
+	statsRun{sent: 1}.apply(source)
+	setVar(t, &stats, source)
+	db := testBolt(t)
+	// Счётчики прошлого запуска
+	previous, err := newStatsStore(db, &processingStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsRun{sent: 4}.apply(previous.source)
+	if err := previous.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newStatsStore(db, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &statsDB, store)
+	api := &stubAPI{}
+
+	if err := handleStats(context.Background(), api, peer, &tg.Message{ID: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.sentMessages) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(api.sentMessages))
+	}
+	reply := api.sentMessages[0].Message
+	for _, want := range []string{"Since start:\nFiles: 1 (succeeded 1", "All time:\nFiles: 5 (succeeded 5"} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("reply %q does not contain %q", reply, want)
+		}
+	}
+}
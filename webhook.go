@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// Заголовок с HMAC-SHA256 тела запроса, ключ задаётся через WEBHOOK_SECRET
+const webhookSignatureHeader = "X-Signature-256"
+
+// Статусы обработки в событии вебхука
+const (
+	conversionSent    = "sent"
+	conversionFailed  = "failed"
+	conversionSkipped = "skipped"
+)
+
+// conversionEvent отправляется на WEBHOOK_URL после обработки каждого файла.
+type conversionEvent struct {
+	DocID      int64  `json:"doc_id"`
+	ChatID     int64  `json:"chat_id"`
+	MsgID      int    `json:"msg_id"`
+	Status     string `json:"status"`
+	OutputSize int64  `json:"output_size,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// webhookNotifier отправляет события обработки во внешнюю систему.
+// Доставка не гарантируется: ошибки только логируются.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	lg     *zap.Logger
+}
+
+// webhook равен nil, если WEBHOOK_URL не задан
+var webhook *webhookNotifier
+
+func newWebhookNotifier(url, secret string, lg *zap.Logger) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+		lg:     lg,
+	}
+}
+
+// Notify отправляет событие в фоне, не задерживая обработку файлов.
+func (w *webhookNotifier) Notify(event conversionEvent) {
+	go func() {
+		if err := w.post(context.Background(), event); err != nil {
+			w.lg.Warn("Send webhook", zap.Int64("doc_id", event.DocID), zap.Error(err))
+		}
+	}()
+}
+
+func (w *webhookNotifier) post(ctx context.Context, event conversionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "marshal event")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "post")
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload возвращает HMAC-SHA256 тела в hex.
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// webhookRequest — запрос, полученный тестовым сервером вебхука.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer запускает сервер, который передаёт запросы в канал и
+// отвечает status.
+func webhookServer(t *testing.T, status int) (*httptest.Server, <-chan webhookRequest) {
+	t.Helper()
+	requests := make(chan webhookRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		requests <- webhookRequest{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+// receiveWebhook ждёт запрос, который Notify отправляет в фоне.
+func receiveWebhook(t *testing.T, requests <-chan webhookRequest) webhookRequest {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+		return webhookRequest{}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	event := conversionEvent{DocID: 7, ChatID: 100, MsgID: 10, Status: conversionSent, OutputSize: 2048}
+
+	tests := []struct {
+		name     string
+		secret   string
+		wantSign bool
+		status   int
+	}{
+		{name: "signed", secret: "s3cret", wantSign: true, status: http.StatusNoContent},
+		{name: "unsigned without secret", status: http.StatusOK},
+		// Ошибка сервера только логируется
+		{name: "server error", secret: "s3cret", wantSign: true, status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := webhookServer(t, tt.status)
+			w := newWebhookNotifier(srv.URL, tt.secret, zap.NewNop())
+
+			w.Notify(event)
+			req := receiveWebhook(t, requests)
+
+			if ct := req.header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var got conversionEvent
+			if err := json.Unmarshal(req.body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != event {
+				t.Errorf("payload = %+v, want %+v", got, event)
+			}
+			for _, key := range []string{`"doc_id":7`, `"chat_id":100`, `"status":"sent"`, `"output_size":2048`} {
+				if !strings.Contains(string(req.body), key) {
+					t.Errorf("payload %s does not contain %s", req.body, key)
+				}
+			}
+
+			sign := req.header.Get(webhookSignatureHeader)
+			if !tt.wantSign {
+				if sign != "" {
+					t.Errorf("signature %q without secret", sign)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(tt.secret))
+			mac.Write(req.body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sign != want {
+				t.Errorf("signature = %q, want %q", sign, want)
+			}
+		})
+	}
+}
+
+func TestWebhookPostStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "accepted", status: http.StatusAccepted},
+		{name: "client error", status: http.StatusBadRequest, wantErr: true},
+		{name: "server error", status: http.StatusBadGateway, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := webhookServer(t, tt.status)
+			w := newWebhookNotifier(srv.URL, "", zap.NewNop())
+			if err := w.post(context.Background(), conversionEvent{DocID: 1}); (err != nil) != tt.wantErr {
+				t.Errorf("post() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessAudioWebhook(t *testing.T) {
+	setFFprobe(t, fakeFFprobeScript)
+	setOggCache(t)
+	peer := &tg.InputPeerChannel{ChannelID: 1, AccessHash: 2}
+
+	tests := []struct {
+		name       string
+		ffmpeg     string
+		wantStatus string
+		wantReason string
+	}{
+		{name: "sent", ffmpeg: fakeFFmpegScript, wantStatus: conversionSent},
+		{name: "failed", ffmpeg: "exit 1", wantStatus: conversionFailed, wantReason: "ошибка конвертации"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFFmpeg(t, tt.ffmpeg)
+			srv, requests := webhookServer(t, http.StatusOK)
+			setVar(t, &webhook, newWebhookNotifier(srv.URL, "", zap.NewNop()))
+			doc, content := testAudio("audio/mpeg", "song.mp3", &tg.DocumentAttributeAudio{Duration: 3})
+			api := &stubAPI{files: map[int64][]byte{doc.ID: content}}
+			dir := t.TempDir()
+			files := fileOptions{DownloadDir: filepath.Join(dir, "downloads"), OggDir: filepath.Join(dir, "ogg")}
+
+			_ = processAudio(context.Background(), zap.NewNop(), api, peer, 10, doc, time.Time{}, files)
+
+			var got conversionEvent
+			if err := json.Unmarshal(receiveWebhook(t, requests).body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.DocID != doc.ID || got.ChatID != inputPeerID(peer) || got.MsgID != 10 {
+				t.Errorf("event = %+v", got)
+			}
+			if got.Status != tt.wantStatus || got.Reason != tt.wantReason {
+				t.Errorf("status %q, reason %q, want %q, %q", got.Status, got.Reason, tt.wantStatus, tt.wantReason)
+			}
+			if (got.OutputSize > 0) != (tt.wantStatus == conversionSent) {
+				t.Errorf("output size = %d", got.OutputSize)
+			}
+		})
+	}
+}